@@ -0,0 +1,196 @@
+package alerts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/steinarvk/watcher/storage"
+)
+
+// ValidatePattern checks that a silence pattern is a valid path.Match
+// pattern. Note that '*' does not match '/', so "a/*" silences the
+// triggers directly under "a" only.
+func ValidatePattern(pattern string) error {
+	if pattern == "" {
+		return errors.New("empty pattern")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	return nil
+}
+
+// FindSilence returns the first of the silences that matches the trigger
+// path, or nil if there is none.
+func FindSilence(silences []*storage.Silence, triggerPath string) *storage.Silence {
+	for _, silence := range silences {
+		if ok, _ := path.Match(silence.PathPattern, triggerPath); ok {
+			return silence
+		}
+	}
+	return nil
+}
+
+// NewSilence validates and creates a silence lasting from now until the
+// given time.
+func NewSilence(db storage.Store, pattern string, until time.Time, author, comment string) (*storage.Silence, error) {
+	if err := ValidatePattern(pattern); err != nil {
+		return nil, err
+	}
+	if author == "" {
+		return nil, errors.New("missing author")
+	}
+	now := time.Now()
+	if !until.After(now) {
+		return nil, fmt.Errorf("silence would end in the past (%v)", until)
+	}
+
+	silence := &storage.Silence{
+		PathPattern: pattern,
+		Created:     now,
+		Expires:     until,
+		Author:      author,
+		Comment:     comment,
+	}
+	id, err := db.CreateSilence(silence)
+	if err != nil {
+		return nil, err
+	}
+	silence.Id = id
+
+	log.Printf("created silence %d for %q until %v by %q: %q", id, pattern, until, author, comment)
+
+	return silence, nil
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("error writing response: %v", err)
+	}
+}
+
+// Handler serves the alert API:
+//
+//	GET  <prefix>/silences         lists the active silences
+//	POST <prefix>/silences         creates a silence
+//	POST <prefix>/silences/expire  expires a silence (?id=N)
+//	POST <prefix>/ack              acknowledges a firing trigger
+func Handler(db storage.Store, prefix string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(prefix+"/silences", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			silences, err := db.GetActiveSilences(time.Now())
+			if err != nil {
+				http.Error(w, "failed to read from database", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, silences)
+
+		case "POST":
+			request := struct {
+				PathPattern string `json:"path_pattern"`
+				Until       string `json:"until"`
+				Duration    string `json:"duration"`
+				Author      string `json:"author"`
+				Comment     string `json:"comment"`
+			}{}
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				http.Error(w, "JSON parse error", http.StatusBadRequest)
+				return
+			}
+
+			var until time.Time
+			switch {
+			case request.Until != "" && request.Duration != "":
+				http.Error(w, "'until' and 'duration' are mutually exclusive", http.StatusBadRequest)
+				return
+			case request.Until != "":
+				t, err := time.Parse(time.RFC3339, request.Until)
+				if err != nil {
+					http.Error(w, "invalid 'until' (want RFC3339)", http.StatusBadRequest)
+					return
+				}
+				until = t
+			case request.Duration != "":
+				dur, err := time.ParseDuration(request.Duration)
+				if err != nil {
+					http.Error(w, "invalid 'duration'", http.StatusBadRequest)
+					return
+				}
+				until = time.Now().Add(dur)
+			default:
+				http.Error(w, "missing 'until' or 'duration'", http.StatusBadRequest)
+				return
+			}
+
+			silence, err := NewSilence(db, request.PathPattern, until, request.Author, request.Comment)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writeJSON(w, silence)
+
+		default:
+			http.Error(w, "only GET and POST allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc(prefix+"/silences/expire", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.ParseInt(req.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid or missing 'id'", http.StatusBadRequest)
+			return
+		}
+		if err := db.ExpireSilence(id, time.Now()); err != nil {
+			http.Error(w, "failed to write to database", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("expired silence %d", id)
+		writeJSON(w, map[string]int64{"expired": id})
+	})
+
+	mux.HandleFunc(prefix+"/ack", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "only POST allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		request := struct {
+			TriggerPath string `json:"trigger_path"`
+			Author      string `json:"author"`
+		}{}
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			http.Error(w, "JSON parse error", http.StatusBadRequest)
+			return
+		}
+		if request.TriggerPath == "" || request.Author == "" {
+			http.Error(w, "missing 'trigger_path' or 'author'", http.StatusBadRequest)
+			return
+		}
+		err := db.AcknowledgeAlert(request.TriggerPath, request.Author, time.Now())
+		if err == storage.ErrNotFiring {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to write to database", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("alert %q acknowledged by %q", request.TriggerPath, request.Author)
+		writeJSON(w, request)
+	})
+
+	return mux
+}
@@ -0,0 +1,93 @@
+package alerts
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/watcher/storage"
+)
+
+func request(t *testing.T, h http.Handler, method, url, body string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+	return rec.Code, rec.Body.String()
+}
+
+func TestSilences(t *testing.T) {
+	db := storage.NewMemory()
+	h := Handler(db, "/alerts")
+
+	for _, body := range []string{
+		`{"path_pattern": "w/*", "author": "tester"}`,
+		`{"path_pattern": "w/*", "duration": "1h"}`,
+		`{"path_pattern": "[", "duration": "1h", "author": "tester"}`,
+		`{"path_pattern": "w/*", "duration": "1h", "until": "2030-01-01T00:00:00Z", "author": "tester"}`,
+	} {
+		if code, _ := request(t, h, "POST", "/alerts/silences", body); code != http.StatusBadRequest {
+			t.Errorf("POST %s = %d want 400", body, code)
+		}
+	}
+
+	code, body := request(t, h, "POST", "/alerts/silences", `{"path_pattern": "w/*", "duration": "1h", "author": "tester", "comment": "maintenance"}`)
+	if code != http.StatusOK {
+		t.Fatalf("POST silence = %d %s", code, body)
+	}
+	var created storage.Silence
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	code, body = request(t, h, "GET", "/alerts/silences", "")
+	var silences []*storage.Silence
+	if err := json.Unmarshal([]byte(body), &silences); err != nil || code != http.StatusOK {
+		t.Fatalf("GET silences = %d %s", code, body)
+	}
+	if len(silences) != 1 || silences[0].Id != created.Id || FindSilence(silences, "w/t") == nil || FindSilence(silences, "w/a/t") != nil {
+		t.Fatalf("GET silences = %s want the created silence matching only w/*", body)
+	}
+
+	if code, body := request(t, h, "POST", "/alerts/silences/expire?id="+strconv.FormatInt(created.Id, 10), ""); code != http.StatusOK {
+		t.Fatalf("POST expire = %d %s", code, body)
+	}
+	active, err := db.GetActiveSilences(time.Now().Add(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 0 {
+		t.Errorf("active silences after expiry = %v want none", active)
+	}
+}
+
+func TestAcknowledge(t *testing.T) {
+	db := storage.NewMemory()
+	h := Handler(db, "/alerts")
+
+	ack := `{"trigger_path": "w/a/t", "author": "tester"}`
+	if code, _ := request(t, h, "POST", "/alerts/ack", ack); code != http.StatusConflict {
+		t.Errorf("POST ack of an alert that is not firing = %d want 409", code)
+	}
+	if code, _ := request(t, h, "POST", "/alerts/ack", `{"trigger_path": "w/a/t"}`); code != http.StatusBadRequest {
+		t.Errorf("POST ack without author = %d want 400", code)
+	}
+
+	now := time.Now()
+	if err := db.SetAlertState(&storage.AlertState{TriggerPath: "w/a/t", FiringSince: &now, LastNotified: &now}); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := request(t, h, "POST", "/alerts/ack", ack); code != http.StatusOK {
+		t.Fatalf("POST ack = %d %s", code, body)
+	}
+	state, err := db.GetAlertState("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Acknowledged == nil || state.AcknowledgedBy != "tester" {
+		t.Errorf("alert state = %+v want acknowledged by tester", state)
+	}
+}
@@ -97,6 +97,24 @@ var (
 		},
 		[]string{"name", "status"},
 	)
+
+	metricSamplesStored = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "metric_samples",
+			Help:      "Number of metric samples emitted by analyses in metrics mode",
+		},
+		[]string{"name"},
+	)
+
+	metricSampleParseErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "metric_sample_parse_errors",
+			Help:      "Number of outputs of analyses in metrics mode that were not valid samples",
+		},
+		[]string{"name"},
+	)
 )
 
 func init() {
@@ -105,9 +123,11 @@ func init() {
 	prometheus.MustRegister(metricAnalyseRuns)
 	prometheus.MustRegister(metricAnalyseRunsFinished)
 	prometheus.MustRegister(metricAnalyseRunLatency)
+	prometheus.MustRegister(metricSamplesStored)
+	prometheus.MustRegister(metricSampleParseErrors)
 }
 
-func Analyse(db *storage.DB, parentPath, path string, spec *config.AnalysisSpec, notify <-chan struct{}, nodesStored chan<- string) error {
+func Analyse(db storage.Store, parentPath, path string, spec *config.AnalysisSpec, notify <-chan struct{}, nodesStored chan<- string) error {
 	log.Printf("starting analyser for node %q", path)
 
 	metricAnalysersStarted.WithLabelValues(path).Inc()
@@ -136,39 +156,15 @@ func Analyse(db *storage.DB, parentPath, path string, spec *config.AnalysisSpec,
 		2 * time.Minute,
 	}
 
-	timeout := make(chan struct{}, 100)
-	go func() {
-		for {
-			scheduler.WaitUntil(checkScheduler.ScheduleNext(time.Now()))
-			timeout <- struct{}{}
-		}
-	}()
-
-	skipDelay := true
-
+	// Work is enqueued as executions of the parent are stored, by whichever
+	// process stores them, and for those stored before this analysis was
+	// configured by the Reconciler.
 	for {
-		if !skipDelay {
-			select {
-			case <-notify:
-				metricNodeStoredHintsReceived.Inc()
-				if Verbose {
-					log.Printf("analyser %q woke up: notified", path)
-				}
-			case <-timeout:
-				if Verbose {
-					log.Printf("analyser %q woke up: timeout", path)
-				}
-			}
-		}
-
-		items, more, err := db.GetChildlessExecutions(parentPath, path)
-		if err != nil {
-			return err
-		}
-		skipDelay = more
-
-		for _, item := range items {
-			err := db.WithLease(fmt.Sprintf("analyse:%s:%d", path, item.Id), runTimeout+time.Second, func() error {
+		for {
+			// Samples are counted once they are stored, with the result.
+			var samplesProcessed int
+			processed, err := db.ProcessWork(path, runTimeout+time.Second, info, func(item *storage.WorkItem) (*runner.Result, []*storage.Sample) {
+				samplesProcessed = 0
 				log.Printf("running analysis %q", path)
 
 				track := beginTracking(path)
@@ -178,20 +174,55 @@ func Analyse(db *storage.DB, parentPath, path string, spec *config.AnalysisSpec,
 				// An error running the command is not actually an analysis error.
 				// We still store the result.
 				if err != nil {
-					log.Printf("error running analyse %q (%d): %v", path, item.Id, err)
+					log.Printf("error running analyse %q (%d): %v", path, item.ExecutionId, err)
 				} else {
 					if Verbose {
 						log.Printf("ran analyse %q (ok)", path)
 					}
 				}
+				if result == nil {
+					// The command could not be run at all. This is stored
+					// as a failure, so that the item is done with rather
+					// than retried forever.
+					now := time.Now()
+					return &runner.Result{Start: now, Stop: now, Stderr: err.Error()}, nil
+				}
 
-				_, err = db.InsertExecution(path, result, info, &item.Id)
-				nodesStored <- path
-				return err
+				if !spec.Metrics || !result.Success {
+					return result, nil
+				}
+				// Output that is not valid samples is still stored.
+				samples, err := ParseSamples(result.Stdout)
+				if err != nil {
+					log.Printf("error parsing samples of %q (%d): %v", path, item.ExecutionId, err)
+					metricSampleParseErrors.WithLabelValues(path).Inc()
+					return result, nil
+				}
+				samplesProcessed = len(samples)
+				return result, samples
 			})
 			if err != nil {
 				return err
 			}
+			if !processed {
+				break
+			}
+			metricSamplesStored.WithLabelValues(path).Add(float64(samplesProcessed))
+			nodesStored <- path
+		}
+
+		timeout := time.NewTimer(time.Until(checkScheduler.ScheduleNext(time.Now())))
+		select {
+		case <-notify:
+			metricNodeStoredHintsReceived.Inc()
+			if Verbose {
+				log.Printf("analyser %q woke up: notified", path)
+			}
+		case <-timeout.C:
+			if Verbose {
+				log.Printf("analyser %q woke up: timeout", path)
+			}
 		}
+		timeout.Stop()
 	}
 }
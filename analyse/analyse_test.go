@@ -0,0 +1,155 @@
+package analyse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/runner"
+	"github.com/steinarvk/watcher/storage"
+)
+
+func TestAnalyse(t *testing.T) {
+	db := storage.NewMemory()
+	if err := db.SetChildren(map[string][]string{"w": {"w/upper"}}); err != nil {
+		t.Fatal(err)
+	}
+	info := &hostinfo.HostInfo{Hostname: "testhost"}
+	t0 := time.Now()
+
+	var watchIds []int64
+	for i, stdout := range []string{"one\n", "two\n"} {
+		start := t0.Add(time.Duration(i) * time.Second)
+		id, err := db.InsertExecution("w", &runner.Result{Start: start, Stop: start, Stdout: stdout, Success: true}, info, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		watchIds = append(watchIds, id)
+	}
+
+	notify := make(chan struct{}, 100)
+	nodesStored := make(chan string, 100)
+	spec := &config.AnalysisSpec{
+		Name: "upper",
+		Run:  &runner.Config{Shell: "tr a-z A-Z"},
+	}
+	go func() {
+		if err := Analyse(db, "w", "w/upper", spec, notify, nodesStored); err != nil {
+			t.Errorf("Analyse() = %v", err)
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-nodesStored:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for analysis #%d", i)
+		}
+	}
+
+	rows, err := db.QueryExecutionResults("w/upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Result.Stdout != "ONE\n" || rows[1].Result.Stdout != "TWO\n" {
+		t.Fatalf("got analyses %+v want ONE and TWO", rows)
+	}
+	if !rows[1].RootTime.Equal(t0.Add(time.Second).Truncate(time.Millisecond)) {
+		t.Errorf("got root time %v want that of the watch execution %d", rows[1].RootTime, watchIds[1])
+	}
+
+	if n, err := db.EnqueueChildlessExecutions("w", "w/upper"); err != nil || n != 0 {
+		t.Errorf("EnqueueChildlessExecutions() after analysis = %d, %v want 0", n, err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	db := storage.NewMemory()
+	now := time.Now()
+	for _, path := range []string{"w", "w/a"} {
+		if _, err := db.InsertExecution(path, &runner.Result{Start: now, Stop: now, Stdout: "one\n", Success: true}, &hostinfo.HostInfo{Hostname: "testhost"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The analysis w/a is new, and so is its digest trigger w/a/t.
+	if err := db.SetChildren(map[string][]string{"w": {"w/a"}, "w/a": {"w/a/t"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconcile(db, map[string]bool{"w/a": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if pending, err := db.GetPendingWork("w/a", 10); err != nil || len(pending) != 1 {
+		t.Errorf("GetPendingWork(w/a) = %+v, %v want the earlier execution of w", pending, err)
+	}
+	if pending, err := db.GetPendingWork("w/a/t", 10); err != nil || len(pending) != 0 {
+		t.Errorf("GetPendingWork(w/a/t) = %+v, %v want nothing for a digest trigger", pending, err)
+	}
+	if children, err := db.GetUnreconciledChildren(); err != nil || len(children) != 0 {
+		t.Errorf("GetUnreconciledChildren() = %v, %v want none after reconciling", children, err)
+	}
+}
+
+func TestAnalyseCommandNotRun(t *testing.T) {
+	db := storage.NewMemory()
+	if err := db.SetChildren(map[string][]string{"w": {"w/m"}}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if _, err := db.InsertExecution("w", &runner.Result{Start: now, Stop: now, Stdout: "one\n", Success: true}, &hostinfo.HostInfo{Hostname: "testhost"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	notify := make(chan struct{}, 100)
+	nodesStored := make(chan string, 100)
+	spec := &config.AnalysisSpec{
+		Name:    "m",
+		Run:     &runner.Config{Program: &runner.ProgramSpec{Binary: "/nonexistent/program"}},
+		Metrics: true,
+	}
+	go func() {
+		if err := Analyse(db, "w", "w/m", spec, notify, nodesStored); err != nil {
+			t.Errorf("Analyse() = %v", err)
+		}
+	}()
+
+	select {
+	case <-nodesStored:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for the analysis")
+	}
+
+	latest, err := db.GetLatestExecution("w/m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil || latest.Result.Success || latest.Result.Stderr == "" {
+		t.Errorf("got analysis %+v want a failure with the error", latest)
+	}
+}
+
+func TestParseSamples(t *testing.T) {
+	samples, err := ParseSamples(`{"name": "temperature", "value": 21.5, "labels": {"room": "kitchen"}}
+
+{"name": "comments", "value": 3}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 2 || samples[0].Name != "temperature" || samples[0].Value != 21.5 || samples[0].Labels["room"] != "kitchen" || samples[1].Name != "comments" || samples[1].Value != 3 || samples[1].Labels != nil {
+		t.Errorf("ParseSamples() = %+v", samples)
+	}
+
+	for _, output := range []string{
+		"21.5\n",
+		`{"name": "temperature"}`,
+		`{"value": 21.5}`,
+		`{"name": "temperature", "value": "21.5"}`,
+	} {
+		if samples, err := ParseSamples(output); err == nil {
+			t.Errorf("ParseSamples(%q) = %+v want error", output, samples)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package analyse
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/steinarvk/watcher/storage"
+)
+
+// Reconciler enqueues the work of each new analysis on the executions of
+// its parent stored before it was configured. This scans every execution
+// of the parent, so it is done once for each analysis, by one daemon: the
+// children reconciled are recorded in the database. Other children (e.g.
+// digest triggers, which start from when they are added) are only marked
+// as reconciled. A failure is logged, and tried again after the period.
+func Reconciler(db storage.Store, analyses map[string]bool, period time.Duration) error {
+	for {
+		err := db.WithLease("reconcile", period, func(ctx context.Context) error {
+			return reconcile(db.WithContext(ctx), analyses)
+		})
+		if err != nil {
+			log.Printf("error reconciling analyses: %v", err)
+		}
+		time.Sleep(period)
+	}
+}
+
+func reconcile(db storage.Store, analyses map[string]bool) error {
+	children, err := db.GetUnreconciledChildren()
+	if err != nil {
+		return err
+	}
+
+	for parent, paths := range children {
+		for _, child := range paths {
+			if analyses[child] {
+				n, err := db.EnqueueChildlessExecutions(parent, child)
+				if err != nil {
+					return err
+				}
+				log.Printf("enqueued analysis %q of %d earlier execution(s)", child, n)
+			}
+			if err := db.SetChildReconciled(parent, child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package analyse
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/steinarvk/watcher/storage"
+)
+
+// ParseSamples parses the output of an analysis in metrics mode: a sample
+// per line, as a JSON object with "name", "value" and optionally "labels".
+// Blank lines are skipped.
+func ParseSamples(output string) ([]*storage.Sample, error) {
+	var rv []*storage.Sample
+	for i, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var record struct {
+			Name   string            `json:"name"`
+			Value  *float64          `json:"value"`
+			Labels map[string]string `json:"labels"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		if record.Name == "" {
+			return nil, fmt.Errorf("line %d: missing name", i+1)
+		}
+		if record.Value == nil {
+			return nil, fmt.Errorf("line %d: missing value", i+1)
+		}
+		rv = append(rv, &storage.Sample{
+			Name:   record.Name,
+			Labels: record.Labels,
+			Value:  *record.Value,
+		})
+	}
+	return rv, nil
+}
@@ -3,43 +3,684 @@ package config
 import (
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
 	"strings"
+	"text/template"
 	"time"
 	"unicode/utf8"
 
+	"github.com/steinarvk/watcher/notify"
 	"github.com/steinarvk/watcher/runner"
 	"github.com/steinarvk/watcher/scheduler"
+	"github.com/steinarvk/watcher/storage"
 )
 
 type Config struct {
-	Watch []*WatchSpec `yaml:"watch"`
+	Storage   *StorageSpec   `yaml:"storage"`
+	Watch     []*WatchSpec   `yaml:"watch"`
+	Staleness *StalenessSpec `yaml:"staleness"`
+	Pruning   *PruningSpec   `yaml:"pruning"`
 }
 
 func (c *Config) Check() error {
+	if c.Storage != nil {
+		if err := c.Storage.Check(); err != nil {
+			return fmt.Errorf("in storage section: %v", err)
+		}
+	}
 	for i, w := range c.Watch {
 		if err := w.Check(); err != nil {
 			return fmt.Errorf("in watch spec %d: %v", i, err)
 		}
 	}
+	if c.Staleness != nil {
+		if err := c.Staleness.Check(); err != nil {
+			return fmt.Errorf("in staleness section: %v", err)
+		}
+	} else if len(c.StaleNodes()) > 0 {
+		return errors.New("'max_staleness' given but no 'staleness' section")
+	}
+	if c.Pruning != nil {
+		if err := c.Pruning.Check(); err != nil {
+			return fmt.Errorf("in pruning section: %v", err)
+		}
+	}
+	return nil
+}
+
+// StorageSpec selects the storage backend. The default is Postgres, with
+// the connection details given by the database secrets file; "sqlite"
+// stores everything in the SQLite database file at 'path'. Outputs are
+// stored compressed with 'compression' ("zstd", the default, "gzip" or
+// "none"). With 'spool_dir', executions that cannot be stored because the
+// database is unavailable are kept in that local directory until they can.
+// A query is cancelled after the timeout given for it by name (as in the
+// metrics) in 'query_timeouts', if any, or else after 'query_timeout', if
+// given; by default, queries are not limited.
+type StorageSpec struct {
+	Backend       string            `yaml:"backend"`
+	Path          string            `yaml:"path"`
+	Compression   string            `yaml:"compression"`
+	SpoolDir      string            `yaml:"spool_dir"`
+	QueryTimeout  string            `yaml:"query_timeout"`
+	QueryTimeouts map[string]string `yaml:"query_timeouts"`
+}
+
+const (
+	StorageBackendPostgres = "postgres"
+	StorageBackendSQLite   = "sqlite"
+)
+
+func (c *StorageSpec) GetBackend() string {
+	if c == nil || c.Backend == "" {
+		return StorageBackendPostgres
+	}
+	return c.Backend
+}
+
+func (c *StorageSpec) GetCompression() string {
+	if c == nil || c.Compression == "" {
+		return storage.DefaultCompression
+	}
+	return c.Compression
+}
+
+func (c *StorageSpec) GetSpoolDir() string {
+	if c == nil {
+		return ""
+	}
+	return c.SpoolDir
+}
+
+func (c *StorageSpec) GetQueryTimeout() (time.Duration, error) {
+	if c == nil || c.QueryTimeout == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.QueryTimeout)
+}
+
+func (c *StorageSpec) GetQueryTimeouts() (map[string]time.Duration, error) {
+	if c == nil {
+		return nil, nil
+	}
+	rv := map[string]time.Duration{}
+	for name, s := range c.QueryTimeouts {
+		dur, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q for query %q: %v", s, name, err)
+		}
+		rv[name] = dur
+	}
+	return rv, nil
+}
+
+func (c *StorageSpec) Check() error {
+	if err := storage.CheckCompression(c.GetCompression()); err != nil {
+		return err
+	}
+	if _, err := c.GetQueryTimeout(); err != nil {
+		return fmt.Errorf("invalid query_timeout %q: %v", c.QueryTimeout, err)
+	}
+	if _, err := c.GetQueryTimeouts(); err != nil {
+		return fmt.Errorf("in query_timeouts: %v", err)
+	}
+	switch c.GetBackend() {
+	case StorageBackendPostgres:
+		if c.Path != "" {
+			return errors.New("'path' only applies to the sqlite backend")
+		}
+	case StorageBackendSQLite:
+		if c.Path == "" {
+			return errors.New("missing 'path'")
+		}
+	default:
+		return fmt.Errorf("invalid backend %q (want %q or %q)", c.Backend, StorageBackendPostgres, StorageBackendSQLite)
+	}
+	return nil
+}
+
+// StalenessSpec specifies how to alert about stale nodes, i.e. nodes with a
+// 'max_staleness' whose latest successful execution is older than that.
+// The command is run with a JSON description of the node as input, once
+// when the node becomes stale and once when it produces data again.
+type StalenessSpec struct {
+	CheckPeriod string         `yaml:"check_period"`
+	Run         *runner.Config `yaml:"run"`
+}
+
+const DefaultStalenessCheckPeriod = time.Minute
+
+func (c *StalenessSpec) GetCheckPeriod() (time.Duration, error) {
+	if c.CheckPeriod == "" {
+		return DefaultStalenessCheckPeriod, nil
+	}
+	return time.ParseDuration(c.CheckPeriod)
+}
+
+func (c *StalenessSpec) Check() error {
+	if _, err := c.GetCheckPeriod(); err != nil {
+		return fmt.Errorf("invalid check_period %q: %v", c.CheckPeriod, err)
+	}
+	if c.Run == nil {
+		return errors.New("missing 'run'")
+	}
+	return c.Run.Check()
+}
+
+// PruningSpec configures the pruner, which deletes (or compacts) the
+// executions of watches with a 'retention' section that are no longer to be
+// kept. With 'dry_run', it only logs what it would delete.
+type PruningSpec struct {
+	Period    string `yaml:"period"`
+	BatchSize int    `yaml:"batch_size"`
+	DryRun    bool   `yaml:"dry_run"`
+}
+
+const (
+	DefaultPruningPeriod    = time.Hour
+	DefaultPruningBatchSize = 100
+)
+
+func (c *PruningSpec) GetPeriod() (time.Duration, error) {
+	if c == nil || c.Period == "" {
+		return DefaultPruningPeriod, nil
+	}
+	return time.ParseDuration(c.Period)
+}
+
+func (c *PruningSpec) GetBatchSize() int {
+	if c == nil || c.BatchSize == 0 {
+		return DefaultPruningBatchSize
+	}
+	return c.BatchSize
+}
+
+func (c *PruningSpec) Check() error {
+	dur, err := c.GetPeriod()
+	if err != nil {
+		return fmt.Errorf("invalid period %q: %v", c.Period, err)
+	}
+	if dur <= 0 {
+		return fmt.Errorf("invalid period %q: must be positive", c.Period)
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("invalid batch_size %d: must be positive", c.BatchSize)
+	}
+	return nil
+}
+
+// RetentionSpec says which executions of a watch to keep. An execution is
+// deleted if it is older than 'max_age' or is not among the 'max_count'
+// latest executions, unless it is among the 'keep_last_successful' latest
+// successful executions. If 'keep_failures_for' is given, failed
+// executions are instead deleted once they are older than that.
+//
+// Executions older than that may instead (or as well) be compacted; see
+// CompactionSpec.
+//
+// Deleting an execution of a watch deletes the executions of the analyses
+// and triggers that were run on it, so retention is only given for watches.
+type RetentionSpec struct {
+	MaxAge             string          `yaml:"max_age"`
+	MaxCount           int             `yaml:"max_count"`
+	KeepLastSuccessful int             `yaml:"keep_last_successful"`
+	KeepFailuresFor    string          `yaml:"keep_failures_for"`
+	Compact            *CompactionSpec `yaml:"compact"`
+}
+
+// CompactionSpec says how to compact the executions of a watch once they
+// are older than 'after'. With 'keep: changes', only the executions whose
+// output (or success) differs from that of the previous execution are
+// kept; with 'keep: hourly' or 'keep: daily', only the first execution of
+// each hour or day (in UTC). A kept execution records how many runs it
+// stands for, and when the last of them stopped.
+type CompactionSpec struct {
+	After string `yaml:"after"`
+	Keep  string `yaml:"keep"`
+}
+
+const (
+	CompactKeepChanges = "changes"
+	CompactKeepHourly  = "hourly"
+	CompactKeepDaily   = "daily"
+)
+
+func (c *CompactionSpec) GetAfter() (time.Duration, error) {
+	return parseOptionalDuration("after", c.After)
+}
+
+func (c *CompactionSpec) Check() error {
+	if c.After == "" {
+		return errors.New("missing 'after'")
+	}
+	if _, err := c.GetAfter(); err != nil {
+		return err
+	}
+	switch c.Keep {
+	case CompactKeepChanges, CompactKeepHourly, CompactKeepDaily:
+	case "":
+		return errors.New("missing 'keep'")
+	default:
+		return fmt.Errorf("invalid keep %q (want %q, %q or %q)", c.Keep, CompactKeepChanges, CompactKeepHourly, CompactKeepDaily)
+	}
+	return nil
+}
+
+func parseOptionalDuration(name, s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, s, err)
+	}
+	if dur <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be positive", name, s)
+	}
+	return dur, nil
+}
+
+func (c *RetentionSpec) GetMaxAge() (time.Duration, error) {
+	return parseOptionalDuration("max_age", c.MaxAge)
+}
+
+func (c *RetentionSpec) GetKeepFailuresFor() (time.Duration, error) {
+	return parseOptionalDuration("keep_failures_for", c.KeepFailuresFor)
+}
+
+func (c *RetentionSpec) Check() error {
+	if _, err := c.GetMaxAge(); err != nil {
+		return err
+	}
+	if _, err := c.GetKeepFailuresFor(); err != nil {
+		return err
+	}
+	if c.MaxCount < 0 {
+		return fmt.Errorf("invalid max_count %d: must be positive", c.MaxCount)
+	}
+	if c.KeepLastSuccessful < 0 {
+		return fmt.Errorf("invalid keep_last_successful %d: must be positive", c.KeepLastSuccessful)
+	}
+	if c.Compact != nil {
+		if err := c.Compact.Check(); err != nil {
+			return fmt.Errorf("in compact section: %v", err)
+		}
+	}
+	if c.MaxAge == "" && c.MaxCount == 0 && c.KeepFailuresFor == "" && c.Compact == nil {
+		return errors.New("need at least one of 'max_age', 'max_count', 'keep_failures_for' and 'compact'")
+	}
+	return nil
+}
+
+// RetainedWatch is a watch with a retention policy.
+type RetainedWatch struct {
+	Path      string
+	Retention *RetentionSpec
+}
+
+// RetainedWatches returns every watch with a 'retention' section.
+func (c *Config) RetainedWatches() []RetainedWatch {
+	var rv []RetainedWatch
+	for _, w := range c.Watch {
+		if w.Retention != nil {
+			rv = append(rv, RetainedWatch{w.Name, w.Retention})
+		}
+	}
+	return rv
+}
+
+// AnalysisPaths returns the paths of every analysis.
+func (c *Config) AnalysisPaths() map[string]bool {
+	rv := map[string]bool{}
+
+	var visit func(string, []*AnalysisSpec)
+	visit = func(path string, children []*AnalysisSpec) {
+		for _, child := range children {
+			childPath := path + "/" + child.Name
+			rv[childPath] = true
+			visit(childPath, child.Children)
+		}
+	}
+
+	for _, w := range c.Watch {
+		visit(w.Name, w.Children)
+	}
+
+	return rv
+}
+
+// QueuedChildren returns the paths of the nodes that are given work from
+// the queue of each node that has any, by the path of the node: its
+// analyses, and the digest triggers collecting its outputs.
+func (c *Config) QueuedChildren() map[string][]string {
+	rv := map[string][]string{}
+
+	var visit func(string, []*AnalysisSpec)
+	visit = func(path string, children []*AnalysisSpec) {
+		for _, child := range children {
+			childPath := path + "/" + child.Name
+			rv[path] = append(rv[path], childPath)
+			for _, trigger := range child.Triggers {
+				if trigger.Digest != nil {
+					rv[childPath] = append(rv[childPath], childPath+"/"+trigger.Name)
+				}
+			}
+			visit(childPath, child.Children)
+		}
+	}
+
+	for _, w := range c.Watch {
+		visit(w.Name, w.Children)
+	}
+
+	return rv
+}
+
+// ExportSpec publishes the latest successful output of a node (watch or
+// analysis) as a Prometheus gauge, if 'export_metric' is set. The output is
+// a number, unless 'metric_labels' or 'metric_value' is given: then it is
+// a JSON object per line, one per series, with the value in the field
+// 'metric_value' ("value" by default) and each of the 'metric_labels' (by
+// label name) in the field given for it. The gauge is named 'metric_name'
+// (by default, watcher_node_value), and also has the label "node".
+type ExportSpec struct {
+	ExportMetric bool              `yaml:"export_metric"`
+	MetricName   string            `yaml:"metric_name"`
+	MetricHelp   string            `yaml:"metric_help"`
+	MetricValue  string            `yaml:"metric_value"`
+	MetricLabels map[string]string `yaml:"metric_labels"`
+}
+
+var (
+	metricNameRE  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	metricLabelRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// JSON returns whether the output is JSON rather than a number.
+func (c *ExportSpec) JSON() bool {
+	return c.MetricValue != "" || len(c.MetricLabels) > 0
+}
+
+func (c *ExportSpec) Check() error {
+	if !c.ExportMetric {
+		if c.MetricName != "" || c.MetricHelp != "" || c.JSON() {
+			return errors.New("'metric_*' given without 'export_metric'")
+		}
+		return nil
+	}
+	if c.MetricName != "" && !metricNameRE.MatchString(c.MetricName) {
+		return fmt.Errorf("invalid metric_name %q", c.MetricName)
+	}
+	for label := range c.MetricLabels {
+		if !metricLabelRE.MatchString(label) || strings.HasPrefix(label, "__") || label == "node" {
+			return fmt.Errorf("invalid label %q in metric_labels", label)
+		}
+	}
+	return nil
+}
+
+// ExportedNode is a node whose output is exported as a gauge.
+type ExportedNode struct {
+	Path string
+	Spec *ExportSpec
+}
+
+// ExportedNodes returns every node (watch or analysis) with 'export_metric'.
+func (c *Config) ExportedNodes() []ExportedNode {
+	var rv []ExportedNode
+
+	var visit func(string, *ExportSpec, []*AnalysisSpec)
+	visit = func(path string, spec *ExportSpec, children []*AnalysisSpec) {
+		if spec.ExportMetric {
+			rv = append(rv, ExportedNode{path, spec})
+		}
+		for _, child := range children {
+			visit(path+"/"+child.Name, &child.Export, child.Children)
+		}
+	}
+
+	for _, w := range c.Watch {
+		visit(w.Name, &w.Export, w.Children)
+	}
+
+	return rv
+}
+
+// StaleNode is a node with a staleness limit.
+type StaleNode struct {
+	Path         string
+	MaxStaleness time.Duration
+}
+
+// StaleNodes returns every node (watch or analysis) with a 'max_staleness'.
+// The config must already have been checked.
+func (c *Config) StaleNodes() []StaleNode {
+	var rv []StaleNode
+
+	var visit func(string, string, []*AnalysisSpec)
+	visit = func(path string, maxStaleness string, children []*AnalysisSpec) {
+		if maxStaleness != "" {
+			dur, _ := time.ParseDuration(maxStaleness)
+			rv = append(rv, StaleNode{path, dur})
+		}
+		for _, child := range children {
+			visit(path+"/"+child.Name, child.MaxStaleness, child.Children)
+		}
+	}
+
+	for _, w := range c.Watch {
+		visit(w.Name, w.MaxStaleness, w.Children)
+	}
+
+	return rv
+}
+
+func checkMaxStaleness(s string) error {
+	if s == "" {
+		return nil
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid max_staleness %q: %v", s, err)
+	}
+	if dur <= 0 {
+		return fmt.Errorf("invalid max_staleness %q: must be positive", s)
+	}
 	return nil
 }
 
-// TriggerSpec specifies a trigger. A trigger runs a command if an analysis
-// finishes with a success exit and a nonempty (after trimming) stdout,
-// only if that analysis is the _latest_ analysis yet seen, and only if the
-// trigger has not triggered within the last <period>. The primary application
-// is to send notifications.
+// TriggerSpec specifies a trigger. A trigger runs a command if its condition
+// holds for an analysis (by default: it finishes with a success exit and a
+// nonempty, after trimming, stdout), only if that analysis is the _latest_
+// analysis yet seen, and only if the trigger has not triggered within the
+// last <period>. The primary application is to send notifications.
+//
+// Alternatively, a trigger can be stateful, specified with 'on_fire' instead
+// of 'run'. A stateful trigger starts firing when its condition holds for
+// the latest analysis, running 'on_fire' once. While it keeps firing,
+// 'on_repeat' (or 'on_fire', if 'on_repeat' is not given) is run every
+// <repeat>, if given. When the condition no longer holds, the trigger is
+// resolved, running 'on_resolve' if given with the input it last fired with.
+//
+// A trigger with a 'digest' section instead collects its inputs and runs
+// its command with all of them on a schedule (see DigestSpec).
+//
+// Like other nodes, a trigger is only run by the daemons matching its
+// 'run_on' constraints, which are independent of those of its analysis.
 type TriggerSpec struct {
-	Name   string         `yaml:"name"`
-	Period string         `yaml:"period"`
-	Run    *runner.Config `yaml:"run"`
+	Name     string          `yaml:"name"`
+	RunOn    RunOn           `yaml:"run_on"`
+	Period   string          `yaml:"period"`
+	Run      *TriggerCommand `yaml:"run"`
+	DedupKey *DedupKeySpec   `yaml:"dedup_key"`
+	Digest   *DigestSpec     `yaml:"digest"`
+
+	Condition *ConditionSpec `yaml:"condition"`
+
+	OnFire    *TriggerCommand `yaml:"on_fire"`
+	OnRepeat  *TriggerCommand `yaml:"on_repeat"`
+	OnResolve *TriggerCommand `yaml:"on_resolve"`
+	Repeat    string          `yaml:"repeat"`
+}
+
+// TriggerCommand is what a trigger runs: a command, as for other nodes, or
+// with 'notify' a built-in notifier (along with its 'timeout').
+type TriggerCommand struct {
+	runner.Config `yaml:",inline"`
+	Notify        *notify.Config `yaml:"notify"`
+}
+
+func (c *TriggerCommand) Check() error {
+	if c.Notify == nil {
+		return c.Config.Check()
+	}
+	if c.Shell != "" || c.Program != nil || c.Python3 != "" || c.DoNotRun {
+		return errors.New("'notify' and a command are mutually exclusive")
+	}
+	if _, err := c.GetTimeout(); err != nil {
+		return fmt.Errorf("invalid timeout %q: %v", c.Timeout, err)
+	}
+	if err := c.Notify.Check(); err != nil {
+		return fmt.Errorf("invalid notify config: %v", err)
+	}
+	return nil
+}
+
+// ConditionSpec specifies when a trigger fires, given the executions of
+// its parent. At most one condition may be given:
+//
+// 'nonempty' (the default) holds if the execution succeeded with a nonempty
+// stdout, which is the input to the trigger. 'matches' holds if it succeeded
+// with a stdout matching the regular expression. 'changed' holds if it
+// succeeded with a stdout different from that of the previous successful
+// execution. 'failed' holds if the execution failed, and
+// 'consecutive_failures' if it and the N-1 executions before it all failed;
+// for these the input is the stderr of the failed execution.
+//
+// Conditions on the output ignore failed executions: a stateful trigger
+// neither fires nor resolves on one.
+type ConditionSpec struct {
+	Nonempty            bool   `yaml:"nonempty"`
+	Matches             string `yaml:"matches"`
+	Changed             bool   `yaml:"changed"`
+	Failed              bool   `yaml:"failed"`
+	ConsecutiveFailures int    `yaml:"consecutive_failures"`
+}
+
+func (c *ConditionSpec) Check() error {
+	n := 0
+	for _, given := range []bool{c.Nonempty, c.Matches != "", c.Changed, c.Failed, c.ConsecutiveFailures != 0} {
+		if given {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("at most one condition may be given")
+	}
+	if c.Matches != "" {
+		if _, err := regexp.Compile(c.Matches); err != nil {
+			return fmt.Errorf("invalid regex %q: %v", c.Matches, err)
+		}
+	}
+	if c.ConsecutiveFailures < 0 {
+		return fmt.Errorf("invalid consecutive_failures %d: must be positive", c.ConsecutiveFailures)
+	}
+	return nil
 }
 
+// DedupKeySpec specifies how to extract deduplication keys from the input
+// of a trigger. If given, the period of the trigger applies to each key
+// separately: the trigger runs if any of the keys in its input has not been
+// seen within the period.
+//
+// With 'json', the input is parsed as JSON and the value at the given dotted
+// path ("." for the whole input) gives the keys: the keys of an object, the
+// elements of an array, or a single scalar value. With 'regex', every match
+// of the regular expression is a key, or its first group if it has one.
+// If no keys can be extracted, the period applies to the trigger as a whole.
+type DedupKeySpec struct {
+	JSON  string `yaml:"json"`
+	Regex string `yaml:"regex"`
+}
+
+func (c *DedupKeySpec) Check() error {
+	if (c.JSON == "") == (c.Regex == "") {
+		return errors.New("exactly one of 'json' and 'regex' is required")
+	}
+	if c.Regex != "" {
+		if _, err := regexp.Compile(c.Regex); err != nil {
+			return fmt.Errorf("invalid regex %q: %v", c.Regex, err)
+		}
+	}
+	return nil
+}
+
+// DigestSpec makes a trigger collect every nonempty input and run its
+// command once per scheduled window with all of them (if there were any),
+// instead of once per input. With format "json" (the default), the command
+// is given a JSON array of the inputs; with format "text", it is given the
+// rendered template (see DefaultDigestTemplate for the available data).
+type DigestSpec struct {
+	Schedule *scheduler.Config `yaml:"schedule"`
+	Format   string            `yaml:"format"`
+	Template string            `yaml:"template"`
+}
+
+const (
+	DigestFormatJSON = "json"
+	DigestFormatText = "text"
+
+	DefaultDigestTemplate = "{{range .Items}}{{.RootTime.Format \"2006-01-02 15:04:05\"}}: {{.Input}}\n{{end}}"
+)
+
+func (c *DigestSpec) GetFormat() string {
+	if c.Format == "" {
+		return DigestFormatJSON
+	}
+	return c.Format
+}
+
+func (c *DigestSpec) Check() error {
+	if c.Schedule == nil {
+		return errors.New("missing 'schedule'")
+	}
+	if err := c.Schedule.Check(); err != nil {
+		return fmt.Errorf("in schedule section: %v", err)
+	}
+	switch c.GetFormat() {
+	case DigestFormatJSON:
+		if c.Template != "" {
+			return errors.New("'template' requires format \"text\"")
+		}
+	case DigestFormatText:
+		if _, err := template.New("digest").Parse(c.Template); err != nil {
+			return fmt.Errorf("invalid template: %v", err)
+		}
+	default:
+		return fmt.Errorf("invalid format %q (want %q or %q)", c.Format, DigestFormatJSON, DigestFormatText)
+	}
+	return nil
+}
+
+// Stateful returns whether the trigger has a firing/resolved lifecycle.
+func (c *TriggerSpec) Stateful() bool {
+	return c.OnFire != nil
+}
+
+// AnalysisSpec specifies an analysis. With 'metrics', the output of the
+// analysis is a sample of a metric per line, as a JSON object with "name",
+// "value" and optionally "labels", and the samples are also stored as
+// numeric series.
 type AnalysisSpec struct {
-	Name     string          `yaml:"name"`
-	Run      *runner.Config  `yaml:"run"`
-	Children []*AnalysisSpec `yaml:"analyse"`
-	Triggers []*TriggerSpec  `yaml:"triggers"`
+	Name         string          `yaml:"name"`
+	Run          *runner.Config  `yaml:"run"`
+	Metrics      bool            `yaml:"metrics"`
+	MaxStaleness string          `yaml:"max_staleness"`
+	RunOn        RunOn           `yaml:"run_on"`
+	Export       ExportSpec      `yaml:",inline"`
+	Children     []*AnalysisSpec `yaml:"analyse"`
+	Triggers     []*TriggerSpec  `yaml:"triggers"`
 }
 
 func checkNodeName(s string) error {
@@ -54,7 +695,7 @@ func checkNodeName(s string) error {
 	}
 	initial, _ := utf8.DecodeRuneInString(s)
 	if strings.ContainsRune("0123456789_", initial) {
-		return fmt.Errorf("invalid name %q: first character cannot be %v", initial)
+		return fmt.Errorf("invalid name %q: first character cannot be %q", s, initial)
 	}
 	return nil
 }
@@ -64,6 +705,34 @@ func (c *TriggerSpec) Check() error {
 		return err
 	}
 
+	if err := c.RunOn.Check(); err != nil {
+		return fmt.Errorf("in run_on: %v", err)
+	}
+
+	if c.Condition != nil {
+		if err := c.Condition.Check(); err != nil {
+			return fmt.Errorf("in condition section: %v", err)
+		}
+	}
+
+	if c.Stateful() {
+		return c.checkStateful()
+	}
+
+	if c.Digest != nil {
+		return c.checkDigest()
+	}
+
+	if c.DedupKey != nil {
+		if err := c.DedupKey.Check(); err != nil {
+			return fmt.Errorf("in dedup_key section: %v", err)
+		}
+	}
+
+	if c.OnRepeat != nil || c.OnResolve != nil || c.Repeat != "" {
+		return errors.New("'on_repeat', 'on_resolve' and 'repeat' require 'on_fire'")
+	}
+
 	if c.Period == "" {
 		return errors.New("missing period")
 	}
@@ -80,6 +749,79 @@ func (c *TriggerSpec) Check() error {
 	return c.Run.Check()
 }
 
+func (c *TriggerSpec) checkDigest() error {
+	if c.OnRepeat != nil || c.OnResolve != nil || c.Repeat != "" {
+		return errors.New("'on_repeat', 'on_resolve' and 'repeat' require 'on_fire'")
+	}
+
+	if c.Period != "" {
+		return errors.New("'period' does not apply to digest triggers (see 'digest.schedule')")
+	}
+
+	if c.DedupKey != nil {
+		return errors.New("'dedup_key' does not apply to digest triggers")
+	}
+
+	if c.Condition != nil {
+		return errors.New("'condition' does not apply to digest triggers")
+	}
+
+	if err := c.Digest.Check(); err != nil {
+		return fmt.Errorf("in digest section: %v", err)
+	}
+
+	if c.Run == nil {
+		return errors.New("missing 'run'")
+	}
+
+	return c.Run.Check()
+}
+
+func (c *TriggerSpec) checkStateful() error {
+	if c.Run != nil {
+		return errors.New("'run' and 'on_fire' are mutually exclusive")
+	}
+
+	if c.Period != "" {
+		return errors.New("'period' does not apply to stateful triggers (see 'repeat')")
+	}
+
+	if c.DedupKey != nil {
+		return errors.New("'dedup_key' does not apply to stateful triggers")
+	}
+
+	if c.Digest != nil {
+		return errors.New("'digest' does not apply to stateful triggers")
+	}
+
+	if c.Repeat != "" {
+		dur, err := time.ParseDuration(c.Repeat)
+		if err != nil {
+			return fmt.Errorf("invalid repeat %q: %v", c.Repeat, err)
+		}
+		if dur <= 0 {
+			return fmt.Errorf("invalid repeat %q: must be positive", c.Repeat)
+		}
+	} else if c.OnRepeat != nil {
+		return errors.New("'on_repeat' given without 'repeat'")
+	}
+
+	if err := c.OnFire.Check(); err != nil {
+		return fmt.Errorf("in on_fire section: %v", err)
+	}
+	if c.OnRepeat != nil {
+		if err := c.OnRepeat.Check(); err != nil {
+			return fmt.Errorf("in on_repeat section: %v", err)
+		}
+	}
+	if c.OnResolve != nil {
+		if err := c.OnResolve.Check(); err != nil {
+			return fmt.Errorf("in on_resolve section: %v", err)
+		}
+	}
+	return nil
+}
+
 func (c *AnalysisSpec) Check() error {
 	if err := checkNodeName(c.Name); err != nil {
 		return err
@@ -90,6 +832,15 @@ func (c *AnalysisSpec) Check() error {
 	if err := c.Run.Check(); err != nil {
 		return fmt.Errorf("in run section: %v", err)
 	}
+	if err := checkMaxStaleness(c.MaxStaleness); err != nil {
+		return err
+	}
+	if err := c.RunOn.Check(); err != nil {
+		return fmt.Errorf("in run_on: %v", err)
+	}
+	if err := c.Export.Check(); err != nil {
+		return err
+	}
 	seen := map[string]bool{}
 	for i, child := range c.Children {
 		if seen[child.Name] {
@@ -113,10 +864,14 @@ func (c *AnalysisSpec) Check() error {
 }
 
 type WatchSpec struct {
-	Name     string            `yaml:"name"`
-	Run      *runner.Config    `yaml:"run"`
-	Schedule *scheduler.Config `yaml:"schedule"`
-	Children []*AnalysisSpec   `yaml:"analyse"`
+	Name         string            `yaml:"name"`
+	Run          *runner.Config    `yaml:"run"`
+	Schedule     *scheduler.Config `yaml:"schedule"`
+	MaxStaleness string            `yaml:"max_staleness"`
+	Retention    *RetentionSpec    `yaml:"retention"`
+	RunOn        RunOn             `yaml:"run_on"`
+	Export       ExportSpec        `yaml:",inline"`
+	Children     []*AnalysisSpec   `yaml:"analyse"`
 }
 
 func (c *WatchSpec) Check() error {
@@ -135,6 +890,20 @@ func (c *WatchSpec) Check() error {
 	if err := c.Schedule.Check(); err != nil {
 		return fmt.Errorf("in schedule section: %v", err)
 	}
+	if err := checkMaxStaleness(c.MaxStaleness); err != nil {
+		return err
+	}
+	if c.Retention != nil {
+		if err := c.Retention.Check(); err != nil {
+			return fmt.Errorf("in retention section: %v", err)
+		}
+	}
+	if err := c.RunOn.Check(); err != nil {
+		return fmt.Errorf("in run_on: %v", err)
+	}
+	if err := c.Export.Check(); err != nil {
+		return err
+	}
 	seen := map[string]bool{}
 	for i, child := range c.Children {
 		if seen[child.Name] {
@@ -147,3 +916,74 @@ func (c *WatchSpec) Check() error {
 	}
 	return nil
 }
+
+// Tags describe a daemon, for matching against the 'run_on' constraints of
+// nodes. A tag is a label such as "has-gpu-tools" or "region=eu"; every
+// daemon has the tag "host=<hostname>".
+type Tags map[string]bool
+
+// ParseTags parses a comma-separated list of tags, and adds the host tag.
+func ParseTags(s string, hostname string) (Tags, error) {
+	tags := Tags{"host=" + hostname: true}
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		if err := checkTag(tag); err != nil {
+			return nil, err
+		}
+		tags[tag] = true
+	}
+	return tags, nil
+}
+
+// Sorted returns the tags in order.
+func (t Tags) Sorted() []string {
+	var rv []string
+	for tag := range t {
+		rv = append(rv, tag)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+func checkTag(tag string) error {
+	if tag == "" {
+		return errors.New("empty tag")
+	}
+	if strings.ContainsAny(tag, ", \t!") {
+		return fmt.Errorf("invalid tag %q: cannot contain ',', '!' or whitespace", tag)
+	}
+	return nil
+}
+
+// RunOn constrains which daemons run a node. Each entry is a tag that the
+// daemon must have or, prefixed with '!', a tag that it must not have, so
+// that e.g. ["region=eu", "!host=db1"] runs the node on any daemon in the
+// "eu" region except on the host "db1". Without constraints, every daemon
+// runs the node.
+type RunOn []string
+
+func (r RunOn) Check() error {
+	for _, constraint := range r {
+		if err := checkTag(strings.TrimPrefix(constraint, "!")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches returns whether a daemon with the tags runs the node.
+func (r RunOn) Matches(tags Tags) bool {
+	for _, constraint := range r {
+		if strings.HasPrefix(constraint, "!") {
+			if tags[constraint[1:]] {
+				return false
+			}
+		} else if !tags[constraint] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tags, err := ParseTags(" region=eu, has-gpu-tools,,", "db1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tags.Sorted(), []string{"has-gpu-tools", "host=db1", "region=eu"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseTags() = %v want %v", got, want)
+	}
+
+	tags, err = ParseTags("", "db1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tags.Sorted(), []string{"host=db1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseTags(\"\") = %v want %v", got, want)
+	}
+
+	for _, s := range []string{"!no-network", "has gpu"} {
+		if _, err := ParseTags(s, "db1"); err == nil {
+			t.Errorf("ParseTags(%q) succeeded", s)
+		}
+	}
+}
+
+func TestRunOn(t *testing.T) {
+	tags := Tags{"host=db1": true, "region=eu": true}
+
+	for _, test := range []struct {
+		runOn RunOn
+		want  bool
+	}{
+		{nil, true},
+		{RunOn{"region=eu"}, true},
+		{RunOn{"region=us"}, false},
+		{RunOn{"!no-network"}, true},
+		{RunOn{"!host=db1"}, false},
+		{RunOn{"region=eu", "!host=db2"}, true},
+		{RunOn{"region=eu", "!host=db1"}, false},
+	} {
+		if got := test.runOn.Matches(tags); got != test.want {
+			t.Errorf("%v.Matches(%v) = %v want %v", test.runOn, tags.Sorted(), got, test.want)
+		}
+	}
+
+	if err := (RunOn{"region=eu", "!host=db1"}).Check(); err != nil {
+		t.Errorf("Check() = %v", err)
+	}
+	for _, runOn := range []RunOn{{""}, {"!"}, {"!!host=db1"}, {"a,b"}} {
+		if err := runOn.Check(); err == nil {
+			t.Errorf("%q.Check() succeeded", []string(runOn))
+		}
+	}
+}
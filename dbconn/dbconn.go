@@ -0,0 +1,254 @@
+// Package dbconn connects to the Postgres database, as configured by a
+// secrets YAML file and environment variables.
+package dbconn
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/steinarvk/watcher/secrets"
+	"github.com/steinarvk/watcher/storage"
+
+	_ "github.com/lib/pq"
+)
+
+// Config is the connection configuration. A host starting with "/" is the
+// directory of a Unix socket. Pool settings left at zero keep the defaults
+// of database/sql.
+type Config struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Database string `yaml:"database"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+
+	SSLMode     string `yaml:"sslmode"`
+	SSLRootCert string `yaml:"sslrootcert"`
+	SSLCert     string `yaml:"sslcert"`
+	SSLKey      string `yaml:"sslkey"`
+
+	ApplicationName string `yaml:"application_name"`
+	ConnectTimeout  string `yaml:"connect_timeout"`
+
+	MaxOpenConns    int    `yaml:"max_open_conns"`
+	MaxIdleConns    int    `yaml:"max_idle_conns"`
+	ConnMaxLifetime string `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime string `yaml:"conn_max_idle_time"`
+}
+
+const DefaultSSLMode = "require"
+
+var sslModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// EnvPrefix is the prefix of the environment variables that override the
+// secrets file, e.g. WATCHER_DB_PASSWORD.
+const EnvPrefix = "WATCHER_DB_"
+
+// Load reads the secrets file, if given, and then the environment
+// variables, which take precedence.
+func Load(secretsFilename string) (*Config, error) {
+	c := &Config{}
+	if secretsFilename != "" {
+		if err := secrets.FromYAML(secretsFilename, c); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.fromEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if c.Database == "" {
+		return nil, fmt.Errorf("no database given (use --db_secrets or %sDATABASE)", EnvPrefix)
+	}
+	if err := c.Check(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) fromEnv(lookup func(string) (string, bool)) error {
+	strs := map[string]*string{
+		"HOST":               &c.Host,
+		"DATABASE":           &c.Database,
+		"USER":               &c.User,
+		"PASSWORD":           &c.Password,
+		"SSLMODE":            &c.SSLMode,
+		"SSLROOTCERT":        &c.SSLRootCert,
+		"SSLCERT":            &c.SSLCert,
+		"SSLKEY":             &c.SSLKey,
+		"APPLICATION_NAME":   &c.ApplicationName,
+		"CONNECT_TIMEOUT":    &c.ConnectTimeout,
+		"CONN_MAX_LIFETIME":  &c.ConnMaxLifetime,
+		"CONN_MAX_IDLE_TIME": &c.ConnMaxIdleTime,
+	}
+	for name, target := range strs {
+		if value, ok := lookup(EnvPrefix + name); ok {
+			*target = value
+		}
+	}
+
+	ints := map[string]*int{
+		"PORT":           &c.Port,
+		"MAX_OPEN_CONNS": &c.MaxOpenConns,
+		"MAX_IDLE_CONNS": &c.MaxIdleConns,
+	}
+	for name, target := range ints {
+		if value, ok := lookup(EnvPrefix + name); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s%s %q: %v", EnvPrefix, name, value, err)
+			}
+			*target = n
+		}
+	}
+	return nil
+}
+
+func (c *Config) GetSSLMode() string {
+	if c.SSLMode == "" {
+		return DefaultSSLMode
+	}
+	return c.SSLMode
+}
+
+// GetApplicationName defaults to the name of the binary, so that its
+// connections can be told apart in pg_stat_activity.
+func (c *Config) GetApplicationName() string {
+	if c.ApplicationName == "" {
+		return filepath.Base(os.Args[0])
+	}
+	return c.ApplicationName
+}
+
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func (c *Config) Check() error {
+	validMode := false
+	for _, mode := range sslModes {
+		validMode = validMode || c.GetSSLMode() == mode
+	}
+	if !validMode {
+		return fmt.Errorf("invalid sslmode %q (want one of %v)", c.SSLMode, sslModes)
+	}
+	if (c.SSLCert == "") != (c.SSLKey == "") {
+		return errors.New("sslcert and sslkey must be given together")
+	}
+	if c.MaxOpenConns < 0 || c.MaxIdleConns < 0 {
+		return errors.New("pool limits must not be negative")
+	}
+	durations := map[string]string{
+		"connect_timeout":    c.ConnectTimeout,
+		"conn_max_lifetime":  c.ConnMaxLifetime,
+		"conn_max_idle_time": c.ConnMaxIdleTime,
+	}
+	for name, s := range durations {
+		if _, err := parseOptionalDuration(s); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", name, s, err)
+		}
+	}
+	return nil
+}
+
+// quote quotes a value for a connection string, so that it may contain
+// spaces, quotes and backslashes.
+func quote(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// DSN returns the connection string, in key=value form.
+func (c *Config) DSN() string {
+	params := map[string]string{
+		"host":             c.Host,
+		"dbname":           c.Database,
+		"user":             c.User,
+		"password":         c.Password,
+		"sslmode":          c.GetSSLMode(),
+		"sslrootcert":      c.SSLRootCert,
+		"sslcert":          c.SSLCert,
+		"sslkey":           c.SSLKey,
+		"application_name": c.GetApplicationName(),
+	}
+	if c.Port != 0 {
+		params["port"] = strconv.Itoa(c.Port)
+	}
+	if timeout, _ := parseOptionalDuration(c.ConnectTimeout); timeout > 0 {
+		// Postgres takes whole seconds, and would treat 0 as no timeout.
+		params["connect_timeout"] = strconv.Itoa(int((timeout + time.Second - 1) / time.Second))
+	}
+
+	var keys []string
+	for key, value := range params {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		parts = append(parts, key+"="+quote(params[key]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// String describes the connection, without the password.
+func (c *Config) String() string {
+	sanitized := *c
+	if sanitized.Password != "" {
+		sanitized.Password = "<redacted>"
+	}
+	return sanitized.DSN()
+}
+
+// Open opens a connection pool, configured as given.
+func Open(c *Config) (*sql.DB, error) {
+	db, err := sql.Open("postgres", c.DSN())
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to DB (%v): %v", c, err)
+	}
+
+	if c.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	if lifetime, _ := parseOptionalDuration(c.ConnMaxLifetime); lifetime > 0 {
+		db.SetConnMaxLifetime(lifetime)
+	}
+	if idleTime, _ := parseOptionalDuration(c.ConnMaxIdleTime); idleTime > 0 {
+		db.SetConnMaxIdleTime(idleTime)
+	}
+
+	return db, nil
+}
+
+// Connect loads the configuration (see Load) and opens the database as
+// storage. The storage can listen for executions on a connection of its
+// own, also configured as given.
+func Connect(secretsFilename string) (*storage.DB, error) {
+	c, err := Load(secretsFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := Open(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := storage.NewPostgres(db)
+	rv.EnableListening(c.DSN())
+	return rv, nil
+}
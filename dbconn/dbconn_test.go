@@ -0,0 +1,67 @@
+package dbconn
+
+import (
+	"testing"
+)
+
+func TestDSN(t *testing.T) {
+	c := &Config{
+		Host:            "/var/run/postgresql",
+		Database:        "watcher",
+		User:            "watcher",
+		Password:        `it's a \secret`,
+		SSLMode:         "disable",
+		ApplicationName: "watcher",
+		ConnectTimeout:  "1500ms",
+	}
+	want := `application_name='watcher' connect_timeout='2' dbname='watcher' host='/var/run/postgresql' password='it\'s a \\secret' sslmode='disable' user='watcher'`
+	if got := c.DSN(); got != want {
+		t.Errorf("DSN() = %s want %s", got, want)
+	}
+	if got := c.String(); got != `application_name='watcher' connect_timeout='2' dbname='watcher' host='/var/run/postgresql' password='<redacted>' sslmode='disable' user='watcher'` {
+		t.Errorf("String() = %s", got)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	env := map[string]string{
+		"WATCHER_DB_PASSWORD":       "from env",
+		"WATCHER_DB_PORT":           "6432",
+		"WATCHER_DB_MAX_OPEN_CONNS": "4",
+	}
+	c := &Config{Host: "db.example.com", Port: 5432, Password: "from file"}
+	err := c.fromEnv(func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Host != "db.example.com" || c.Port != 6432 || c.Password != "from env" || c.MaxOpenConns != 4 {
+		t.Errorf("fromEnv() = %+v", c)
+	}
+
+	env["WATCHER_DB_PORT"] = "many"
+	if err := c.fromEnv(func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}); err == nil {
+		t.Errorf("fromEnv() with an invalid port succeeded")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, c := range []*Config{
+		{SSLMode: "prefer-not"},
+		{SSLCert: "client.crt"},
+		{MaxOpenConns: -1},
+		{ConnMaxLifetime: "forever"},
+	} {
+		if err := c.Check(); err == nil {
+			t.Errorf("Check(%+v) succeeded", c)
+		}
+	}
+	if err := (&Config{SSLMode: "verify-full", SSLCert: "client.crt", SSLKey: "client.key"}).Check(); err != nil {
+		t.Errorf("Check() = %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+// Package gauges publishes the latest outputs of nodes with 'export_metric'
+// as Prometheus gauges, along with the time of the execution they came from.
+package gauges
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/storage"
+)
+
+var Verbose = false
+
+var (
+	metricExportErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "exported_metric_errors",
+			Help:      "Number of outputs of nodes with export_metric that could not be exported",
+		},
+		[]string{"node"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricExportErrors)
+}
+
+const (
+	DefaultName = "watcher_node_value"
+	DefaultHelp = "Latest output of a node"
+
+	// timestampSuffix names the companion gauge of each gauge, holding the
+	// time (in Unix seconds) of the execution each value came from.
+	timestampSuffix = "_last_update_timestamp_seconds"
+)
+
+type gauge struct {
+	labels  []string
+	help    string
+	value   *prometheus.GaugeVec
+	updated *prometheus.GaugeVec
+}
+
+type node struct {
+	path  string
+	spec  *config.ExportSpec
+	gauge *gauge
+
+	// labels are the label names from the output, in order.
+	labels []string
+
+	// series are the label values of the series set from the latest
+	// output, by their joined values.
+	series map[string][]string
+	lastId int64
+}
+
+// Exporter keeps the gauges of the exported nodes up to date. It is not
+// safe for concurrent use.
+type Exporter struct {
+	nodes map[string]*node
+}
+
+// New registers the gauges of the exported nodes. Nodes may share a gauge,
+// as long as they give it the same labels and help.
+func New(reg prometheus.Registerer, exported []config.ExportedNode) (*Exporter, error) {
+	gauges := map[string]*gauge{}
+	rv := &Exporter{nodes: map[string]*node{}}
+
+	for _, exp := range exported {
+		n := &node{path: exp.Path, spec: exp.Spec}
+		for label := range exp.Spec.MetricLabels {
+			n.labels = append(n.labels, label)
+		}
+		sort.Strings(n.labels)
+
+		name, help := exp.Spec.MetricName, exp.Spec.MetricHelp
+		if name == "" {
+			name = DefaultName
+		}
+		if help == "" {
+			help = DefaultHelp
+		}
+		labels := append([]string{"node"}, n.labels...)
+
+		g, ok := gauges[name]
+		if !ok {
+			g = &gauge{
+				labels: labels,
+				help:   help,
+				value: prometheus.NewGaugeVec(
+					prometheus.GaugeOpts{Name: name, Help: help},
+					labels,
+				),
+				updated: prometheus.NewGaugeVec(
+					prometheus.GaugeOpts{Name: name + timestampSuffix, Help: "Time of the execution of the latest value of " + name},
+					labels,
+				),
+			}
+			if err := reg.Register(g.value); err != nil {
+				return nil, fmt.Errorf("unable to register gauge %q of %q: %v", name, exp.Path, err)
+			}
+			if err := reg.Register(g.updated); err != nil {
+				return nil, fmt.Errorf("unable to register gauge %q of %q: %v", name+timestampSuffix, exp.Path, err)
+			}
+			gauges[name] = g
+		} else if strings.Join(g.labels, ",") != strings.Join(labels, ",") || g.help != help {
+			return nil, fmt.Errorf("gauge %q of %q has different labels or help than for other nodes", name, exp.Path)
+		}
+
+		n.gauge = g
+		rv.nodes[exp.Path] = n
+	}
+
+	return rv, nil
+}
+
+// Exports returns whether the node is exported.
+func (e *Exporter) Exports(path string) bool {
+	_, ok := e.nodes[path]
+	return ok
+}
+
+type value struct {
+	labels []string
+	value  float64
+}
+
+func parseNumber(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	case nil:
+		return 0, errors.New("missing value")
+	}
+	return 0, fmt.Errorf("invalid value %v", v)
+}
+
+func labelValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// parse parses the output of the node into the values of its series.
+func (n *node) parse(output string) ([]value, error) {
+	if !n.spec.JSON() {
+		v, err := strconv.ParseFloat(strings.TrimSpace(output), 64)
+		if err != nil {
+			return nil, err
+		}
+		return []value{{nil, v}}, nil
+	}
+
+	valueField := n.spec.MetricValue
+	if valueField == "" {
+		valueField = "value"
+	}
+
+	var rv []value
+	for i, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		v, err := parseNumber(record[valueField])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: field %q: %v", i+1, valueField, err)
+		}
+		var labels []string
+		for _, label := range n.labels {
+			labels = append(labels, labelValue(record[n.spec.MetricLabels[label]]))
+		}
+		rv = append(rv, value{labels, v})
+	}
+	return rv, nil
+}
+
+// Update sets the gauge of the node from its latest successful execution.
+// Series that are not in the latest output are removed. An output that
+// cannot be parsed is logged, and leaves the gauge as it was.
+func (e *Exporter) Update(db storage.Store, path string) error {
+	n, ok := e.nodes[path]
+	if !ok {
+		return nil
+	}
+
+	rows, err := db.QueryExecutions(&storage.ExecutionQuery{
+		Path:           path,
+		SuccessfulOnly: true,
+		Descending:     true,
+		Limit:          1,
+	})
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 || rows[0].Id == n.lastId {
+		return nil
+	}
+	row := rows[0]
+	n.lastId = row.Id
+
+	values, err := n.parse(row.Result.Stdout)
+	if err != nil {
+		log.Printf("unable to export output of %q (%d): %v", path, row.Id, err)
+		metricExportErrors.WithLabelValues(path).Inc()
+		return nil
+	}
+
+	updated := float64(row.RootTime.UnixNano()) / float64(time.Second)
+	series := map[string][]string{}
+	for _, v := range values {
+		labels := append([]string{path}, v.labels...)
+		key := strings.Join(labels, "\x00")
+		if _, ok := series[key]; ok {
+			log.Printf("unable to export output of %q (%d): duplicate labels %v", path, row.Id, v.labels)
+			metricExportErrors.WithLabelValues(path).Inc()
+			continue
+		}
+		series[key] = labels
+		n.gauge.value.WithLabelValues(labels...).Set(v.value)
+		n.gauge.updated.WithLabelValues(labels...).Set(updated)
+	}
+	for key, labels := range n.series {
+		if _, ok := series[key]; !ok {
+			n.gauge.value.DeleteLabelValues(labels...)
+			n.gauge.updated.DeleteLabelValues(labels...)
+		}
+	}
+	n.series = series
+
+	if Verbose {
+		log.Printf("exported %d value(s) of %q", len(series), path)
+	}
+	return nil
+}
+
+func (e *Exporter) updateAll(db storage.Store) error {
+	for path := range e.nodes {
+		if err := e.Update(db, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run updates the gauge of each node notified on stored, and those of all
+// the nodes every period, e.g. to catch executions stored elsewhere.
+func (e *Exporter) Run(db storage.Store, stored <-chan string, period time.Duration) error {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	if err := e.updateAll(db); err != nil {
+		return err
+	}
+	for {
+		select {
+		case path := <-stored:
+			if err := e.Update(db, path); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := e.updateAll(db); err != nil {
+				return err
+			}
+		}
+	}
+}
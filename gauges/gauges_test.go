@@ -0,0 +1,95 @@
+package gauges
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/runner"
+	"github.com/steinarvk/watcher/storage"
+)
+
+func TestExporter(t *testing.T) {
+	db := storage.NewMemory()
+	info := &hostinfo.HostInfo{Hostname: "testhost"}
+	t0 := time.Unix(1500000000, 0)
+
+	insert := func(path string, seconds int, success bool, stdout string) {
+		t.Helper()
+		start := t0.Add(time.Duration(seconds) * time.Second)
+		if _, err := db.InsertExecution(path, &runner.Result{Start: start, Stop: start, Stdout: stdout, Success: success}, info, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	e, err := New(reg, []config.ExportedNode{
+		{Path: "temp", Spec: &config.ExportSpec{ExportMetric: true}},
+		{Path: "df", Spec: &config.ExportSpec{
+			ExportMetric: true,
+			MetricName:   "disk_used_percent",
+			MetricValue:  "used",
+			MetricLabels: map[string]string{"mount": "mountpoint"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insert("temp", 0, true, "21.5\n")
+	insert("temp", 1, false, "error\n")
+	insert("df", 0, true, `{"mountpoint": "/", "used": 40}`+"\n"+`{"mountpoint": "/home", "used": "75"}`)
+	for _, path := range []string{"temp", "df"} {
+		if err := e.Update(db, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	temp := e.nodes["temp"].gauge
+	if got := testutil.ToFloat64(temp.value.WithLabelValues("temp")); got != 21.5 {
+		t.Errorf("gauge of temp = %v want 21.5 (failures are not exported)", got)
+	}
+	if got := testutil.ToFloat64(temp.updated.WithLabelValues("temp")); got != 1500000000 {
+		t.Errorf("update time of temp = %v want 1500000000", got)
+	}
+
+	disk := e.nodes["df"].gauge
+	if got := testutil.ToFloat64(disk.value.WithLabelValues("df", "/home")); got != 75 {
+		t.Errorf("gauge of df /home = %v want 75", got)
+	}
+	if got := testutil.CollectAndCount(disk.value); got != 2 {
+		t.Errorf("gauge of df has %d series want 2", got)
+	}
+
+	// Series missing from the latest output are removed, and an output
+	// that cannot be parsed leaves the gauge as it was.
+	insert("df", 60, true, `{"mountpoint": "/", "used": 41}`)
+	insert("temp", 60, true, "warm\n")
+	for _, path := range []string{"temp", "df"} {
+		if err := e.Update(db, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := testutil.CollectAndCount(disk.value); got != 1 {
+		t.Errorf("gauge of df has %d series want 1", got)
+	}
+	if got := testutil.ToFloat64(disk.updated.WithLabelValues("df", "/")); got != 1500000060 {
+		t.Errorf("update time of df / = %v want 1500000060", got)
+	}
+	if got := testutil.ToFloat64(temp.value.WithLabelValues("temp")); got != 21.5 {
+		t.Errorf("gauge of temp = %v want 21.5 after unparseable output", got)
+	}
+}
+
+func TestConflictingGauges(t *testing.T) {
+	_, err := New(prometheus.NewRegistry(), []config.ExportedNode{
+		{Path: "a", Spec: &config.ExportSpec{ExportMetric: true, MetricName: "shared"}},
+		{Path: "b", Spec: &config.ExportSpec{ExportMetric: true, MetricName: "shared", MetricLabels: map[string]string{"x": "x"}}},
+	})
+	if err == nil {
+		t.Errorf("New() with a gauge exported with different labels succeeded")
+	}
+}
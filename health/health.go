@@ -0,0 +1,152 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	metricCheckFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "health_check_failures",
+			Help:      "Number of times a health check has failed",
+		},
+		[]string{"check"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricCheckFailures)
+}
+
+type check struct {
+	name     string
+	liveness bool
+	f        func() error
+}
+
+// Checker serves health checks over HTTP. Every check is part of readiness;
+// checks marked as liveness checks additionally determine whether the
+// process is considered alive at all.
+type Checker struct {
+	mu     sync.Mutex
+	checks []check
+}
+
+func (c *Checker) add(name string, liveness bool, f func() error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, check{name, liveness, f})
+}
+
+// AddReadinessCheck adds a check that must pass for the process to be ready.
+func (c *Checker) AddReadinessCheck(name string, f func() error) {
+	c.add(name, false, f)
+}
+
+// AddLivenessCheck adds a check that must pass for the process to be alive
+// (and therefore also to be ready).
+func (c *Checker) AddLivenessCheck(name string, f func() error) {
+	c.add(name, true, f)
+}
+
+type CheckResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type Report struct {
+	OK     bool          `json:"ok"`
+	Checks []CheckResult `json:"checks"`
+}
+
+// Run runs the checks, either only the liveness checks or all of them.
+func (c *Checker) Run(livenessOnly bool) *Report {
+	c.mu.Lock()
+	checks := append([]check(nil), c.checks...)
+	c.mu.Unlock()
+
+	rv := &Report{OK: true}
+	for _, chk := range checks {
+		if livenessOnly && !chk.liveness {
+			continue
+		}
+		result := CheckResult{Name: chk.name, OK: true}
+		if err := chk.f(); err != nil {
+			metricCheckFailures.WithLabelValues(chk.name).Inc()
+			result.OK = false
+			result.Error = err.Error()
+			rv.OK = false
+		}
+		rv.Checks = append(rv.Checks, result)
+	}
+	return rv
+}
+
+func (c *Checker) serve(w http.ResponseWriter, livenessOnly bool) {
+	report := c.Run(livenessOnly)
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.OK {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("error writing health report: %v", err)
+	}
+}
+
+// LivenessHandler serves the liveness checks (conventionally on /healthz).
+func (c *Checker) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.serve(w, true)
+	})
+}
+
+// ReadinessHandler serves all the checks (conventionally on /readyz).
+func (c *Checker) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.serve(w, false)
+	})
+}
+
+// Heartbeat records the last time a periodic background task completed,
+// so that its liveness can be checked.
+type Heartbeat struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (h *Heartbeat) Beat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = time.Now()
+}
+
+// Check returns a check function that fails if the heartbeat has not beaten
+// within maxAge.
+func (h *Heartbeat) Check(maxAge time.Duration) func() error {
+	return func() error {
+		h.mu.Lock()
+		last := h.last
+		h.mu.Unlock()
+
+		if last.IsZero() {
+			return errors.New("no heartbeat yet")
+		}
+		if age := time.Since(last); age > maxAge {
+			return fmt.Errorf("last heartbeat %v ago (at %v)", age, last)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,58 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, h http.Handler) (int, *Report) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	report := &Report{}
+	if err := json.Unmarshal(rec.Body.Bytes(), report); err != nil {
+		t.Fatalf("invalid report %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, report
+}
+
+func TestHandlers(t *testing.T) {
+	c := &Checker{}
+	alive := true
+	c.AddLivenessCheck("alive", func() error {
+		if !alive {
+			return errors.New("dead")
+		}
+		return nil
+	})
+	hb := &Heartbeat{}
+	c.AddReadinessCheck("heartbeat", hb.Check(time.Minute))
+
+	if code, report := get(t, c.ReadinessHandler()); code != http.StatusServiceUnavailable || report.OK {
+		t.Errorf("/readyz without heartbeat = %d %+v want 503", code, report)
+	}
+
+	hb.Beat()
+	if code, report := get(t, c.ReadinessHandler()); code != http.StatusOK || !report.OK || len(report.Checks) != 2 {
+		t.Errorf("/readyz = %d %+v want 200 with two checks", code, report)
+	}
+
+	// A stale heartbeat makes the process unready but not dead.
+	hb.last = time.Now().Add(-2 * time.Minute)
+	code, report := get(t, c.ReadinessHandler())
+	if code != http.StatusServiceUnavailable || report.OK || report.Checks[1].OK || report.Checks[1].Error == "" {
+		t.Errorf("/readyz with stale heartbeat = %d %+v want 503 failing heartbeat", code, report)
+	}
+	if code, report := get(t, c.LivenessHandler()); code != http.StatusOK || len(report.Checks) != 1 {
+		t.Errorf("/healthz with stale heartbeat = %d %+v want 200 with one check", code, report)
+	}
+
+	alive = false
+	if code, _ := get(t, c.LivenessHandler()); code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz with failing liveness check = %d want 503", code)
+	}
+}
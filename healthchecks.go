@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/health"
+	"github.com/steinarvk/watcher/storage"
+	"github.com/steinarvk/watcher/supervisor"
+)
+
+const (
+	databasePingTimeout = 5 * time.Second
+	leaseCleanerMaxAge  = time.Minute
+)
+
+func addHealthChecks(checker *health.Checker, db storage.Store, cfg *config.Config, tags config.Tags, sup *supervisor.Supervisor, leaseCleaner *health.Heartbeat) {
+	checker.AddLivenessCheck("workers-not-failed", func() error {
+		var failed []string
+		for _, status := range sup.Status() {
+			if status.State == supervisor.StateFailed {
+				failed = append(failed, status.Node)
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("permanently failed: %s", strings.Join(failed, ", "))
+		}
+		return nil
+	})
+
+	checker.AddReadinessCheck("database", func() error {
+		return db.Ping(databasePingTimeout)
+	})
+
+	checker.AddReadinessCheck("workers-running", func() error {
+		var notRunning []string
+		for _, status := range sup.Status() {
+			switch status.State {
+			case supervisor.StateRunning, supervisor.StateStopped:
+			default:
+				notRunning = append(notRunning, fmt.Sprintf("%s (%s)", status.Node, status.State))
+			}
+		}
+		if len(notRunning) > 0 {
+			return fmt.Errorf("not running: %s", strings.Join(notRunning, ", "))
+		}
+		return nil
+	})
+
+	checker.AddReadinessCheck("lease-cleaner", leaseCleaner.Check(leaseCleanerMaxAge))
+
+	checker.AddReadinessCheck("schedule-lag", func() error {
+		stopped := map[string]bool{}
+		for _, status := range sup.Status() {
+			if status.State == supervisor.StateStopped {
+				stopped[status.Node] = true
+			}
+		}
+
+		var lagging []string
+		now := time.Now()
+		for _, w := range cfg.Watch {
+			// Watches run elsewhere are for their own daemons to report.
+			if stopped[w.Name] || !w.RunOn.Matches(tags) {
+				continue
+			}
+			next, got, err := db.NextScheduledSpecificEvent(w.Name)
+			if err != nil {
+				return err
+			}
+			if !got {
+				continue
+			}
+			if lag := now.Sub(next); lag > *maxScheduleLag {
+				lagging = append(lagging, fmt.Sprintf("%s (%v late)", w.Name, lag))
+			}
+		}
+		if len(lagging) > 0 {
+			return fmt.Errorf("past scheduled time: %s", strings.Join(lagging, ", "))
+		}
+		return nil
+	})
+}
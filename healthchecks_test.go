@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/health"
+	"github.com/steinarvk/watcher/storage"
+	"github.com/steinarvk/watcher/supervisor"
+)
+
+func serve(h http.Handler) (int, string) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestHealthChecks(t *testing.T) {
+	db := storage.NewMemory()
+	cfg := &config.Config{Watch: []*config.WatchSpec{{Name: "uptime"}}}
+	sup := supervisor.New(1)
+	heartbeat := &health.Heartbeat{}
+	heartbeat.Beat()
+
+	checker := &health.Checker{}
+	addHealthChecks(checker, db, cfg, nil, sup, heartbeat)
+
+	if code, body := serve(checker.ReadinessHandler()); code != http.StatusOK {
+		t.Errorf("/readyz = %d %s want 200", code, body)
+	}
+
+	if err := db.ScheduleEvent("uptime", time.Now().Add(-2**maxScheduleLag)); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := serve(checker.ReadinessHandler()); code != http.StatusServiceUnavailable || !strings.Contains(body, "uptime") {
+		t.Errorf("/readyz with schedule lag = %d %s want 503 naming uptime", code, body)
+	}
+	if code, body := serve(checker.LivenessHandler()); code != http.StatusOK {
+		t.Errorf("/healthz with schedule lag = %d %s want 200", code, body)
+	}
+
+	if err := sup.Go("broken", func() error { return errors.New("broken") }); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, body := serve(checker.LivenessHandler())
+		if code == http.StatusServiceUnavailable && strings.Contains(body, "broken") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("/healthz with failed worker = %d %s want 503 naming broken", code, body)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
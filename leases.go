@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// leasesCore implements the "leases" command, which lists the leases held
+// in the configured database ("leases" or "leases list"), or breaks the
+// lease on a key ("leases break KEY"), e.g. one held by a process on a host
+// that is gone. The holder of a broken lease gives up its work when it next
+// tries to renew the lease.
+func leasesCore(args []string) error {
+	if *configFilename == "" {
+		return errors.New("missing required flag: --config")
+	}
+	if *ephemeral {
+		return errors.New("no leases in ephemeral mode")
+	}
+
+	cfg, err := loadConfig(*configFilename)
+	if err != nil {
+		return err
+	}
+
+	db, err := openStorage(cfg.Storage)
+	if err != nil {
+		return err
+	}
+
+	command := "list"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "list":
+		if len(args) > 1 {
+			return errors.New("usage: leases list")
+		}
+		leases, err := db.ListLeases()
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "KEY\tHOLDER\tOBTAINED\tEXPIRES\n")
+		for _, lease := range leases {
+			holder := "unknown"
+			if lease.HolderHost != "" {
+				holder = fmt.Sprintf("%s:%d", lease.HolderHost, lease.HolderPid)
+			}
+			obtained := "unknown"
+			if lease.Obtained != nil {
+				obtained = lease.Obtained.Format(time.RFC3339)
+			}
+			expires := fmt.Sprintf("in %v", lease.Until.Sub(now).Round(time.Second))
+			if lease.Until.Before(now) {
+				expires = fmt.Sprintf("expired %v ago", now.Sub(lease.Until).Round(time.Second))
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", lease.Key, holder, obtained, expires)
+		}
+		return w.Flush()
+
+	case "break":
+		if len(args) != 2 {
+			return errors.New("usage: leases break KEY")
+		}
+		broken, err := db.BreakLease(args[1])
+		if err != nil {
+			return err
+		}
+		if !broken {
+			return fmt.Errorf("no lease on %q", args[1])
+		}
+		log.Printf("broke lease on %q", args[1])
+		return nil
+
+	default:
+		return fmt.Errorf("unknown leases command %q (want \"list\" or \"break\")", command)
+	}
+}
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,12 +11,22 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/steinarvk/watcher/alerts"
 	"github.com/steinarvk/watcher/analyse"
 	"github.com/steinarvk/watcher/config"
-	"github.com/steinarvk/watcher/secrets"
+	"github.com/steinarvk/watcher/dbconn"
+	"github.com/steinarvk/watcher/gauges"
+	"github.com/steinarvk/watcher/health"
+	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/prune"
+	"github.com/steinarvk/watcher/spool"
+	"github.com/steinarvk/watcher/staleness"
 	"github.com/steinarvk/watcher/storage"
+	"github.com/steinarvk/watcher/supervisor"
 	"github.com/steinarvk/watcher/trigger"
 	"github.com/steinarvk/watcher/watch"
 
@@ -31,12 +42,28 @@ var (
 	DefaultPort = 5365
 )
 
+// spoolReplayPeriod is how often spooled executions are retried.
+const spoolReplayPeriod = 30 * time.Second
+
+// gaugeRefreshPeriod is how often the gauges of exported nodes are updated,
+// besides whenever the nodes are stored.
+const gaugeRefreshPeriod = time.Minute
+
+// reconcilePeriod is how often new analyses are looked for, to enqueue their
+// work on the executions stored before them.
+const reconcilePeriod = time.Minute
+
 var (
 	configFilename    = flag.String("config", "", "config YAML file")
-	dbSecretsFilename = flag.String("db_secrets", "", "database secrets YAML file")
+	dbSecretsFilename = flag.String("db_secrets", "", "database secrets YAML file (or use WATCHER_DB_* environment variables)")
 	verboseLogging    = flag.Bool("verbose", false, "verbose logging")
+	ephemeral         = flag.Bool("ephemeral", false, "keep everything in memory instead of using the configured storage (for dry runs)")
 	listenHost        = flag.String("listen_host", "localhost", "listen on all network interfaces, not only localhost")
 	port              = flag.Int("port", 0, "port on which to listen")
+	alertsListen      = flag.String("alerts_listen", "", "address (e.g. localhost:5366) on which to serve the alert API, which is unauthenticated; not served if empty")
+	maxScheduleLag    = flag.Duration("max_schedule_lag", 5*time.Minute, "how far past its scheduled time a watch may be before the daemon is considered unready")
+	maxWorkerFailures = flag.Int("max_worker_failures", 0, "number of consecutive failures after which a worker is marked as permanently failed (0 for no limit)")
+	tagsFlag          = flag.String("tags", "", "comma-separated tags of this daemon, matched against the 'run_on' of nodes (e.g. region=eu,has-gpu-tools)")
 )
 
 var (
@@ -100,33 +127,53 @@ func loadConfig(filename string) (*config.Config, error) {
 	return cfg, nil
 }
 
-type DatabaseSecrets struct {
-	Host     string `yaml:"host"`
-	Port     int    `yaml:"port"`
-	Database string `yaml:"database"`
-	User     string `yaml:"user"`
-	Password string `yaml:"password"`
-}
+// openDB opens the configured database, without checking its schema.
+func openDB(spec *config.StorageSpec) (*storage.DB, error) {
+	var db *storage.DB
+	var err error
 
-func connectDB(secretsFilename string) (*storage.DB, error) {
-	dbSecrets := DatabaseSecrets{}
-	if err := secrets.FromYAML(secretsFilename, &dbSecrets); err != nil {
+	switch spec.GetBackend() {
+	case config.StorageBackendSQLite:
+		log.Printf("using SQLite database %q", spec.Path)
+		db, err = storage.OpenSQLite(spec.Path)
+
+	default:
+		db, err = dbconn.Connect(*dbSecretsFilename)
+	}
+	if err != nil {
 		return nil, err
 	}
 
-	opts := fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s sslmode=require", dbSecrets.Host, dbSecrets.Port, dbSecrets.Database, dbSecrets.User, dbSecrets.Password)
+	db.Compression = spec.GetCompression()
+	if db.QueryTimeout, err = spec.GetQueryTimeout(); err != nil {
+		return nil, err
+	}
+	if db.QueryTimeouts, err = spec.GetQueryTimeouts(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
 
-	dbSecrets.Password = ""
-	sanitizedDBCreds := dbSecrets
+func openStorage(spec *config.StorageSpec) (storage.Store, error) {
+	if *ephemeral {
+		log.Printf("running in ephemeral mode: nothing will be stored")
+		return storage.NewMemory(), nil
+	}
 
-	db, err := sql.Open("postgres", opts)
+	db, err := openDB(spec)
 	if err != nil {
-		return nil, fmt.Errorf("unable to connect to DB (credentials: %v): %v", sanitizedDBCreds, err)
+		return nil, err
 	}
 
-	opts = ""
+	migrations, err := loadMigrations(spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.CheckSchemaVersion(migrations); err != nil {
+		return nil, err
+	}
 
-	return &storage.DB{db}, nil
+	return db, nil
 }
 
 func mainCore() error {
@@ -134,72 +181,207 @@ func mainCore() error {
 		storage.Verbose = true
 		watch.Verbose = true
 		analyse.Verbose = true
+		supervisor.Verbose = true
+		staleness.Verbose = true
+		prune.Verbose = true
+		spool.Verbose = true
+		gauges.Verbose = true
 	}
 
 	if *configFilename == "" {
 		return errors.New("missing required flag: --config")
 	}
 
-	if *dbSecretsFilename == "" {
-		return errors.New("missing required flag: --db_secrets")
-	}
+	sup := supervisor.New(*maxWorkerFailures)
+	checker := &health.Checker{}
 
 	listener, err := beginListening()
 	if err != nil {
 		return err
 	}
 	http.Handle("/metrics", promhttp.Handler())
+	owners := &ownership{}
+	http.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		instance, nodes := owners.get()
+		status := struct {
+			Instance *instanceStatus           `json:"instance,omitempty"`
+			Nodes    []nodeOwnership           `json:"nodes,omitempty"`
+			Workers  []supervisor.WorkerStatus `json:"workers"`
+		}{
+			Instance: instance,
+			Nodes:    nodes,
+			Workers:  sup.Status(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Printf("error writing status: %v", err)
+		}
+	})
+	http.Handle("/healthz", checker.LivenessHandler())
+	http.Handle("/readyz", checker.ReadinessHandler())
 	log.Printf("listening on: http://%s/metrics", listener.Addr())
 	go func() {
 		// Listen forever, unless something goes wrong.
 		log.Fatal(http.Serve(listener, nil))
 	}()
 
-	db, err := connectDB(*dbSecretsFilename)
+	cfg, err := loadConfig(*configFilename)
 	if err != nil {
 		return err
 	}
 
-	cfg, err := loadConfig(*configFilename)
+	info, err := hostinfo.Get()
 	if err != nil {
 		return err
 	}
+	tags, err := config.ParseTags(*tagsFlag, info.Hostname)
+	if err != nil {
+		return fmt.Errorf("invalid --tags: %v", err)
+	}
+	log.Printf("running with tags %v", tags.Sorted())
+	owners.setInstance(&instanceStatus{
+		Hostname: info.Hostname,
+		Pid:      info.Pid,
+		Tags:     tags.Sorted(),
+	})
+
+	// Shutting down cancels the queries in progress.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, err := openStorage(cfg.Storage)
+	if err != nil {
+		return err
+	}
+	if err := db.SetChildren(cfg.QueuedChildren()); err != nil {
+		return fmt.Errorf("unable to record the children of nodes: %v", err)
+	}
+	db = db.WithContext(ctx)
+	rawDB := db
 
-	go func() {
+	nodesStored := make(chan string, 100)
+
+	// The spool must wrap the store before any worker is started with it.
+	if dir := cfg.Storage.GetSpoolDir(); dir != "" && !*ephemeral {
+		sp, err := spool.Open(dir)
+		if err != nil {
+			return err
+		}
+		db = &spool.Store{Store: rawDB, Spool: sp}
+		err = sup.Go("internal:spool-replayer", func() error {
+			return spool.Replayer(sp, rawDB, spoolReplayPeriod, nodesStored)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The alert API can silence any trigger, and has no authentication of
+	// its own, so it is kept off the listener for metrics and status.
+	if *alertsListen != "" {
+		alertsListener, err := net.Listen("tcp", *alertsListen)
+		if err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/api/alerts/", alerts.Handler(db, "/api/alerts"))
+		log.Printf("serving the alert API on: http://%s/api/alerts/", alertsListener.Addr())
+		go func() {
+			log.Fatal(http.Serve(alertsListener, mux))
+		}()
+	}
+	owners.setLeases(db)
+
+	leaseCleanerHeartbeat := &health.Heartbeat{}
+
+	// Internal workers are named with a ':', which cannot occur in node names.
+	err = sup.Go("internal:lease-cleaner", func() error {
 		for {
 			if err := db.CleanLeases(time.Now()); err != nil {
-				log.Fatalf("error: CleanLeases() = %v", err)
+				return fmt.Errorf("CleanLeases() = %v", err)
 			}
+			leaseCleanerHeartbeat.Beat()
 			time.Sleep(10 * time.Second)
 		}
-	}()
+	})
+	if err != nil {
+		return err
+	}
 
-	nodesStored := make(chan string, 100)
+	addHealthChecks(checker, db, cfg, tags, sup, leaseCleanerHeartbeat)
+
+	if cfg.Staleness != nil {
+		staleNodes := cfg.StaleNodes()
+		err := sup.Go("internal:staleness-checker", func() error {
+			return staleness.Checker(db, cfg.Staleness, staleNodes)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	analyses := cfg.AnalysisPaths()
+	err = sup.Go("internal:reconciler", func() error {
+		return analyse.Reconciler(db, analyses, reconcilePeriod)
+	})
+	if err != nil {
+		return err
+	}
+
+	if retained := cfg.RetainedWatches(); len(retained) > 0 {
+		err := sup.Go("internal:pruner", func() error {
+			return prune.Pruner(db, cfg.Pruning, retained)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// The gauges are updated from the database, so every daemon exports
+	// every node, whichever daemon runs it.
+	var exporter *gauges.Exporter
+	gaugesStored := make(chan string, 100)
+	if exported := cfg.ExportedNodes(); len(exported) > 0 {
+		exporter, err = gauges.New(prometheus.DefaultRegisterer, exported)
+		if err != nil {
+			return err
+		}
+		err = sup.Go("internal:gauge-exporter", func() error {
+			return exporter.Run(db, gaugesStored, gaugeRefreshPeriod)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	notifyExporter := func(path string) {
+		if exporter == nil || !exporter.Exports(path) {
+			return
+		}
+		select {
+		case gaugesStored <- path:
+		default:
+		}
+	}
 
 	analyserChans := map[string][]chan<- struct{}{}
 
 	var startAnalyser func(string, *config.AnalysisSpec) error
 
+	// Only the nodes run here are notified, so that every channel is read.
 	startTrigger := func(parentPath string, triggerSpec *config.TriggerSpec) error {
+		path := parentPath + "/" + triggerSpec.Name
+		if !owners.add(path, triggerSpec.RunOn, tags) {
+			return nil
+		}
 		notifyChan := make(chan struct{}, 100)
 		analyserChans[parentPath] = append(analyserChans[parentPath], notifyChan)
-		path := parentPath + "/" + triggerSpec.Name
-
-		go func() {
-			err := trigger.TriggerWorker(db, parentPath, path, triggerSpec, notifyChan, nodesStored)
-			if err != nil {
-				log.Fatal(fmt.Errorf("error with trigger %q: %v", path, err))
-			}
-		}()
 
-		return nil
+		return sup.Go(path, func() error {
+			return trigger.TriggerWorker(db, parentPath, path, triggerSpec, notifyChan, nodesStored)
+		})
 	}
 
 	startAnalyser = func(parentPath string, analysisSpec *config.AnalysisSpec) error {
-		notifyChan := make(chan struct{}, 100)
-
-		analyserChans[parentPath] = append(analyserChans[parentPath], notifyChan)
-
 		path := parentPath + "/" + analysisSpec.Name
 		for _, ch := range analysisSpec.Children {
 			if err := startAnalyser(path, ch); err != nil {
@@ -213,38 +395,88 @@ func mainCore() error {
 			}
 		}
 
-		go func() {
-			err := analyse.Analyse(db, parentPath, path, analysisSpec, notifyChan, nodesStored)
-			if err != nil {
-				log.Fatal(fmt.Errorf("error with analyser %q: %v", path, err))
-			}
-		}()
+		if !owners.add(path, analysisSpec.RunOn, tags) {
+			return nil
+		}
+		notifyChan := make(chan struct{}, 100)
+		analyserChans[parentPath] = append(analyserChans[parentPath], notifyChan)
 
-		return nil
+		return sup.Go(path, func() error {
+			return analyse.Analyse(db, parentPath, path, analysisSpec, notifyChan, nodesStored)
+		})
 	}
 
 	for _, w := range cfg.Watch {
-		go func(w *config.WatchSpec) {
-			err := watch.Watch(db, w, nodesStored)
+		w := w
+		if owners.add(w.Name, w.RunOn, tags) {
+			err := sup.Go(w.Name, func() error {
+				return watch.Watch(db, w, nodesStored)
+			})
 			if err != nil {
-				log.Fatal(fmt.Errorf("error with watcher %q: %v", w.Name, err))
+				return err
 			}
-		}(w)
+		}
 		for _, ch := range w.Children {
 			if err := startAnalyser(w.Name, ch); err != nil {
-				log.Fatal(err)
+				return err
 			}
 		}
 	}
 
-	for path := range nodesStored {
-		metricNodeDataStored.WithLabelValues(path).Inc()
-		for _, ch := range analyserChans[path] {
-			metricNodeStoredHintsSent.Inc()
-			ch <- struct{}{}
+	// Executions stored by other processes are notified by the database,
+	// when it can; otherwise they are found by polling.
+	executionsNotified := make(chan string, 100)
+	if pg, ok := rawDB.(*storage.DB); ok && pg.CanListen() {
+		err := sup.Go("internal:execution-listener", func() error {
+			return pg.ListenForExecutions(executionsNotified)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case path := <-nodesStored:
+			metricNodeDataStored.WithLabelValues(path).Inc()
+			notifyExporter(path)
+			// A pending wakeup is enough: an analyser or trigger busy
+			// with earlier work finds the new work when it is done.
+			for _, ch := range analyserChans[path] {
+				select {
+				case ch <- struct{}{}:
+					metricNodeStoredHintsSent.Inc()
+				default:
+				}
+			}
+
+		case path := <-executionsNotified:
+			// This includes our own executions, so a wakeup may already
+			// be pending; there is no need to wait to add another.
+			chans := analyserChans[path]
+			if path == storage.AnyExecution {
+				// Executions may have been missed while the listener
+				// reconnected, so every analyser and trigger looks.
+				chans = nil
+				for _, pathChans := range analyserChans {
+					chans = append(chans, pathChans...)
+				}
+			} else {
+				notifyExporter(path)
+			}
+			for _, ch := range chans {
+				select {
+				case ch <- struct{}{}:
+					metricNodeStoredHintsSent.Inc()
+				default:
+				}
+			}
+
+		case <-ctx.Done():
+			log.Printf("shutting down")
+			return nil
 		}
 	}
-	return errors.New("impossible: exhausted neverending channel (nodesStored)")
 }
 
 func main() {
@@ -252,7 +484,15 @@ func main() {
 
 	os.Unsetenv("PGPASSFILE")
 
-	if err := mainCore(); err != nil {
+	core := mainCore
+	switch flag.Arg(0) {
+	case "migrate":
+		core = func() error { return migrateCore(flag.Args()[1:]) }
+	case "leases":
+		core = func() error { return leasesCore(flag.Args()[1:]) }
+	}
+
+	if err := core(); err != nil {
 		log.Fatalf("fatal: %v", err)
 	}
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/storage"
+)
+
+//go:embed sql/*.sql sql/sqlite/*.sql
+var migrationFiles embed.FS
+
+func loadMigrations(spec *config.StorageSpec) (storage.Migrations, error) {
+	dir := "sql"
+	if spec.GetBackend() == config.StorageBackendSQLite {
+		dir = "sql/sqlite"
+	}
+
+	sub, err := fs.Sub(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	return storage.LoadMigrations(sub)
+}
+
+// migrateCore implements the "migrate" command, which brings the configured
+// database up to the latest schema version.
+func migrateCore(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	baseline := flags.Int("baseline", 0, "record the schema version of a database migrated with pg-migrator, instead of migrating")
+	flags.Parse(args)
+
+	if *configFilename == "" {
+		return errors.New("missing required flag: --config")
+	}
+	if *ephemeral {
+		return errors.New("nothing to migrate in ephemeral mode")
+	}
+
+	cfg, err := loadConfig(*configFilename)
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB(cfg.Storage)
+	if err != nil {
+		return err
+	}
+	defer db.DB.Close()
+
+	if *baseline > 0 {
+		return db.Baseline(*baseline)
+	}
+
+	migrations, err := loadMigrations(cfg.Storage)
+	if err != nil {
+		return err
+	}
+
+	from, to, err := db.Migrate(migrations)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		log.Printf("schema is up to date at version %d", to)
+	} else {
+		log.Printf("migrated schema from version %d to %d", from, to)
+	}
+
+	return migrateOutputs(db)
+}
+
+// migrateOutputsBatchSize is the number of executions whose outputs are
+// moved into blobs per transaction.
+const migrateOutputsBatchSize = 1000
+
+// migrateOutputs moves outputs stored before output blobs were introduced
+// into blobs. It can be interrupted and run again.
+func migrateOutputs(db *storage.DB) error {
+	var afterId int64
+	var n int
+	for {
+		lastId, err := db.MigrateOutputs(afterId, migrateOutputsBatchSize)
+		if err != nil {
+			return err
+		}
+		if lastId == 0 {
+			break
+		}
+		n++
+		log.Printf("moved outputs into blobs up to execution %d", lastId)
+		afterId = lastId
+	}
+	if n > 0 {
+		log.Printf("done moving outputs into blobs")
+	}
+	return nil
+}
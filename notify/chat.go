@@ -0,0 +1,111 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"text/template"
+
+	"github.com/steinarvk/watcher/secrets"
+)
+
+const (
+	defaultChatText = "{{or .Metadata.trigger_path .Metadata.node_path}} ({{.Metadata.event}}):\n{{.Input}}"
+)
+
+// ChatConfig specifies a notifier that posts to a Slack- or
+// Mattermost-compatible incoming webhook. Since the webhook URL is
+// effectively a credential, it can be read from a secrets file instead
+// (with the key "url").
+type ChatConfig struct {
+	URL       string `yaml:"url"`
+	Secrets   string `yaml:"secrets"`
+	Text      string `yaml:"text"`
+	Username  string `yaml:"username"`
+	Channel   string `yaml:"channel"`
+	IconEmoji string `yaml:"icon_emoji"`
+	Retries   *int   `yaml:"retries"`
+}
+
+type ChatSecrets struct {
+	URL string `yaml:"url"`
+}
+
+type chat struct {
+	config  *ChatConfig
+	text    *template.Template
+	retries int
+}
+
+func (c *ChatConfig) toNotifier() (*chat, error) {
+	if (c.URL == "") == (c.Secrets == "") {
+		return nil, errors.New("exactly one of 'url' and 'secrets' is required")
+	}
+	if c.Secrets != "" {
+		if _, err := c.getURL(); err != nil {
+			return nil, err
+		}
+	}
+
+	text := c.Text
+	if text == "" {
+		text = defaultChatText
+	}
+	tmpl, err := parseTemplate("text", text)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &chat{config: c, text: tmpl, retries: DefaultRetries}
+	if c.Retries != nil {
+		if *c.Retries < 0 {
+			return nil, errors.New("'retries' cannot be negative")
+		}
+		rv.retries = *c.Retries
+	}
+	return rv, nil
+}
+
+func (c *ChatConfig) getURL() (string, error) {
+	if c.URL != "" {
+		return c.URL, nil
+	}
+	chatSecrets := ChatSecrets{}
+	if err := secrets.FromYAML(c.Secrets, &chatSecrets); err != nil {
+		return "", err
+	}
+	if chatSecrets.URL == "" {
+		return "", errors.New("missing 'url' in chat secrets")
+	}
+	return chatSecrets.URL, nil
+}
+
+func (c *chat) Notify(ctx context.Context, msg *Message) (string, error) {
+	text, err := render(c.text, msg)
+	if err != nil {
+		return "", err
+	}
+
+	url, err := c.config.getURL()
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(struct {
+		Text      string `json:"text"`
+		Username  string `json:"username,omitempty"`
+		Channel   string `json:"channel,omitempty"`
+		IconEmoji string `json:"icon_emoji,omitempty"`
+	}{text, c.config.Username, c.config.Channel, c.config.IconEmoji})
+	if err != nil {
+		return "", err
+	}
+
+	// Don't leak a secret URL into logs and stored executions.
+	name := url
+	if c.config.Secrets != "" {
+		name = "<chat webhook from " + c.config.Secrets + ">"
+	}
+
+	return post(ctx, url, name, "application/json", nil, body, c.retries)
+}
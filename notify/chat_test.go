@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type chatPayload struct {
+	Text      string `json:"text"`
+	Username  string `json:"username"`
+	Channel   string `json:"channel"`
+	IconEmoji string `json:"icon_emoji"`
+}
+
+func chatServer(t *testing.T) (*httptest.Server, <-chan map[string]interface{}) {
+	t.Helper()
+	payloads := make(chan map[string]interface{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if got := req.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type = %q want application/json", got)
+		}
+		var payload map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			t.Errorf("error decoding chat payload: %v", err)
+		}
+		payloads <- payload
+	}))
+	t.Cleanup(server.Close)
+	return server, payloads
+}
+
+func TestChatDefaultPayload(t *testing.T) {
+	server, payloads := chatServer(t)
+
+	notifier, err := (&Config{Chat: &ChatConfig{URL: server.URL}}).ToNotifier()
+	if err != nil {
+		t.Fatalf("ToNotifier() = %v", err)
+	}
+	msg := &Message{Input: "too hot", Metadata: map[string]string{"trigger_path": "acpi/hot/alert", "event": "fire"}}
+	if _, err := notifier.Notify(context.Background(), msg); err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+
+	payload := <-payloads
+	if len(payload) != 1 || payload["text"] != "acpi/hot/alert (fire):\ntoo hot" {
+		t.Errorf("payload = %v want only the default text", payload)
+	}
+}
+
+func TestChatPayloadFromSecrets(t *testing.T) {
+	server, payloads := chatServer(t)
+
+	filename := filepath.Join(t.TempDir(), "chat.secret.yaml")
+	if err := ioutil.WriteFile(filename, []byte("url: "+server.URL+"/hooks/secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{Chat: &ChatConfig{
+		Secrets:   filename,
+		Text:      ":fire: {{.Metadata.node_path}} is {{.Metadata.event}}",
+		Username:  "watcher",
+		Channel:   "#alerts",
+		IconEmoji: ":eyes:",
+	}}
+	notifier, err := cfg.ToNotifier()
+	if err != nil {
+		t.Fatalf("ToNotifier() = %v", err)
+	}
+	status, err := notifier.Notify(context.Background(), &Message{Metadata: map[string]string{"node_path": "df", "event": "stale"}})
+	if err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+	if strings.Contains(status, "/hooks/secret") {
+		t.Errorf("status = %q leaks the secret URL", status)
+	}
+
+	var got chatPayload
+	data, _ := json.Marshal(<-payloads)
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := chatPayload{Text: ":fire: df is stale", Username: "watcher", Channel: "#alerts", IconEmoji: ":eyes:"}
+	if got != want {
+		t.Errorf("payload = %+v want %+v", got, want)
+	}
+}
@@ -0,0 +1,185 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/steinarvk/watcher/secrets"
+)
+
+const (
+	defaultEmailSubject = "[watcher] {{or .Metadata.trigger_path .Metadata.node_path}} ({{.Metadata.event}})"
+	defaultEmailBody    = "{{.Input}}\n"
+)
+
+// EmailConfig specifies a notifier that sends email through an SMTP server.
+// The server and credentials are read from a secrets file (see SMTPSecrets).
+// STARTTLS is required unless 'allow_plaintext' is set.
+type EmailConfig struct {
+	Secrets        string   `yaml:"secrets"`
+	To             []string `yaml:"to"`
+	Subject        string   `yaml:"subject"`
+	Body           string   `yaml:"body"`
+	AllowPlaintext bool     `yaml:"allow_plaintext"`
+}
+
+type SMTPSecrets struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+type email struct {
+	config  *EmailConfig
+	subject *template.Template
+	body    *template.Template
+}
+
+func (c *EmailConfig) toNotifier() (*email, error) {
+	if c.Secrets == "" {
+		return nil, errors.New("missing 'secrets'")
+	}
+	if len(c.To) == 0 {
+		return nil, errors.New("missing 'to'")
+	}
+	if _, err := c.getSecrets(); err != nil {
+		return nil, err
+	}
+
+	subject := c.Subject
+	if subject == "" {
+		subject = defaultEmailSubject
+	}
+	body := c.Body
+	if body == "" {
+		body = defaultEmailBody
+	}
+
+	rv := &email{config: c}
+	var err error
+	if rv.subject, err = parseTemplate("subject", subject); err != nil {
+		return nil, err
+	}
+	if rv.body, err = parseTemplate("body", body); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (c *EmailConfig) getSecrets() (*SMTPSecrets, error) {
+	rv := &SMTPSecrets{}
+	if err := secrets.FromYAML(c.Secrets, rv); err != nil {
+		return nil, err
+	}
+	if rv.Host == "" {
+		return nil, errors.New("missing 'host' in SMTP secrets")
+	}
+	if rv.From == "" {
+		return nil, errors.New("missing 'from' in SMTP secrets")
+	}
+	if rv.Port == 0 {
+		rv.Port = 587
+	}
+	return rv, nil
+}
+
+func (e *email) Notify(ctx context.Context, msg *Message) (string, error) {
+	subject, err := render(e.subject, msg)
+	if err != nil {
+		return "", err
+	}
+	body, err := render(e.body, msg)
+	if err != nil {
+		return "", err
+	}
+
+	creds, err := e.config.getSecrets()
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", creds.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(e.config.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject)))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&buf, "\r\n")
+	buf.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	if err := e.send(ctx, creds, buf.Bytes()); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("sent email to %s via %s\n", strings.Join(e.config.To, ", "), creds.Host), nil
+}
+
+func (e *email) send(ctx context.Context, creds *SMTPSecrets, message []byte) error {
+	addr := net.JoinHostPort(creds.Host, strconv.Itoa(creds.Port))
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, creds.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: creds.Host}); err != nil {
+			return fmt.Errorf("STARTTLS failed: %v", err)
+		}
+	} else if !e.config.AllowPlaintext {
+		return fmt.Errorf("SMTP server %s does not support STARTTLS (see 'allow_plaintext')", addr)
+	}
+
+	if creds.Username != "" {
+		auth := smtp.PlainAuth("", creds.Username, creds.Password, creds.Host)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %v", err)
+		}
+	}
+
+	if err := client.Mail(creds.From); err != nil {
+		return err
+	}
+	for _, to := range e.config.To {
+		if err := client.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %q rejected: %v", to, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
@@ -0,0 +1,160 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// smtpSession is what a fake SMTP server received in a session.
+type smtpSession struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTPServer serves a single SMTP session without STARTTLS, accepting
+// PLAIN authentication and any sender and recipients.
+func fakeSMTPServer(t *testing.T) (int, <-chan *smtpSession) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	sessions := make(chan *smtpSession, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		session := &smtpSession{}
+		text := textproto.NewConn(conn)
+		reply := func(format string, args ...interface{}) {
+			text.PrintfLine(format, args...)
+		}
+		reply("220 localhost fake SMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch verb {
+			case "EHLO", "HELO":
+				reply("250-localhost")
+				reply("250 AUTH PLAIN")
+			case "AUTH":
+				fields := strings.Fields(line)
+				decoded, _ := base64.StdEncoding.DecodeString(fields[len(fields)-1])
+				session.auth = string(decoded)
+				reply("235 authenticated")
+			case "MAIL":
+				session.from = line
+				reply("250 ok")
+			case "RCPT":
+				session.to = append(session.to, line)
+				reply("250 ok")
+			case "DATA":
+				reply("354 go ahead")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				session.data = string(data)
+				reply("250 ok")
+			case "QUIT":
+				reply("221 bye")
+				sessions <- session
+				return
+			default:
+				reply("502 unknown command")
+			}
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port, sessions
+}
+
+func writeSMTPSecrets(t *testing.T, port int) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "smtp.secret.yaml")
+	data := fmt.Sprintf("host: localhost\nport: %d\nusername: watcher\npassword: hunter2\nfrom: watcher@example.com\n", port)
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestEmail(t *testing.T) {
+	port, sessions := fakeSMTPServer(t)
+
+	cfg := &Config{Email: &EmailConfig{
+		Secrets:        writeSMTPSecrets(t, port),
+		To:             []string{"oncall@example.com", "boss@example.com"},
+		AllowPlaintext: true,
+	}}
+	notifier, err := cfg.ToNotifier()
+	if err != nil {
+		t.Fatalf("ToNotifier() = %v", err)
+	}
+
+	msg := &Message{Input: "disk full\n", Metadata: map[string]string{"trigger_path": "df/full/alert", "event": "fire"}}
+	status, err := notifier.Notify(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+	if !strings.Contains(status, "oncall@example.com") {
+		t.Errorf("status = %q, should mention the recipients", status)
+	}
+
+	session := <-sessions
+	if session.auth != "\x00watcher\x00hunter2" {
+		t.Errorf("AUTH = %q want the credentials from the secrets", session.auth)
+	}
+	if !strings.Contains(session.from, "<watcher@example.com>") || len(session.to) != 2 {
+		t.Errorf("envelope = %q %q", session.from, session.to)
+	}
+
+	headers, err := textproto.NewReader(bufio.NewReader(strings.NewReader(session.data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("invalid message %q: %v", session.data, err)
+	}
+	if got := headers.Get("Subject"); got != "[watcher] df/full/alert (fire)" {
+		t.Errorf("Subject = %q", got)
+	}
+	if got := headers.Get("To"); got != "oncall@example.com, boss@example.com" {
+		t.Errorf("To = %q", got)
+	}
+	// ReadDotBytes turns the CRLFs of the message into LFs.
+	if !strings.Contains(session.data, "\n\ndisk full\n") {
+		t.Errorf("message = %q, should contain the body", session.data)
+	}
+}
+
+func TestEmailRequiresStartTLS(t *testing.T) {
+	port, _ := fakeSMTPServer(t)
+
+	cfg := &Config{Email: &EmailConfig{
+		Secrets: writeSMTPSecrets(t, port),
+		To:      []string{"oncall@example.com"},
+	}}
+	notifier, err := cfg.ToNotifier()
+	if err != nil {
+		t.Fatalf("ToNotifier() = %v", err)
+	}
+	if _, err := notifier.Notify(context.Background(), &Message{Input: "secret"}); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("Notify() without STARTTLS = %v want an error about STARTTLS", err)
+	}
+}
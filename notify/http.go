@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+const (
+	DefaultRetries = 3
+)
+
+// post POSTs the body to the URL, retrying with exponential backoff on
+// network errors, 5xx and 429 responses. Other failures are not retried.
+// The URL is referred to as 'name' in messages, since it may be secret.
+func post(ctx context.Context, url, name, contentType string, headers map[string]string, body []byte, retries int) (string, error) {
+	attempts := 0
+	var status string
+
+	operation := func() error {
+		attempts++
+
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			if name != url {
+				err = fmt.Errorf("POST %s: invalid URL", name)
+			}
+			return backoff.Permanent(err)
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", contentType)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			if name != url {
+				return fmt.Errorf("POST %s: request failed", name)
+			}
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<20))
+
+		status = resp.Status
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+			return fmt.Errorf("POST %s: %s", name, resp.Status)
+		default:
+			return backoff.Permanent(fmt.Errorf("POST %s: %s", name, resp.Status))
+		}
+	}
+
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = time.Second
+	bo.MaxElapsedTime = 0
+
+	err := backoff.Retry(operation, backoff.WithContext(backoff.WithMaxRetries(bo, uint64(retries)), ctx))
+	if permanent, ok := err.(*backoff.PermanentError); ok {
+		err = permanent.Err
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed after %d attempt(s): %v", attempts, err)
+	}
+
+	return fmt.Sprintf("POST %s: %s (attempt %d)\n", name, status, attempts), nil
+}
@@ -0,0 +1,97 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Config specifies a built-in notifier, used in place of a command.
+type Config struct {
+	Webhook *WebhookConfig `yaml:"webhook"`
+	Email   *EmailConfig   `yaml:"email"`
+	Chat    *ChatConfig    `yaml:"chat"`
+}
+
+// Message is the data available to the templates of a notifier.
+type Message struct {
+	Input    string
+	Metadata map[string]string
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"trim": strings.TrimSpace,
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %q: %v", name, err)
+	}
+	return tmpl, nil
+}
+
+func render(tmpl *template.Template, msg *Message) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, msg); err != nil {
+		return "", fmt.Errorf("error rendering template %q: %v", tmpl.Name(), err)
+	}
+	return buf.String(), nil
+}
+
+// Notifier sends a notification. It returns a human-readable description of
+// the delivery, which is stored as the output of the trigger execution.
+type Notifier interface {
+	Notify(ctx context.Context, msg *Message) (string, error)
+}
+
+func countTrue(xs ...bool) int {
+	var rv int
+	for _, x := range xs {
+		if x {
+			rv++
+		}
+	}
+	return rv
+}
+
+func (c *Config) ToNotifier() (Notifier, error) {
+	n := countTrue(
+		c.Webhook != nil,
+		c.Email != nil,
+		c.Chat != nil,
+	)
+	if n == 0 {
+		return nil, errors.New("empty notify config")
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("ambiguous notify config: %v", c)
+	}
+
+	switch {
+	case c.Webhook != nil:
+		return c.Webhook.toNotifier()
+
+	case c.Email != nil:
+		return c.Email.toNotifier()
+
+	case c.Chat != nil:
+		return c.Chat.toNotifier()
+
+	default:
+		return nil, fmt.Errorf("internal error handling notify config: %v", c)
+	}
+}
+
+func (c *Config) Check() error {
+	_, err := c.ToNotifier()
+	return err
+}
@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebhookDefaultBody(t *testing.T) {
+	var got struct {
+		Input    string            `json:"input"`
+		Metadata map[string]string `json:"metadata"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := json.NewDecoder(req.Body).Decode(&got); err != nil {
+			t.Errorf("error decoding webhook body: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	cfg := &Config{Webhook: &WebhookConfig{URL: server.URL}}
+	notifier, err := cfg.ToNotifier()
+	if err != nil {
+		t.Fatalf("ToNotifier() = %v", err)
+	}
+
+	msg := &Message{Input: "hello", Metadata: map[string]string{"event": "fire"}}
+	if _, err := notifier.Notify(context.Background(), msg); err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+	if got.Input != "hello" || got.Metadata["event"] != "fire" {
+		t.Errorf("webhook received %v", got)
+	}
+}
+
+func TestWebhookRetriesServerErrors(t *testing.T) {
+	attempts := 0
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts < 2 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		data, _ := ioutil.ReadAll(req.Body)
+		body = string(data)
+	}))
+	defer server.Close()
+
+	cfg := &Config{Webhook: &WebhookConfig{
+		URL:  server.URL,
+		Body: "{{.Metadata.trigger_path}}: {{trim .Input}}",
+	}}
+	notifier, err := cfg.ToNotifier()
+	if err != nil {
+		t.Fatalf("ToNotifier() = %v", err)
+	}
+
+	msg := &Message{Input: " 42\n", Metadata: map[string]string{"trigger_path": "a/b"}}
+	status, err := notifier.Notify(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("Notify() = %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("attempts = %d want 2", attempts)
+	}
+	if body != "a/b: 42" {
+		t.Errorf("body = %q want %q", body, "a/b: 42")
+	}
+	if !strings.Contains(status, "attempt 2") {
+		t.Errorf("status = %q, should mention attempt 2", status)
+	}
+}
+
+func TestWebhookDoesNotRetryClientErrors(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		http.Error(w, "bad request", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	cfg := &Config{Webhook: &WebhookConfig{URL: server.URL}}
+	notifier, err := cfg.ToNotifier()
+	if err != nil {
+		t.Fatalf("ToNotifier() = %v", err)
+	}
+
+	if _, err := notifier.Notify(context.Background(), &Message{}); err == nil {
+		t.Errorf("Notify() = unexpected success")
+	}
+	if attempts != 1 {
+		t.Errorf("attempts = %d want 1", attempts)
+	}
+}
+
+func TestAmbiguousConfig(t *testing.T) {
+	cfg := &Config{
+		Webhook: &WebhookConfig{URL: "http://localhost/"},
+		Chat:    &ChatConfig{URL: "http://localhost/"},
+	}
+	if err := cfg.Check(); err == nil {
+		t.Errorf("Check() of ambiguous config = unexpected success")
+	}
+}
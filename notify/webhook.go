@@ -0,0 +1,80 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"text/template"
+)
+
+// WebhookConfig specifies a notifier that POSTs to a URL. By default the
+// body is a JSON object with the fields "input" and "metadata"; it can be
+// replaced by a template.
+type WebhookConfig struct {
+	URL         string            `yaml:"url"`
+	Headers     map[string]string `yaml:"headers"`
+	ContentType string            `yaml:"content_type"`
+	Body        string            `yaml:"body"`
+	Retries     *int              `yaml:"retries"`
+}
+
+type webhook struct {
+	url         string
+	headers     map[string]string
+	contentType string
+	body        *template.Template
+	retries     int
+}
+
+func (c *WebhookConfig) toNotifier() (*webhook, error) {
+	if c.URL == "" {
+		return nil, errors.New("missing 'url'")
+	}
+
+	rv := &webhook{
+		url:         c.URL,
+		headers:     c.Headers,
+		contentType: c.ContentType,
+		retries:     DefaultRetries,
+	}
+	if rv.contentType == "" {
+		rv.contentType = "application/json"
+	}
+	if c.Retries != nil {
+		if *c.Retries < 0 {
+			return nil, errors.New("'retries' cannot be negative")
+		}
+		rv.retries = *c.Retries
+	}
+	if c.Body != "" {
+		tmpl, err := parseTemplate("body", c.Body)
+		if err != nil {
+			return nil, err
+		}
+		rv.body = tmpl
+	}
+	return rv, nil
+}
+
+func (w *webhook) Notify(ctx context.Context, msg *Message) (string, error) {
+	var body []byte
+
+	if w.body != nil {
+		text, err := render(w.body, msg)
+		if err != nil {
+			return "", err
+		}
+		body = []byte(text)
+	} else {
+		data, err := json.Marshal(struct {
+			Input    string            `json:"input"`
+			Metadata map[string]string `json:"metadata"`
+		}{msg.Input, msg.Metadata})
+		if err != nil {
+			return "", err
+		}
+		body = data
+	}
+
+	return post(ctx, w.url, w.url, w.contentType, w.headers, body, w.retries)
+}
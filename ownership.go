@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/storage"
+)
+
+// instanceStatus identifies this daemon in the status API.
+type instanceStatus struct {
+	Hostname string   `json:"hostname"`
+	Pid      int      `json:"pid"`
+	Tags     []string `json:"tags"`
+}
+
+// leaseHolder is the instance holding a lease on a node.
+type leaseHolder struct {
+	Lease string    `json:"lease"`
+	Host  string    `json:"host"`
+	Pid   int       `json:"pid"`
+	Until time.Time `json:"until"`
+}
+
+// nodeOwnership says whether this daemon may run a node (its run_on
+// constraints match the tags of the daemon), and which instances hold
+// leases on the node, i.e. are running it now. Whether this daemon is one
+// of them is given by Owned. Analyses are not leased: their work is shared
+// between the daemons that may run them.
+type nodeOwnership struct {
+	Path     string        `json:"path"`
+	RunOn    []string      `json:"run_on,omitempty"`
+	Eligible bool          `json:"eligible"`
+	Holders  []leaseHolder `json:"holders,omitempty"`
+	Owned    bool          `json:"owned"`
+}
+
+// ownership records which nodes this daemon may run, and finds which
+// instances are running them in the leases, for the status API.
+type ownership struct {
+	mu       sync.Mutex
+	instance *instanceStatus
+	leases   storage.Leases
+	nodes    []nodeOwnership
+}
+
+func (o *ownership) setInstance(instance *instanceStatus) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.instance = instance
+}
+
+func (o *ownership) setLeases(leases storage.Leases) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.leases = leases
+}
+
+// add records the node, and returns whether this daemon is to run it.
+func (o *ownership) add(path string, runOn config.RunOn, tags config.Tags) bool {
+	eligible := runOn.Matches(tags)
+	if !eligible {
+		log.Printf("not running %q here: run_on %v does not match tags", path, []string(runOn))
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.nodes = append(o.nodes, nodeOwnership{Path: path, RunOn: runOn, Eligible: eligible})
+	return eligible
+}
+
+// leasedNode returns the path of the node a lease is on, if any: leases on
+// nodes are keyed by a prefix such as "execute:", and those of periodic
+// triggers also by the execution they trigger on.
+func leasedNode(key string) string {
+	i := strings.Index(key, ":")
+	if i < 0 {
+		return ""
+	}
+	prefix, path := key[:i], key[i+1:]
+	if prefix == "trigger" {
+		if j := strings.LastIndex(path, ":"); j >= 0 {
+			path = path[:j]
+		}
+	}
+	return path
+}
+
+func (o *ownership) get() (*instanceStatus, []nodeOwnership) {
+	o.mu.Lock()
+	instance, leases := o.instance, o.leases
+	nodes := append([]nodeOwnership(nil), o.nodes...)
+	o.mu.Unlock()
+
+	if leases == nil {
+		return instance, nodes
+	}
+	infos, err := leases.ListLeases()
+	if err != nil {
+		log.Printf("unable to list leases for the status: %v", err)
+		return instance, nodes
+	}
+
+	holders := map[string][]leaseHolder{}
+	for _, info := range infos {
+		if path := leasedNode(info.Key); path != "" {
+			holders[path] = append(holders[path], leaseHolder{info.Key, info.HolderHost, info.HolderPid, info.Until})
+		}
+	}
+	for i := range nodes {
+		nodes[i].Holders = holders[nodes[i].Path]
+		for _, holder := range nodes[i].Holders {
+			if instance != nil && holder.Host == instance.Hostname && holder.Pid == instance.Pid {
+				nodes[i].Owned = true
+			}
+		}
+	}
+	return instance, nodes
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/storage"
+)
+
+func TestLeasedNode(t *testing.T) {
+	for key, want := range map[string]string{
+		"execute:w":        "w",
+		"schedule:w":       "w",
+		"alert:w/a/t":      "w/a/t",
+		"digest:w/a/t":     "w/a/t",
+		"trigger:w/a/t:42": "w/a/t",
+		"pruner":           "",
+	} {
+		if got := leasedNode(key); got != want {
+			t.Errorf("leasedNode(%q) = %q want %q", key, got, want)
+		}
+	}
+}
+
+func TestOwnership(t *testing.T) {
+	info, err := hostinfo.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := config.Tags{"host=" + info.Hostname: true, "region=eu": true}
+
+	o := &ownership{}
+	o.setInstance(&instanceStatus{Hostname: info.Hostname, Pid: info.Pid, Tags: tags.Sorted()})
+
+	if !o.add("w", nil, tags) {
+		t.Errorf("add(w) without run_on = false want true")
+	}
+	if o.add("w/a", config.RunOn{"has-gpu-tools"}, tags) {
+		t.Errorf("add(w/a) with run_on [has-gpu-tools] = true want false")
+	}
+	if !o.add("w/a/t", config.RunOn{"region=eu"}, tags) {
+		t.Errorf("add(w/a/t) with run_on [region=eu] = false want true")
+	}
+
+	// Without leases, nothing is owned.
+	instance, nodes := o.get()
+	if instance == nil || instance.Hostname != info.Hostname {
+		t.Errorf("get() instance = %+v want %s", instance, info.Hostname)
+	}
+	want := []nodeOwnership{
+		{Path: "w", Eligible: true},
+		{Path: "w/a", RunOn: []string{"has-gpu-tools"}},
+		{Path: "w/a/t", RunOn: []string{"region=eu"}, Eligible: true},
+	}
+	if len(nodes) != len(want) {
+		t.Fatalf("get() nodes = %+v want %+v", nodes, want)
+	}
+	for i := range want {
+		if nodes[i].Path != want[i].Path || nodes[i].Eligible != want[i].Eligible || len(nodes[i].RunOn) != len(want[i].RunOn) || nodes[i].Owned {
+			t.Errorf("get() nodes[%d] = %+v want %+v", i, nodes[i], want[i])
+		}
+	}
+
+	// The watch is owned by this instance while it holds its lease.
+	db := storage.NewMemory()
+	o.setLeases(db)
+	lease, err := db.TryObtainLease("execute:w", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, nodes = o.get()
+	if !nodes[0].Owned || len(nodes[0].Holders) != 1 || nodes[0].Holders[0].Lease != "execute:w" {
+		t.Errorf("get() nodes[0] = %+v want owned through execute:w", nodes[0])
+	}
+	if nodes[2].Owned || len(nodes[2].Holders) != 0 {
+		t.Errorf("get() nodes[2] = %+v want not owned", nodes[2])
+	}
+
+	if err := lease.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, nodes = o.get(); nodes[0].Owned {
+		t.Errorf("get() nodes[0] = %+v want not owned after the lease is released", nodes[0])
+	}
+}
@@ -0,0 +1,154 @@
+package prune
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/storage"
+)
+
+// compactor compacts the executions of a watch that are older than after,
+// keeping the first of each run of executions in the same group.
+type compactor struct {
+	after     time.Duration
+	sameGroup func(a, b *storage.CompactionRow) bool
+
+	// cursor is the start time of the first execution of the latest
+	// group; everything before it has been compacted already.
+	cursor time.Time
+}
+
+func newCompactor(spec *config.CompactionSpec) (*compactor, error) {
+	after, err := spec.GetAfter()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &compactor{
+		after:  after,
+		cursor: time.Unix(0, 0),
+	}
+
+	switch spec.Keep {
+	case config.CompactKeepChanges:
+		c.sameGroup = func(a, b *storage.CompactionRow) bool {
+			return a.Success == b.Success && a.Stdout == b.Stdout
+		}
+	case config.CompactKeepHourly:
+		c.sameGroup = func(a, b *storage.CompactionRow) bool {
+			return a.Start.UTC().Truncate(time.Hour).Equal(b.Start.UTC().Truncate(time.Hour))
+		}
+	case config.CompactKeepDaily:
+		c.sameGroup = func(a, b *storage.CompactionRow) bool {
+			ay, am, ad := a.Start.UTC().Date()
+			by, bm, bd := b.Start.UTC().Date()
+			return ay == by && am == bm && ad == bd
+		}
+	default:
+		return nil, fmt.Errorf("invalid keep %q", spec.Keep)
+	}
+
+	return c, nil
+}
+
+// group is a run of executions in the same group, of which the first is
+// kept.
+type group struct {
+	keep   *storage.CompactionRow
+	runs   int
+	until  time.Time
+	remove []int64
+}
+
+func newGroup(row *storage.CompactionRow) *group {
+	return &group{keep: row, runs: row.Runs, until: row.Until}
+}
+
+func (g *group) add(row *storage.CompactionRow) {
+	g.runs += row.Runs
+	if row.Until.After(g.until) {
+		g.until = row.Until
+	}
+	g.remove = append(g.remove, row.Id)
+}
+
+// compact compacts the executions of the watch older than the cutoff, and
+// returns the number of executions removed.
+func (c *compactor) compact(db storage.Store, path string, now time.Time, batchSize int, dryRun bool) (int64, error) {
+	before := now.Add(-c.after)
+
+	var removed int64
+	flush := func(g *group) error {
+		if len(g.remove) == 0 {
+			return nil
+		}
+		removed += int64(len(g.remove))
+		if !dryRun {
+			if err := db.CompactExecutions(g.keep.Id, g.runs, g.until, g.remove); err != nil {
+				return err
+			}
+			metricCompactedExecutions.WithLabelValues(path).Add(float64(len(g.remove)))
+		}
+		g.remove = nil
+		return nil
+	}
+
+	var current *group
+	from := c.cursor
+	for {
+		batch, err := db.GetCompactionRows(path, from, before, batchSize)
+		if err != nil {
+			return removed, err
+		}
+
+		for _, row := range batch {
+			if current != nil && c.sameGroup(current.keep, row) {
+				current.add(row)
+				if len(current.remove) >= batchSize {
+					if err := flush(current); err != nil {
+						return removed, err
+					}
+				}
+				continue
+			}
+			if current != nil {
+				if err := flush(current); err != nil {
+					return removed, err
+				}
+			}
+			current = newGroup(row)
+		}
+
+		if len(batch) < batchSize {
+			break
+		}
+		from = batch[len(batch)-1].Start.Add(time.Millisecond)
+		time.Sleep(batchPause)
+	}
+
+	if current != nil {
+		if err := flush(current); err != nil {
+			return removed, err
+		}
+		// The latest group may go on with executions that are not yet old
+		// enough, so the next pass starts from it.
+		if !dryRun {
+			c.cursor = current.keep.Start
+		}
+	}
+
+	if removed > 0 {
+		if dryRun {
+			log.Printf("dry run: would compact away %d execution(s) of %q", removed, path)
+		} else {
+			log.Printf("compacted away %d execution(s) of %q", removed, path)
+		}
+	}
+	if dryRun {
+		metricCompactableExecutions.WithLabelValues(path).Set(float64(removed))
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,284 @@
+package prune
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/storage"
+)
+
+var (
+	Verbose = false
+)
+
+var (
+	metricPrunedRows = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "pruned_rows",
+			Help:      "Number of execution rows pruned (including those below the pruned executions)",
+		},
+		[]string{"node"},
+	)
+
+	metricPrunedBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "pruned_bytes",
+			Help:      "Bytes of execution data pruned",
+		},
+		[]string{"node"},
+	)
+
+	metricPrunableRows = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "watcher",
+			Name:      "prunable_rows",
+			Help:      "Number of execution rows that would be pruned (in dry run mode)",
+		},
+		[]string{"node"},
+	)
+
+	metricPrunableBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "watcher",
+			Name:      "prunable_bytes",
+			Help:      "Bytes of execution data that would be pruned (in dry run mode)",
+		},
+		[]string{"node"},
+	)
+
+	metricCompactedExecutions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "compacted_executions",
+			Help:      "Number of executions of watches removed by compaction",
+		},
+		[]string{"node"},
+	)
+
+	metricDeletedBlobs = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "deleted_output_blobs",
+			Help:      "Number of stored outputs deleted after the last execution using them was pruned",
+		},
+	)
+
+	metricCompactableExecutions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "watcher",
+			Name:      "compactable_executions",
+			Help:      "Number of executions of watches that compaction would remove (in dry run mode)",
+		},
+		[]string{"node"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricPrunedRows)
+	prometheus.MustRegister(metricPrunedBytes)
+	prometheus.MustRegister(metricPrunableRows)
+	prometheus.MustRegister(metricPrunableBytes)
+	prometheus.MustRegister(metricCompactedExecutions)
+	prometheus.MustRegister(metricCompactableExecutions)
+	prometheus.MustRegister(metricDeletedBlobs)
+}
+
+// batchPause is the pause between batches, to leave the database time for
+// other work.
+const batchPause = 100 * time.Millisecond
+
+// toPolicy returns the policy for pruning, or nil if the watch is only to
+// be compacted.
+func toPolicy(spec *config.RetentionSpec) (*storage.RetentionPolicy, error) {
+	if spec.MaxAge == "" && spec.MaxCount == 0 && spec.KeepFailuresFor == "" {
+		return nil, nil
+	}
+	maxAge, err := spec.GetMaxAge()
+	if err != nil {
+		return nil, err
+	}
+	keepFailuresFor, err := spec.GetKeepFailuresFor()
+	if err != nil {
+		return nil, err
+	}
+	return &storage.RetentionPolicy{
+		MaxAge:             maxAge,
+		MaxCount:           spec.MaxCount,
+		KeepLastSuccessful: spec.KeepLastSuccessful,
+		KeepFailuresFor:    keepFailuresFor,
+	}, nil
+}
+
+type watch struct {
+	path      string
+	policy    *storage.RetentionPolicy
+	compactor *compactor
+}
+
+// Pruner periodically deletes the executions of the watches that their
+// retention policies say not to keep, and then compacts them, in batches.
+// Only one instance prunes at a time.
+func Pruner(db storage.Store, spec *config.PruningSpec, retained []config.RetainedWatch) error {
+	period, err := spec.GetPeriod()
+	if err != nil {
+		return err
+	}
+
+	var watches []watch
+	for _, w := range retained {
+		policy, err := toPolicy(w.Retention)
+		if err != nil {
+			return err
+		}
+		var c *compactor
+		if w.Retention.Compact != nil {
+			c, err = newCompactor(w.Retention.Compact)
+			if err != nil {
+				return err
+			}
+		}
+		watches = append(watches, watch{w.Path, policy, c})
+	}
+
+	dryRun := spec != nil && spec.DryRun
+	if dryRun {
+		log.Printf("starting pruner for %d watch(es) in dry run mode: nothing will be deleted", len(watches))
+	} else {
+		log.Printf("starting pruner for %d watch(es)", len(watches))
+	}
+
+	for {
+		err := db.WithLease("pruner", period, func(ctx context.Context) error {
+			// Queries are cancelled if the lease is lost.
+			err := pruneAll(ctx, db.WithContext(ctx), watches, spec.GetBatchSize(), dryRun)
+			if ctx.Err() != nil {
+				log.Printf("pruner lost its lease: stopping until the next period")
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		time.Sleep(period)
+	}
+}
+
+func pruneAll(ctx context.Context, db storage.Store, watches []watch, batchSize int, dryRun bool) error {
+	now := time.Now()
+	for _, w := range watches {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if w.policy != nil {
+			if err := pruneWatch(db, w, now, batchSize, dryRun); err != nil {
+				return err
+			}
+		}
+		if w.compactor != nil {
+			if _, err := w.compactor.compact(db, w.path, now, batchSize, dryRun); err != nil {
+				return err
+			}
+		}
+	}
+	if dryRun {
+		return nil
+	}
+	return deleteUnusedBlobs(db, now, batchSize)
+}
+
+func pruneWatch(db storage.Store, w watch, now time.Time, batchSize int, dryRun bool) error {
+	var executions, rows, bytes int64
+	var first, last time.Time
+
+	cutoffs, err := db.GetRetentionCutoffs(w.path, w.policy, now)
+	if err != nil {
+		return err
+	}
+
+	var after *storage.Cursor
+	for {
+		batch, err := db.GetPrunableExecutions(w.path, cutoffs, after, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		var ids []int64
+		var batchRows, batchBytes int64
+		for _, item := range batch {
+			ids = append(ids, item.Id)
+			batchRows += item.Rows
+			batchBytes += item.Bytes
+			if first.IsZero() || item.Started.Before(first) {
+				first = item.Started
+			}
+			if item.Started.After(last) {
+				last = item.Started
+			}
+		}
+		after = batch[len(batch)-1].Cursor()
+
+		if !dryRun {
+			if err := db.DeleteExecutions(ids); err != nil {
+				return err
+			}
+			metricPrunedRows.WithLabelValues(w.path).Add(float64(batchRows))
+			metricPrunedBytes.WithLabelValues(w.path).Add(float64(batchBytes))
+			if Verbose {
+				log.Printf("pruned batch of %d execution(s) of %q", len(ids), w.path)
+			}
+		}
+
+		executions += int64(len(ids))
+		rows += batchRows
+		bytes += batchBytes
+
+		if len(batch) < batchSize {
+			break
+		}
+		time.Sleep(batchPause)
+	}
+
+	if dryRun {
+		metricPrunableRows.WithLabelValues(w.path).Set(float64(rows))
+		metricPrunableBytes.WithLabelValues(w.path).Set(float64(bytes))
+		if executions > 0 {
+			log.Printf("dry run: would prune %d execution(s) of %q started from %v to %v (%d rows, %d bytes)", executions, w.path, first, last, rows, bytes)
+		}
+	} else if executions > 0 {
+		log.Printf("pruned %d execution(s) of %q started from %v to %v (%d rows, %d bytes)", executions, w.path, first, last, rows, bytes)
+	}
+
+	return nil
+}
+
+// deleteUnusedBlobs deletes the stored outputs that were only used by
+// executions that are now gone.
+func deleteUnusedBlobs(db storage.Store, now time.Time, batchSize int) error {
+	var total int64
+	for {
+		n, err := db.DeleteUnusedBlobs(now.Add(-storage.BlobGracePeriod), batchSize)
+		if err != nil {
+			return err
+		}
+		metricDeletedBlobs.Add(float64(n))
+		total += n
+		if n < int64(batchSize) {
+			break
+		}
+		time.Sleep(batchPause)
+	}
+	if total > 0 {
+		log.Printf("deleted %d unused output blob(s)", total)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package prune
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/runner"
+	"github.com/steinarvk/watcher/storage"
+)
+
+func TestPruneWatch(t *testing.T) {
+	db := storage.NewMemory()
+	info := &hostinfo.HostInfo{Hostname: "testhost", Pid: 1234}
+	t0 := time.Unix(1500000000, 0)
+
+	for i := 0; i < 10; i++ {
+		start := t0.Add(time.Duration(i) * time.Minute)
+		result := &runner.Result{Start: start, Stop: start, Stdout: "output", Success: true}
+		id, err := db.InsertExecution("w", result, info, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.InsertExecution("w/a", result, info, &id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := watch{"w", &storage.RetentionPolicy{MaxCount: 4}, nil}
+
+	if err := pruneWatch(db, w, t0.Add(time.Hour), 4, true); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.QueryExecutionResults("w")
+	if err != nil || len(rows) != 10 {
+		t.Errorf("after dry run: got %d executions (%v) want 10", len(rows), err)
+	}
+
+	if err := pruneWatch(db, w, t0.Add(time.Hour), 4, false); err != nil {
+		t.Fatal(err)
+	}
+	rows, err = db.QueryExecutionResults("w")
+	if err != nil || len(rows) != 4 {
+		t.Fatalf("after pruning: got %d executions (%v) want 4", len(rows), err)
+	}
+	if !rows[0].Result.Start.Equal(t0.Add(6 * time.Minute)) {
+		t.Errorf("after pruning: oldest execution started at %v want %v", rows[0].Result.Start, t0.Add(6*time.Minute))
+	}
+	rows, err = db.QueryExecutionResults("w/a")
+	if err != nil || len(rows) != 4 {
+		t.Errorf("after pruning: got %d analyses (%v) want 4", len(rows), err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	db := storage.NewMemory()
+	info := &hostinfo.HostInfo{Hostname: "testhost", Pid: 1234}
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	outputs := []string{"a", "a", "a", "b", "b", "a", "a", "a", "a", "c"}
+	insert := func(i int) {
+		start := t0.Add(time.Duration(i) * time.Minute)
+		result := &runner.Result{Start: start, Stop: start.Add(time.Second), Stdout: outputs[i], Success: true}
+		if _, err := db.InsertExecution("w", result, info, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		insert(i)
+	}
+
+	c, err := newCompactor(&config.CompactionSpec{After: "1h", Keep: config.CompactKeepChanges})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(now time.Time, wantOutputs string, wantRuns []int) {
+		t.Helper()
+		if _, err := c.compact(db, "w", now, 2, false); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := db.GetCompactionRows("w", t0, now, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotOutputs string
+		var gotRuns []int
+		for _, row := range rows {
+			gotOutputs += row.Stdout
+			gotRuns = append(gotRuns, row.Runs)
+		}
+		if gotOutputs != wantOutputs || fmt.Sprint(gotRuns) != fmt.Sprint(wantRuns) {
+			t.Errorf("after compaction: got %q with runs %v want %q with runs %v", gotOutputs, gotRuns, wantOutputs, wantRuns)
+		}
+	}
+
+	// Only the executions older than an hour are compacted.
+	check(t0.Add(time.Hour+4*time.Minute+30*time.Second), "abaaa", []int{3, 2, 1, 1, 1})
+
+	// The latest group goes on with executions that are compacted later.
+	insert(8)
+	insert(9)
+	check(t0.Add(2*time.Hour), "abac", []int{3, 2, 4, 1})
+
+	rows, err := db.GetCompactionRows("w", t0, t0.Add(time.Hour), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := t0.Add(2*time.Minute + time.Second); !rows[0].Until.Equal(want) {
+		t.Errorf("first execution stands for runs until %v want %v", rows[0].Until, want)
+	}
+}
+
+func TestCompactDaily(t *testing.T) {
+	c, err := newCompactor(&config.CompactionSpec{After: "24h", Keep: config.CompactKeepDaily})
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := &storage.CompactionRow{Start: day.Add(time.Hour)}
+	b := &storage.CompactionRow{Start: day.Add(23 * time.Hour)}
+	next := &storage.CompactionRow{Start: day.Add(25 * time.Hour)}
+	if !c.sameGroup(a, b) || c.sameGroup(b, next) {
+		t.Errorf("daily groups wrong")
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"os"
 	"os/exec"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -23,9 +26,10 @@ func (r Result) Runtime() time.Duration {
 }
 
 type options struct {
-	ctx     context.Context
-	input   string
-	timeout time.Duration
+	ctx      context.Context
+	input    string
+	timeout  time.Duration
+	metadata map[string]string
 }
 
 type Option func(*options) error
@@ -37,6 +41,15 @@ func WithTimeout(dt time.Duration) Option {
 	}
 }
 
+// WithContext runs the command under the context, killing it if the context
+// is cancelled.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) error {
+		o.ctx = ctx
+		return nil
+	}
+}
+
 func WithInput(s string) Option {
 	return func(o *options) error {
 		o.input = s
@@ -44,12 +57,31 @@ func WithInput(s string) Option {
 	}
 }
 
+// WithMetadata gives the command information about why it is being run, as
+// an environment variable named WATCHER_<KEY> (with the key in upper case)
+// for each item.
+func WithMetadata(metadata map[string]string) Option {
+	return func(o *options) error {
+		o.metadata = metadata
+		return nil
+	}
+}
+
 type Spec interface {
 	Program() string
 	Args() []string
 	ShouldRun() bool
 }
 
+func metadataEnv(metadata map[string]string) []string {
+	var rv []string
+	for k, v := range metadata {
+		rv = append(rv, "WATCHER_"+strings.ToUpper(k)+"="+v)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
 func Run(spec Spec, opts ...Option) (*Result, error) {
 	o := options{
 		ctx: context.Background(),
@@ -68,6 +100,9 @@ func Run(spec Spec, opts ...Option) (*Result, error) {
 	}
 
 	cmd := exec.CommandContext(o.ctx, spec.Program(), spec.Args()...)
+	if len(o.metadata) > 0 {
+		cmd.Env = append(os.Environ(), metadataEnv(o.metadata)...)
+	}
 	if o.input != "" {
 		inputBuf := bytes.NewBufferString(o.input)
 		cmd.Stdin = inputBuf
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"time"
+
+	"github.com/robfig/cron/v3"
 )
 
 type RandomConfig struct {
@@ -14,6 +16,7 @@ type RandomConfig struct {
 type Config struct {
 	Period string        `yaml:"period"`
 	Random *RandomConfig `yaml:"random"`
+	Cron   string        `yaml:"cron"`
 }
 
 func countTrue(xs ...bool) int {
@@ -30,6 +33,7 @@ func (c *Config) ToSpec() (Scheduler, error) {
 	n := countTrue(
 		c.Period != "",
 		c.Random != nil,
+		c.Cron != "",
 	)
 	if n == 0 {
 		return nil, errors.New("empty scheduler config")
@@ -64,6 +68,14 @@ func (c *Config) ToSpec() (Scheduler, error) {
 
 		return UniformRandom{minDur, maxDur}, nil
 
+	case c.Cron != "":
+		schedule, err := cron.ParseStandard(c.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'cron' %q: %v", c.Cron, err)
+		}
+
+		return Cron{schedule}, nil
+
 	default:
 		return nil, fmt.Errorf("internal error handling scheduler config: %v", c)
 	}
@@ -3,6 +3,8 @@ package scheduler
 import (
 	"math/rand"
 	"time"
+
+	"github.com/robfig/cron/v3"
 )
 
 type Scheduler interface {
@@ -29,6 +31,16 @@ func (d UniformRandom) ScheduleNext(t0 time.Time) time.Time {
 	return t0.Add(dur)
 }
 
+// Cron schedules according to a standard crontab specification (such as
+// "0 9 * * *"), in local time unless the spec starts with "CRON_TZ=".
+type Cron struct {
+	Schedule cron.Schedule
+}
+
+func (c Cron) ScheduleNext(t0 time.Time) time.Time {
+	return c.Schedule.Next(t0)
+}
+
 func WaitUntil(t time.Time) {
 	for time.Now().Before(t) {
 		time.Sleep(t.Sub(time.Now()))
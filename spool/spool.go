@@ -0,0 +1,351 @@
+// Package spool keeps the executions that could not be stored in the
+// database on local disk, until they can be.
+//
+// The spool is a directory of segment files, to which entries are appended
+// as JSON lines and synced to disk one at a time. Replaying the spool moves
+// appends on to a new segment and inserts the entries of the old ones in
+// order, deleting each segment once all of its entries are stored. An entry
+// that is inserted twice (because replaying was interrupted) is recognized
+// by the database as a duplicate and skipped.
+package spool
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/runner"
+	"github.com/steinarvk/watcher/storage"
+)
+
+var (
+	Verbose = false
+)
+
+var (
+	metricSpoolEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "watcher",
+			Name:      "spool_entries",
+			Help:      "Number of executions in the local spool waiting to be stored in the database",
+		},
+	)
+
+	metricSpooled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "spooled_executions",
+			Help:      "Number of executions spooled locally because they could not be stored",
+		},
+		[]string{"path"},
+	)
+
+	metricReplayed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "replayed_executions",
+			Help:      "Number of spooled executions stored in the database (by status)",
+		},
+		[]string{"path", "status"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricSpoolEntries)
+	prometheus.MustRegister(metricSpooled)
+	prometheus.MustRegister(metricReplayed)
+}
+
+const segmentSuffix = ".jsonl"
+
+// Entry is a spooled execution, with everything needed to insert it as it
+// would have been inserted. Outputs are kept as bytes, since they need not
+// be UTF-8.
+type Entry struct {
+	Path     string    `json:"path"`
+	Start    time.Time `json:"start"`
+	Stop     time.Time `json:"stop"`
+	Stdout   []byte    `json:"stdout"`
+	Stderr   []byte    `json:"stderr"`
+	Success  bool      `json:"success"`
+	Hostname string    `json:"hostname"`
+	Pid      int       `json:"pid"`
+	Parent   *int64    `json:"parent,omitempty"`
+	Spooled  time.Time `json:"spooled"`
+}
+
+func (e *Entry) result() *runner.Result {
+	return &runner.Result{
+		Start:   e.Start,
+		Stop:    e.Stop,
+		Stdout:  string(e.Stdout),
+		Stderr:  string(e.Stderr),
+		Success: e.Success,
+	}
+}
+
+// Spool is a spool directory.
+type Spool struct {
+	dir string
+
+	mu      sync.Mutex
+	current *os.File
+	depth   int
+}
+
+// Open opens the spool directory, creating it if need be.
+func Open(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating spool directory: %v", err)
+	}
+	s := &Spool{dir: dir}
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		entries, err := readSegment(segment)
+		if err != nil {
+			return nil, err
+		}
+		s.depth += len(entries)
+	}
+	metricSpoolEntries.Set(float64(s.depth))
+	if s.depth > 0 {
+		log.Printf("spool %q has %d execution(s) waiting to be stored", dir, s.depth)
+	}
+	return s, nil
+}
+
+// Depth returns the number of entries in the spool.
+func (s *Spool) Depth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.depth
+}
+
+func (s *Spool) segments() ([]string, error) {
+	rv, err := filepath.Glob(filepath.Join(s.dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rv)
+	return rv, nil
+}
+
+// syncDir makes the creation or removal of a segment durable.
+func (s *Spool) syncDir() error {
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Append adds the execution to the spool. It returns once the entry is on
+// disk.
+func (s *Spool) Append(path string, result *runner.Result, info *hostinfo.HostInfo, parent *int64) error {
+	data, err := json.Marshal(&Entry{
+		Path:     path,
+		Start:    result.Start,
+		Stop:     result.Stop,
+		Stdout:   []byte(result.Stdout),
+		Stderr:   []byte(result.Stderr),
+		Success:  result.Success,
+		Hostname: info.Hostname,
+		Pid:      info.Pid,
+		Parent:   parent,
+		Spooled:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == nil {
+		name := filepath.Join(s.dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), segmentSuffix))
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return fmt.Errorf("error creating spool segment: %v", err)
+		}
+		if err := s.syncDir(); err != nil {
+			f.Close()
+			return fmt.Errorf("error syncing spool directory: %v", err)
+		}
+		s.current = f
+	}
+
+	if _, err := s.current.Write(data); err != nil {
+		return fmt.Errorf("error writing to spool: %v", err)
+	}
+	if err := s.current.Sync(); err != nil {
+		return fmt.Errorf("error syncing spool: %v", err)
+	}
+
+	s.depth++
+	metricSpoolEntries.Set(float64(s.depth))
+	metricSpooled.WithLabelValues(path).Inc()
+	return nil
+}
+
+// readSegment reads the entries of a segment. A final line that is cut
+// short (by a crash while it was written) is skipped.
+func readSegment(name string) ([]*Entry, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rv []*Entry
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if strings.TrimSpace(line) != "" {
+				log.Printf("skipping incomplete entry at the end of spool segment %q", name)
+			}
+			break
+		}
+		entry := &Entry{}
+		if err := json.Unmarshal([]byte(line), entry); err != nil {
+			return nil, fmt.Errorf("corrupt spool segment %q: %v", name, err)
+		}
+		rv = append(rv, entry)
+	}
+	return rv, nil
+}
+
+// Replay inserts the spooled executions into the database, in the order
+// they were spooled, sends the path of each one stored on nodesStored (if
+// not nil), and returns how many it stored. It stops at the first
+// error from the database, to be retried later; but an entry the database
+// rejects while it is otherwise reachable (e.g. because its parent has
+// been pruned meanwhile) is dropped, so as not to block the spool forever.
+func (s *Spool) Replay(db storage.Store, nodesStored chan<- string) (int, error) {
+	s.mu.Lock()
+	if s.current != nil {
+		s.current.Close()
+		s.current = nil
+	}
+	segments, err := s.segments()
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	var stored int
+	for _, segment := range segments {
+		entries, err := readSegment(segment)
+		if err != nil {
+			return stored, err
+		}
+
+		for _, entry := range entries {
+			info := &hostinfo.HostInfo{Hostname: entry.Hostname, Pid: entry.Pid}
+			_, err := db.InsertExecution(entry.Path, entry.result(), info, entry.Parent)
+			switch {
+			case err == nil:
+				metricReplayed.WithLabelValues(entry.Path, "ok").Inc()
+				if Verbose {
+					log.Printf("stored spooled execution of %q started at %v", entry.Path, entry.Start)
+				}
+				stored++
+				if nodesStored != nil {
+					nodesStored <- entry.Path
+				}
+			case storage.IsDuplicateExecution(err):
+				metricReplayed.WithLabelValues(entry.Path, "duplicate").Inc()
+			default:
+				if pingErr := db.Ping(time.Minute); pingErr != nil {
+					return stored, err
+				}
+				log.Printf("dropping spooled execution of %q started at %v: %v", entry.Path, entry.Start, err)
+				metricReplayed.WithLabelValues(entry.Path, "dropped").Inc()
+			}
+		}
+
+		if err := os.Remove(segment); err != nil {
+			return stored, err
+		}
+		if err := s.syncDir(); err != nil {
+			return stored, err
+		}
+		s.mu.Lock()
+		s.depth -= len(entries)
+		metricSpoolEntries.Set(float64(s.depth))
+		s.mu.Unlock()
+	}
+
+	return stored, nil
+}
+
+// Replayer replays the spool every period, while it is not empty. The paths
+// of the executions stored are sent on nodesStored.
+func Replayer(s *Spool, db storage.Store, period time.Duration, nodesStored chan<- string) error {
+	for {
+		time.Sleep(period)
+
+		if s.Depth() == 0 {
+			continue
+		}
+		stored, err := s.Replay(db, nodesStored)
+		if stored > 0 {
+			log.Printf("stored %d spooled execution(s); %d left", stored, s.Depth())
+		}
+		if err != nil {
+			log.Printf("unable to replay spool (will retry in %v): %v", period, err)
+		}
+	}
+}
+
+// Store is a storage.Store that spools the executions it cannot insert,
+// instead of failing. An execution that is spooled is reported as stored,
+// with id 0. Executions whose insertion was cancelled through the context
+// of the store (e.g. as its lease was lost) are not spooled.
+//
+// Only executions inserted directly (those of watches and triggers) are
+// spooled. Analyses are not: they are run on work claimed from the
+// database, and if their result cannot be stored, the work is claimed
+// again once its claim runs out.
+type Store struct {
+	storage.Store
+	Spool *Spool
+
+	ctx context.Context
+}
+
+func (s *Store) WithContext(ctx context.Context) storage.Store {
+	return &Store{Store: s.Store.WithContext(ctx), Spool: s.Spool, ctx: ctx}
+}
+
+func (s *Store) InsertExecution(path string, result *runner.Result, info *hostinfo.HostInfo, parent *int64) (int64, error) {
+	id, err := s.Store.InsertExecution(path, result, info, parent)
+	if err == nil || storage.IsDuplicateExecution(err) {
+		return id, err
+	}
+	if s.ctx != nil && s.ctx.Err() != nil {
+		return id, err
+	}
+
+	if spoolErr := s.Spool.Append(path, result, info, parent); spoolErr != nil {
+		return 0, fmt.Errorf("%v (and unable to spool: %v)", err, spoolErr)
+	}
+	log.Printf("spooled execution of %q: unable to store it: %v", path, err)
+	return 0, nil
+}
@@ -0,0 +1,106 @@
+package spool
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/runner"
+	"github.com/steinarvk/watcher/storage"
+)
+
+// unavailable is a store whose database is down.
+type unavailable struct {
+	storage.Store
+}
+
+var errUnavailable = errors.New("database unavailable")
+
+func (u unavailable) InsertExecution(path string, result *runner.Result, info *hostinfo.HostInfo, parent *int64) (int64, error) {
+	return 0, errUnavailable
+}
+
+func (u unavailable) Ping(timeout time.Duration) error {
+	return errUnavailable
+}
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	db := storage.NewMemory()
+	info := &hostinfo.HostInfo{Hostname: "testhost", Pid: 1234}
+	t0 := time.Unix(1500000000, 0)
+
+	parent, err := db.InsertExecution("w", &runner.Result{Start: t0, Stop: t0, Success: true}, info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sp, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &Store{Store: unavailable{db}, Spool: sp}
+
+	binary := "\x00\xff not UTF-8"
+	for i := 1; i <= 3; i++ {
+		start := t0.Add(time.Duration(i) * time.Minute)
+		result := &runner.Result{Start: start, Stop: start.Add(time.Second), Stdout: binary, Success: true}
+		if _, err := store.InsertExecution("w/t", result, info, &parent); err != nil {
+			t.Fatalf("InsertExecution() with the database down = %v want spooled", err)
+		}
+	}
+
+	if stored, err := sp.Replay(unavailable{db}, nil); err == nil || stored != 0 {
+		t.Errorf("Replay() with the database down = %d, %v want an error", stored, err)
+	}
+
+	// The spool survives restarts.
+	sp, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth := sp.Depth(); depth != 3 {
+		t.Errorf("Depth() after reopening = %d want 3", depth)
+	}
+
+	// An execution that was stored before replaying was interrupted is
+	// skipped.
+	start := t0.Add(time.Minute)
+	if _, err := db.InsertExecution("w/t", &runner.Result{Start: start, Stop: start.Add(time.Second), Stdout: binary, Success: true}, info, &parent); err != nil {
+		t.Fatal(err)
+	}
+
+	nodesStored := make(chan string, 10)
+	if stored, err := sp.Replay(db, nodesStored); err != nil || stored != 2 {
+		t.Errorf("Replay() = %d, %v want 2", stored, err)
+	}
+	if depth := sp.Depth(); depth != 0 {
+		t.Errorf("Depth() after replaying = %d want 0", depth)
+	}
+	if len(nodesStored) != 2 {
+		t.Errorf("Replay() sent %d paths want 2", len(nodesStored))
+	}
+
+	rows, err := db.QueryExecutionResults("w/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("got %d executions want 3", len(rows))
+	}
+	for i, row := range rows {
+		want := t0.Add(time.Duration(i+1) * time.Minute)
+		if !row.Result.Start.Equal(want) || row.Result.Stdout != binary || !row.RootTime.Equal(t0) {
+			t.Errorf("execution %d = %+v want started at %v with root time %v", i, row, want, t0)
+		}
+	}
+
+	sp, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth := sp.Depth(); depth != 0 {
+		t.Errorf("Depth() after replaying and reopening = %d want 0", depth)
+	}
+}
@@ -0,0 +1,7 @@
+CREATE TABLE alert_states (
+  trigger_path TEXT PRIMARY KEY,
+  firing_since_utcmillis BIGINT NULL,
+  firing_input TEXT NOT NULL,
+  last_notified_utcmillis BIGINT NULL,
+  resolved_at_utcmillis BIGINT NULL
+);
@@ -0,0 +1,33 @@
+CREATE TABLE alert_silences (
+  silence_id BIGSERIAL PRIMARY KEY,
+  path_pattern TEXT NOT NULL,
+  created_utcmillis BIGINT NOT NULL,
+  expires_utcmillis BIGINT NOT NULL,
+  author TEXT NOT NULL,
+  comment TEXT NOT NULL
+);
+
+CREATE INDEX alert_silences_idx_expires
+  ON alert_silences (expires_utcmillis);
+
+ALTER TABLE alert_states ADD COLUMN
+  acknowledged_utcmillis BIGINT NULL;
+
+ALTER TABLE alert_states ADD COLUMN
+  acknowledged_by TEXT NULL;
+
+CREATE TABLE suppressed_firings (
+  suppression_id BIGSERIAL PRIMARY KEY,
+  trigger_path TEXT NOT NULL,
+  parent_execution_id BIGINT NOT NULL
+    REFERENCES program_executions (execution_id)
+    ON DELETE CASCADE,
+  silence_id BIGINT NULL
+    REFERENCES alert_silences (silence_id)
+    ON DELETE SET NULL,
+  suppressed_utcmillis BIGINT NOT NULL,
+  reason TEXT NOT NULL,
+  input TEXT NOT NULL,
+  CONSTRAINT suppressed_firings_uniq_trigger_and_parent
+    UNIQUE (trigger_path, parent_execution_id)
+);
@@ -0,0 +1,6 @@
+CREATE TABLE trigger_dedup_keys (
+  trigger_path TEXT NOT NULL,
+  dedup_key TEXT NOT NULL,
+  last_fired_utcmillis BIGINT NOT NULL,
+  PRIMARY KEY (trigger_path, dedup_key)
+);
@@ -0,0 +1,17 @@
+CREATE TABLE digest_states (
+  trigger_path TEXT PRIMARY KEY,
+  last_execution_id BIGINT NOT NULL,
+  last_delivered_utcmillis BIGINT NOT NULL
+);
+
+CREATE TABLE digest_items (
+  digest_item_id BIGSERIAL PRIMARY KEY,
+  trigger_path TEXT NOT NULL,
+  execution_id BIGINT NOT NULL
+    REFERENCES program_executions (execution_id)
+    ON DELETE CASCADE,
+  input TEXT NOT NULL,
+  collected_utcmillis BIGINT NOT NULL,
+  CONSTRAINT digest_items_uniq_trigger_and_execution
+    UNIQUE (trigger_path, execution_id)
+);
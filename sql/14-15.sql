@@ -0,0 +1,2 @@
+CREATE INDEX program_executions_idx_root_execution_id
+  ON program_executions (root_execution_id);
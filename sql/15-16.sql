@@ -0,0 +1,5 @@
+ALTER TABLE program_executions ADD COLUMN
+  compacted_runs INT NOT NULL DEFAULT 1;
+
+ALTER TABLE program_executions ADD COLUMN
+  compacted_until_utcmillis BIGINT NULL;
@@ -0,0 +1,14 @@
+CREATE TABLE pending_work (
+  work_id BIGSERIAL PRIMARY KEY,
+  node_path TEXT NOT NULL,
+  execution_id BIGINT NOT NULL
+    REFERENCES program_executions (execution_id)
+    ON DELETE CASCADE,
+  enqueued_utcmillis BIGINT NOT NULL,
+  claimed_until_utcmillis BIGINT NULL,
+  CONSTRAINT pending_work_uniq_node_and_execution
+    UNIQUE (node_path, execution_id)
+);
+
+CREATE INDEX pending_work_idx_execution_id
+  ON pending_work (execution_id);
@@ -0,0 +1,8 @@
+ALTER TABLE work_leases ADD COLUMN
+  holder_host TEXT NULL;
+
+ALTER TABLE work_leases ADD COLUMN
+  holder_pid INTEGER NULL;
+
+ALTER TABLE work_leases ADD COLUMN
+  obtained_utcmillis BIGINT NULL;
@@ -0,0 +1,17 @@
+CREATE TABLE metric_samples (
+  sample_id BIGSERIAL PRIMARY KEY,
+  node_path TEXT NOT NULL,
+  execution_id BIGINT NOT NULL
+    REFERENCES program_executions (execution_id)
+    ON DELETE CASCADE,
+  sample_utcmillis BIGINT NOT NULL,
+  metric_name TEXT NOT NULL,
+  labels TEXT NOT NULL,
+  value DOUBLE PRECISION NOT NULL
+);
+
+CREATE INDEX metric_samples_idx_node_name_and_time
+  ON metric_samples (node_path, metric_name, sample_utcmillis);
+
+CREATE INDEX metric_samples_idx_execution_id
+  ON metric_samples (execution_id);
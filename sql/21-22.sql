@@ -0,0 +1 @@
+ALTER TABLE node_children ADD COLUMN reconciled BOOLEAN NOT NULL DEFAULT FALSE;
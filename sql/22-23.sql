@@ -0,0 +1,10 @@
+ALTER TABLE program_executions ADD COLUMN root_started_utcmillis BIGINT NULL;
+
+UPDATE program_executions
+  SET root_started_utcmillis = COALESCE(
+    (SELECT r.started_utcmillis FROM program_executions AS r
+     WHERE r.execution_id = program_executions.root_execution_id),
+    started_utcmillis);
+
+CREATE INDEX program_executions_idx_node_path_and_root_started
+  ON program_executions (node_path, root_started_utcmillis, execution_id);
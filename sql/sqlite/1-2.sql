@@ -0,0 +1,104 @@
+CREATE TABLE work_leases (
+  lease_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  lease_key TEXT NOT NULL,
+  leased_until_utcmillis BIGINT NOT NULL,
+  CONSTRAINT work_leases_uniq_lease_key
+    UNIQUE (lease_key)
+);
+
+CREATE TABLE program_executions (
+  execution_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  parent_execution_id BIGINT NULL
+    REFERENCES program_executions (execution_id)
+    ON DELETE CASCADE,
+  root_execution_id BIGINT NULL
+    REFERENCES program_executions (execution_id)
+    ON DELETE CASCADE,
+  node_path TEXT NOT NULL,
+  executor_host TEXT NOT NULL,
+  executor_pid INT NOT NULL,
+  started_utcmillis BIGINT NOT NULL,
+  stopped_utcmillis BIGINT NOT NULL,
+  success BOOLEAN NOT NULL,
+  stdout TEXT NOT NULL,
+  stderr TEXT NOT NULL,
+  CONSTRAINT program_executions_uniq_node_and_start
+    UNIQUE (node_path, started_utcmillis)
+);
+
+CREATE INDEX program_executions_idx_node_path
+  ON program_executions (node_path);
+
+CREATE INDEX program_executions_idx_parent_execution_id
+  ON program_executions (parent_execution_id);
+
+CREATE TABLE scheduling_queue (
+  schedule_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  node_path TEXT NOT NULL,
+  target_time_utcmillis BIGINT NOT NULL,
+  CONSTRAINT scheduling_queue_uniq_node_path
+    UNIQUE (node_path)
+);
+
+CREATE TABLE alert_states (
+  trigger_path TEXT PRIMARY KEY,
+  firing_since_utcmillis BIGINT NULL,
+  firing_input TEXT NOT NULL,
+  last_notified_utcmillis BIGINT NULL,
+  resolved_at_utcmillis BIGINT NULL,
+  acknowledged_utcmillis BIGINT NULL,
+  acknowledged_by TEXT NULL
+);
+
+CREATE TABLE alert_silences (
+  silence_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  path_pattern TEXT NOT NULL,
+  created_utcmillis BIGINT NOT NULL,
+  expires_utcmillis BIGINT NOT NULL,
+  author TEXT NOT NULL,
+  comment TEXT NOT NULL
+);
+
+CREATE INDEX alert_silences_idx_expires
+  ON alert_silences (expires_utcmillis);
+
+CREATE TABLE suppressed_firings (
+  suppression_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  trigger_path TEXT NOT NULL,
+  parent_execution_id BIGINT NOT NULL
+    REFERENCES program_executions (execution_id)
+    ON DELETE CASCADE,
+  silence_id BIGINT NULL
+    REFERENCES alert_silences (silence_id)
+    ON DELETE SET NULL,
+  suppressed_utcmillis BIGINT NOT NULL,
+  reason TEXT NOT NULL,
+  input TEXT NOT NULL,
+  CONSTRAINT suppressed_firings_uniq_trigger_and_parent
+    UNIQUE (trigger_path, parent_execution_id)
+);
+
+CREATE TABLE trigger_dedup_keys (
+  trigger_path TEXT NOT NULL,
+  dedup_key TEXT NOT NULL,
+  last_fired_utcmillis BIGINT NOT NULL,
+  PRIMARY KEY (trigger_path, dedup_key)
+);
+
+CREATE TABLE digest_states (
+  trigger_path TEXT PRIMARY KEY,
+  last_execution_id BIGINT NOT NULL,
+  last_delivered_utcmillis BIGINT NOT NULL
+);
+
+CREATE TABLE digest_items (
+  digest_item_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  trigger_path TEXT NOT NULL,
+  execution_id BIGINT NOT NULL
+    REFERENCES program_executions (execution_id)
+    ON DELETE CASCADE,
+  input TEXT NOT NULL,
+  collected_utcmillis BIGINT NOT NULL,
+  CONSTRAINT digest_items_uniq_trigger_and_execution
+    UNIQUE (trigger_path, execution_id)
+);
@@ -0,0 +1,24 @@
+CREATE TABLE output_blobs (
+  blob_hash BLOB PRIMARY KEY,
+  compression TEXT NOT NULL,
+  size_bytes BIGINT NOT NULL,
+  data BLOB NOT NULL,
+  last_used_utcmillis BIGINT NOT NULL
+);
+
+CREATE INDEX output_blobs_idx_last_used
+  ON output_blobs (last_used_utcmillis);
+
+ALTER TABLE program_executions ADD COLUMN
+  stdout_hash BLOB NULL
+    REFERENCES output_blobs (blob_hash);
+
+ALTER TABLE program_executions ADD COLUMN
+  stderr_hash BLOB NULL
+    REFERENCES output_blobs (blob_hash);
+
+CREATE INDEX program_executions_idx_stdout_hash
+  ON program_executions (stdout_hash);
+
+CREATE INDEX program_executions_idx_stderr_hash
+  ON program_executions (stderr_hash);
@@ -0,0 +1,5 @@
+CREATE TABLE node_children (
+  parent_path TEXT NOT NULL,
+  child_path TEXT NOT NULL,
+  PRIMARY KEY (parent_path, child_path)
+);
@@ -0,0 +1,255 @@
+package staleness
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/runner"
+	"github.com/steinarvk/watcher/storage"
+)
+
+var (
+	Verbose = false
+)
+
+var (
+	metricNodeStale = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "watcher",
+			Name:      "node_stale",
+			Help:      "Whether a node is stale (1) or not (0)",
+		},
+		[]string{"node"},
+	)
+
+	metricNodeStalenessSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "watcher",
+			Name:      "node_staleness_seconds",
+			Help:      "Seconds since the latest successful execution of a node",
+		},
+		[]string{"node"},
+	)
+
+	metricStalenessAlerts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "staleness_alerts",
+			Help:      "Number of staleness alert commands run (by status)",
+		},
+		[]string{"node", "status"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricNodeStale)
+	prometheus.MustRegister(metricNodeStalenessSeconds)
+	prometheus.MustRegister(metricStalenessAlerts)
+}
+
+const (
+	StatusStale    = "stale"
+	StatusResolved = "resolved"
+)
+
+// Alert is the JSON description of a stale (or no longer stale) node that
+// is given as input to the staleness command.
+type Alert struct {
+	Status                 string `json:"status"`
+	NodePath               string `json:"node_path"`
+	MaxStaleness           string `json:"max_staleness"`
+	Staleness              string `json:"staleness"`
+	LatestSuccessUTCMillis *int64 `json:"latest_success_utcmillis"`
+}
+
+// Checker periodically checks the time of the latest successful execution
+// of each of the given nodes, and runs the staleness command when a node
+// becomes stale or recovers. Whether a node is stale is stored as the alert
+// state of its key (see stateKey), so that neither other instances nor a
+// restart alert about it again.
+func Checker(db storage.Store, spec *config.StalenessSpec, nodes []config.StaleNode) error {
+	log.Printf("starting staleness checker for %d node(s)", len(nodes))
+
+	checkPeriod, err := spec.GetCheckPeriod()
+	if err != nil {
+		return err
+	}
+
+	runSpec, err := spec.Run.ToSpec()
+	if err != nil {
+		return err
+	}
+
+	if !runSpec.ShouldRun() {
+		return errors.New("do-not-run for staleness command makes no sense")
+	}
+
+	runTimeout, err := spec.Run.GetTimeout()
+	if err != nil {
+		return err
+	}
+
+	c := &checker{
+		db:         db,
+		runSpec:    runSpec,
+		runTimeout: runTimeout,
+		t0:         time.Now(),
+		stale:      map[string]bool{},
+	}
+
+	for {
+		for _, node := range nodes {
+			if err := c.check(node); err != nil {
+				return err
+			}
+		}
+
+		time.Sleep(checkPeriod)
+	}
+}
+
+// stateKey is the key of the alert state and lease of the staleness of a
+// node.
+func stateKey(path string) string {
+	return "staleness:" + path
+}
+
+func isStale(state *storage.AlertState) bool {
+	return state != nil && state.Firing()
+}
+
+type checker struct {
+	db         storage.Store
+	runSpec    runner.Spec
+	runTimeout time.Duration
+
+	// t0 stands in for the latest success of nodes that have none.
+	t0 time.Time
+
+	// stale caches the stored staleness of each node.
+	stale map[string]bool
+}
+
+func (c *checker) check(node config.StaleNode) error {
+	key := stateKey(node.Path)
+
+	wasStale, known := c.stale[node.Path]
+	if !known {
+		state, err := c.db.GetAlertState(key)
+		if err != nil {
+			return err
+		}
+		wasStale = isStale(state)
+		c.stale[node.Path] = wasStale
+		c.setMetric(node.Path, wasStale)
+	}
+
+	latest, err := c.db.GetTimeOfLatestSuccessfulExecution(node.Path)
+	if err != nil {
+		return err
+	}
+
+	since := c.t0
+	if latest != nil {
+		since = *latest
+		metricNodeStalenessSeconds.WithLabelValues(node.Path).Set(time.Since(since).Seconds())
+	}
+	staleness := time.Since(since)
+	nowStale := staleness > node.MaxStaleness
+
+	// Only a success resolves staleness; t0 is reset by restarts.
+	if nowStale == wasStale || (wasStale && latest == nil) {
+		return nil
+	}
+
+	alert := &Alert{
+		Status:       StatusResolved,
+		NodePath:     node.Path,
+		MaxStaleness: node.MaxStaleness.String(),
+		Staleness:    staleness.String(),
+	}
+	if nowStale {
+		alert.Status = StatusStale
+	}
+	if latest != nil {
+		millis := latest.UnixNano() / int64(time.Millisecond)
+		alert.LatestSuccessUTCMillis = &millis
+	}
+
+	// Several instances may be checking the same nodes; the lease stops
+	// them from alerting at the same time, and the stored state stops
+	// them from alerting again afterwards.
+	err = c.db.WithLease(key, c.runTimeout+time.Second, func(ctx context.Context) error {
+		db := c.db.WithContext(ctx)
+		state, err := db.GetAlertState(key)
+		if err != nil {
+			return err
+		}
+		if isStale(state) == nowStale {
+			return nil
+		}
+
+		if err := c.runAlert(ctx, alert); err != nil {
+			// Leave the state unchanged so that we try again next time.
+			log.Printf("error running staleness command for %q: %v", node.Path, err)
+			return nil
+		}
+
+		now := time.Now()
+		newState := &storage.AlertState{
+			TriggerPath:  key,
+			LastNotified: &now,
+		}
+		if nowStale {
+			newState.FiringSince = &now
+		} else {
+			newState.ResolvedAt = &now
+		}
+		return db.SetAlertState(newState)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Whether this instance alerted, another one did, or the command
+	// failed, the stored state is reread on the next check.
+	delete(c.stale, node.Path)
+	return nil
+}
+
+func (c *checker) setMetric(path string, stale bool) {
+	value := 0.0
+	if stale {
+		value = 1.0
+	}
+	metricNodeStale.WithLabelValues(path).Set(value)
+}
+
+func (c *checker) runAlert(ctx context.Context, alert *Alert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("node %q is %s (staleness %s, max %s)", alert.NodePath, alert.Status, alert.Staleness, alert.MaxStaleness)
+
+	metadata := map[string]string{
+		"node_path": alert.NodePath,
+		"event":     alert.Status,
+	}
+	_, err = runner.Run(c.runSpec, runner.WithContext(ctx), runner.WithTimeout(c.runTimeout), runner.WithInput(string(data)), runner.WithMetadata(metadata))
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	metricStalenessAlerts.WithLabelValues(alert.NodePath, status).Inc()
+	if err == nil && Verbose {
+		log.Printf("ran staleness command for %q (%s)", alert.NodePath, alert.Status)
+	}
+	return err
+}
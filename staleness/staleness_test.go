@@ -0,0 +1,97 @@
+package staleness
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/runner"
+	"github.com/steinarvk/watcher/storage"
+)
+
+func TestChecker(t *testing.T) {
+	db := storage.NewMemory()
+	info := &hostinfo.HostInfo{Hostname: "testhost"}
+	insert := func(start time.Time) {
+		t.Helper()
+		if _, err := db.InsertExecution("w", &runner.Result{Start: start, Stop: start, Success: true}, info, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logfile := filepath.Join(t.TempDir(), "alerts")
+	runSpec, err := (&runner.Config{Shell: "cat >> " + logfile + " && echo >> " + logfile}).ToSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newChecker := func() *checker {
+		return &checker{db: db, runSpec: runSpec, runTimeout: 10 * time.Second, t0: time.Now(), stale: map[string]bool{}}
+	}
+	alerts := func() []string {
+		t.Helper()
+		data, err := ioutil.ReadFile(logfile)
+		if err != nil {
+			return nil
+		}
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+	node := config.StaleNode{Path: "w", MaxStaleness: time.Hour}
+
+	insert(time.Now().Add(-2 * time.Hour))
+	c := newChecker()
+	for i := 0; i < 2; i++ {
+		if err := c.check(node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := alerts(); len(got) != 1 || !strings.Contains(got[0], `"status":"stale"`) {
+		t.Fatalf("alerts = %q want one stale alert", got)
+	}
+
+	// Another instance, or a restart, does not alert again.
+	if err := newChecker().check(node); err != nil {
+		t.Fatal(err)
+	}
+	if got := alerts(); len(got) != 1 {
+		t.Fatalf("alerts after restart = %q want one", got)
+	}
+
+	insert(time.Now())
+	if err := c.check(node); err != nil {
+		t.Fatal(err)
+	}
+	if got := alerts(); len(got) != 2 || !strings.Contains(got[1], `"status":"resolved"`) {
+		t.Fatalf("alerts = %q want stale then resolved", got)
+	}
+}
+
+func TestCheckerNeverSucceeded(t *testing.T) {
+	db := storage.NewMemory()
+	runSpec, err := (&runner.Config{Shell: "true"}).ToSpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := config.StaleNode{Path: "w", MaxStaleness: time.Hour}
+
+	c := &checker{db: db, runSpec: runSpec, runTimeout: 10 * time.Second, t0: time.Now().Add(-2 * time.Hour), stale: map[string]bool{}}
+	if err := c.check(node); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := db.GetAlertState(stateKey("w")); err != nil || !isStale(state) {
+		t.Fatalf("state = %+v, %v want stale", state, err)
+	}
+
+	// After a restart the node has not been stale for long, but without a
+	// success it stays stale.
+	c = &checker{db: db, runSpec: runSpec, runTimeout: 10 * time.Second, t0: time.Now(), stale: map[string]bool{}}
+	if err := c.check(node); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := db.GetAlertState(stateKey("w")); err != nil || !isStale(state) {
+		t.Fatalf("state after restart = %+v, %v want stale", state, err)
+	}
+}
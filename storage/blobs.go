@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Outputs are stored in output_blobs, keyed by their SHA-256 hash, so that
+// identical outputs are stored once. Older rows may still have their
+// outputs in the stdout and stderr columns of program_executions; those are
+// moved into blobs by MigrateOutputs.
+
+// Compression algorithms for output blobs. Outputs that do not shrink are
+// stored uncompressed.
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+
+	DefaultCompression = CompressionZstd
+)
+
+// BlobGracePeriod is how long an unused blob is kept after it was last
+// used, so that it is not deleted while an execution using it is inserted.
+const BlobGracePeriod = time.Hour
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func compress(algorithm string, data []byte) (string, []byte, error) {
+	var compressed []byte
+	switch algorithm {
+	case CompressionNone:
+		return CompressionNone, data, nil
+
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return "", nil, err
+		}
+		if err := w.Close(); err != nil {
+			return "", nil, err
+		}
+		compressed = buf.Bytes()
+
+	case CompressionZstd:
+		compressed = zstdEncoder.EncodeAll(data, nil)
+
+	default:
+		return "", nil, fmt.Errorf("unknown compression %q", algorithm)
+	}
+
+	if len(compressed) >= len(data) {
+		return CompressionNone, data, nil
+	}
+	return algorithm, compressed, nil
+}
+
+func decompress(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionNone:
+		return data, nil
+
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+
+	case CompressionZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+
+	default:
+		return nil, fmt.Errorf("unknown compression %q", algorithm)
+	}
+}
+
+// CheckCompression returns an error if the compression algorithm is unknown.
+func CheckCompression(algorithm string) error {
+	switch algorithm {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q (want %q, %q or %q)", algorithm, CompressionNone, CompressionGzip, CompressionZstd)
+}
+
+func blobHash(content string) []byte {
+	hash := sha256.Sum256([]byte(content))
+	return hash[:]
+}
+
+func (d *DB) compression() string {
+	if d.Compression == "" {
+		return DefaultCompression
+	}
+	return d.Compression
+}
+
+// storeBlob stores the content as a blob, unless it is already stored, and
+// returns its hash.
+func (d *DB) storeBlob(tx *sql.Tx, content string, t time.Time) ([]byte, error) {
+	hash := blobHash(content)
+
+	// Marking the blob as used also keeps it from being deleted until the
+	// transaction is done.
+	result, err := tx.Exec(d.dialect.rebind(`
+		UPDATE output_blobs SET last_used_utcmillis = $2 WHERE blob_hash = $1
+	`), hash, toUTCMillis(t))
+	if err != nil {
+		return nil, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return hash, nil
+	}
+
+	algorithm, data, err := compress(d.compression(), []byte(content))
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(d.dialect.rebind(`
+		INSERT INTO output_blobs
+			(blob_hash, compression, size_bytes, data, last_used_utcmillis)
+			VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (blob_hash) DO UPDATE SET
+			last_used_utcmillis = EXCLUDED.last_used_utcmillis
+	`), hash, algorithm, len(content), data, toUTCMillis(t))
+	if err != nil {
+		return nil, err
+	}
+	metricBlobBytes.WithLabelValues(algorithm).Add(float64(len(data)))
+	return hash, nil
+}
+
+// output is an output of an execution as read from the database, either
+// from the old column or from its blob (if compression is set).
+type output struct {
+	text        string
+	compression sql.NullString
+	data        []byte
+}
+
+func (o *output) value() (string, error) {
+	if !o.compression.Valid {
+		return o.text, nil
+	}
+	data, err := decompress(o.compression.String, o.data)
+	if err != nil {
+		return "", fmt.Errorf("error decompressing output: %v", err)
+	}
+	return string(data), nil
+}
+
+// outputJoins joins program_executions AS n with the blobs of its stdout
+// (as so) and stderr (as se).
+const outputJoins = `
+	LEFT OUTER JOIN output_blobs AS so ON so.blob_hash = n.stdout_hash
+	LEFT OUTER JOIN output_blobs AS se ON se.blob_hash = n.stderr_hash
+`
+
+// MigrateOutputs moves the outputs of up to limit executions with an id
+// greater than afterId from the old columns into blobs. It returns the
+// last id migrated, or 0 if there was nothing left to migrate.
+func (d *DB) MigrateOutputs(afterId int64, limit int) (int64, error) {
+	track := d.beginTracking("migrate-outputs")
+
+	tx, err := d.DB.BeginTx(track.ctx, nil)
+	if err != nil {
+		return 0, track.Finish(err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(d.dialect.rebind(`
+		SELECT execution_id, stdout, stderr
+		FROM program_executions
+		WHERE stdout_hash IS NULL
+		  AND execution_id > $1
+		ORDER BY execution_id
+		LIMIT $2
+	`), afterId, limit)
+	if err != nil {
+		return 0, track.Finish(err)
+	}
+
+	type legacyRow struct {
+		id             int64
+		stdout, stderr string
+	}
+	var legacy []legacyRow
+	for rows.Next() {
+		var row legacyRow
+		if err := rows.Scan(&row.id, &row.stdout, &row.stderr); err != nil {
+			rows.Close()
+			return 0, track.Finish(err)
+		}
+		legacy = append(legacy, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, track.Finish(err)
+	}
+
+	now := time.Now()
+	var lastId int64
+	for _, row := range legacy {
+		stdoutHash, err := d.storeBlob(tx, row.stdout, now)
+		if err != nil {
+			return 0, track.Finish(err)
+		}
+		stderrHash, err := d.storeBlob(tx, row.stderr, now)
+		if err != nil {
+			return 0, track.Finish(err)
+		}
+		_, err = tx.Exec(d.dialect.rebind(`
+			UPDATE program_executions
+			SET stdout_hash = $2, stderr_hash = $3, stdout = '', stderr = ''
+			WHERE execution_id = $1
+		`), row.id, stdoutHash, stderrHash)
+		if err != nil {
+			return 0, track.Finish(err)
+		}
+		lastId = row.id
+	}
+
+	return lastId, track.Finish(tx.Commit())
+}
+
+// DeleteUnusedBlobs deletes up to limit blobs that no execution uses and
+// that were last used before t, and returns how many it deleted.
+func (d *DB) DeleteUnusedBlobs(t time.Time, limit int) (int64, error) {
+	result, err := d.wrappedExec("delete-unused-blobs", `
+		DELETE FROM output_blobs
+		WHERE blob_hash IN (
+			SELECT b.blob_hash FROM output_blobs AS b
+			WHERE b.last_used_utcmillis < $1
+			  AND NOT EXISTS (SELECT 1 FROM program_executions WHERE stdout_hash = b.blob_hash)
+			  AND NOT EXISTS (SELECT 1 FROM program_executions WHERE stderr_hash = b.blob_hash)
+			LIMIT $2)
+		  AND last_used_utcmillis < $1
+	`, toUTCMillis(t), limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
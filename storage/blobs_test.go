@@ -0,0 +1,143 @@
+package storage_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/runner"
+	"github.com/steinarvk/watcher/storage"
+)
+
+var testInfo = &hostinfo.HostInfo{Hostname: "testhost", Pid: 1234}
+
+func openMigratedSQLite(t *testing.T) *storage.DB {
+	db := openSQLite(t)
+	if _, _, err := db.Migrate(loadMigrations(t, "../sql/sqlite")); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func countBlobs(t *testing.T, db *storage.DB) int {
+	var n int
+	if err := db.DB.QueryRow(`SELECT COUNT(*) FROM output_blobs`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestCompression(t *testing.T) {
+	output := strings.Repeat("Filesystem 1K-blocks Used Available Use% Mounted on\n", 100)
+	for _, compression := range []string{storage.CompressionNone, storage.CompressionGzip, storage.CompressionZstd} {
+		db := openMigratedSQLite(t)
+		db.Compression = compression
+
+		start := time.Unix(1500000000, 0)
+		result := &runner.Result{Start: start, Stop: start, Stdout: output, Stderr: "short", Success: true}
+		if _, err := db.InsertExecution("w", result, testInfo, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := db.QueryExecutionResults("w")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 1 || rows[0].Result.Stdout != output || rows[0].Result.Stderr != "short" {
+			t.Errorf("%s: QueryExecutionResults() = %v want the inserted outputs", compression, rows)
+		}
+
+		var stored int
+		if err := db.DB.QueryRow(`SELECT LENGTH(data) FROM output_blobs WHERE size_bytes = ?`, len(output)).Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if compressed := stored < len(output); compressed != (compression != storage.CompressionNone) {
+			t.Errorf("%s: stored %d bytes of %d", compression, stored, len(output))
+		}
+	}
+}
+
+func TestMigrateOutputs(t *testing.T) {
+	db := openMigratedSQLite(t)
+
+	if _, err := db.DB.Exec(`
+		INSERT INTO program_executions
+			(node_path, executor_host, executor_pid, started_utcmillis, stopped_utcmillis, success, stdout, stderr)
+			VALUES ('w', 'testhost', 1234, 0, 1000, 1, 'legacy output', 'legacy error')
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(childPath string) {
+		t.Helper()
+		rows, err := db.QueryExecutionResults("w")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 1 || rows[0].Result.Stdout != "legacy output" || rows[0].Result.Stderr != "legacy error" {
+			t.Errorf("QueryExecutionResults() = %+v want legacy outputs", rows[0].Result)
+		}
+		if _, err := db.EnqueueChildlessExecutions("w", childPath); err != nil {
+			t.Fatal(err)
+		}
+		var input string
+		_, err = db.ProcessWork(childPath, time.Minute, testInfo, func(item *storage.WorkItem) (*runner.Result, []*storage.Sample) {
+			input = item.Stdout
+			return &runner.Result{Start: time.Unix(1, 0), Stdout: item.Stdout, Stderr: "legacy error", Success: true}, nil
+		})
+		if err != nil || input != "legacy output" {
+			t.Errorf("ProcessWork() got input %q, %v want legacy output", input, err)
+		}
+	}
+
+	check("w/a")
+
+	lastId, err := db.MigrateOutputs(0, 10)
+	if err != nil || lastId == 0 {
+		t.Fatalf("MigrateOutputs() = %d, %v want an id", lastId, err)
+	}
+	if lastId, err := db.MigrateOutputs(lastId, 10); err != nil || lastId != 0 {
+		t.Errorf("MigrateOutputs() again = %d, %v want 0", lastId, err)
+	}
+
+	check("w/b")
+	if n := countBlobs(t, db); n != 2 {
+		t.Errorf("got %d blobs want 2", n)
+	}
+}
+
+func TestDeleteUnusedBlobs(t *testing.T) {
+	db := openMigratedSQLite(t)
+
+	start := time.Unix(1500000000, 0)
+	var ids []int64
+	for i, stdout := range []string{"same", "same", "different"} {
+		result := &runner.Result{Start: start.Add(time.Duration(i) * time.Minute), Stdout: stdout, Success: true}
+		id, err := db.InsertExecution("w", result, testInfo, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// "same", "different" and the empty stderr.
+	if n := countBlobs(t, db); n != 3 {
+		t.Errorf("got %d blobs want 3", n)
+	}
+
+	if err := db.DeleteExecutions([]int64{ids[0], ids[2]}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.DeleteUnusedBlobs(time.Now().Add(-time.Hour), 100); err != nil || n != 0 {
+		t.Errorf("DeleteUnusedBlobs() within grace period = %d, %v want 0", n, err)
+	}
+	if n, err := db.DeleteUnusedBlobs(time.Now().Add(time.Hour), 100); err != nil || n != 1 {
+		t.Errorf("DeleteUnusedBlobs() = %d, %v want 1", n, err)
+	}
+
+	rows, err := db.QueryExecutionResults("w")
+	if err != nil || len(rows) != 1 || rows[0].Result.Stdout != "same" {
+		t.Errorf("QueryExecutionResults() = %v, %v want the remaining execution", rows, err)
+	}
+}
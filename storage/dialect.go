@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// dialect is the SQL database behind a DB. Queries are written for Postgres
+// and adapted where the databases differ.
+type dialect int
+
+const (
+	dialectPostgres dialect = iota
+	dialectSQLite
+)
+
+func (d dialect) String() string {
+	switch d {
+	case dialectPostgres:
+		return "postgres"
+	case dialectSQLite:
+		return "sqlite"
+	default:
+		return "unknown"
+	}
+}
+
+var postgresPlaceholder = regexp.MustCompile(`\$([0-9]+)`)
+
+// rebind rewrites the $N placeholders of a query into ?N for SQLite, which
+// binds them by number in the same way.
+func (d dialect) rebind(query string) string {
+	if d != dialectSQLite {
+		return query
+	}
+	return postgresPlaceholder.ReplaceAllString(query, "?$1")
+}
+
+func isUniqueViolation(err error) bool {
+	switch castErr := err.(type) {
+	case *pq.Error:
+		return castErr.Code.Name() == "unique_violation"
+	case *sqlite.Error:
+		code := castErr.Code()
+		return code == sqlite3.SQLITE_CONSTRAINT_UNIQUE || code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+	return false
+}
+
+// IsDuplicateExecution returns whether the error is from inserting an
+// execution of a node that already has an execution with the same start
+// time, which is how an execution that was already inserted is recognized.
+func IsDuplicateExecution(err error) bool {
+	return err == errMemoryUniqueViolation || isUniqueViolation(err)
+}
+
+// errorStatus names the kind of a database error, for metrics.
+func errorStatus(err error) string {
+	switch castErr := err.(type) {
+	case *pq.Error:
+		return castErr.Code.Name()
+	case *sqlite.Error:
+		return fmt.Sprintf("sqlite_%d", castErr.Code())
+	}
+	return "error"
+}
@@ -0,0 +1,55 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/watcher/storage"
+)
+
+// renewalLeases hands out leases whose renewals return the given result.
+type renewalLeases struct {
+	storage.Leases
+	ok  bool
+	err error
+}
+
+func (l *renewalLeases) TryObtainLease(key string, deadline time.Time) (storage.Lease, error) {
+	return l, nil
+}
+
+func (l *renewalLeases) Renew(deadline time.Time) (bool, error) { return l.ok, l.err }
+func (l *renewalLeases) Release() error                         { return nil }
+
+func TestWithLease(t *testing.T) {
+	run := func(leases *renewalLeases) error {
+		t.Helper()
+		var ctxErr error
+		err := storage.WithLease(context.Background(), leases, "k", 30*time.Millisecond, func(ctx context.Context) error {
+			select {
+			case <-ctx.Done():
+			case <-time.After(200 * time.Millisecond):
+			}
+			ctxErr = ctx.Err()
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ctxErr
+	}
+
+	if err := run(&renewalLeases{ok: true}); err != nil {
+		t.Errorf("context of a renewed lease = %v want not done", err)
+	}
+	// The database being unavailable does not mean that anyone else has
+	// the lease.
+	if err := run(&renewalLeases{err: errors.New("connection refused")}); err != nil {
+		t.Errorf("context of a lease that cannot be renewed = %v want not done", err)
+	}
+	if err := run(&renewalLeases{ok: false}); err == nil {
+		t.Errorf("context of a lost lease is not done")
+	}
+}
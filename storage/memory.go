@@ -0,0 +1,962 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/runner"
+)
+
+// Memory is an in-memory implementation of Store, for tests and for
+// running without a database. Nothing is persisted, and it cannot be used
+// to coordinate several processes.
+type Memory struct {
+	mu     sync.Mutex
+	nextId int64
+
+	executions []*memoryExecution
+	children   map[string][]string
+	reconciled map[[2]string]bool
+	work       []*memoryWork
+	leases     map[string]*memoryLease
+	queue      map[string]time.Time
+
+	alertStates       map[string]AlertState
+	silences          []Silence
+	suppressedFirings map[memoryKey]bool
+	dedupFirings      map[memoryKey]time.Time
+	digestStates      map[string]DigestState
+	digestItems       []memoryDigestItem
+}
+
+type memoryExecution struct {
+	id     int64
+	path   string
+	parent *int64
+	root   *memoryExecution
+	result runner.Result
+
+	// runs and until are as in CompactionRow.
+	runs  int
+	until time.Time
+
+	samples []*Sample
+}
+
+func (e *memoryExecution) rootTime() time.Time {
+	if e.root != nil {
+		return e.root.result.Start
+	}
+	return e.result.Start
+}
+
+func (e *memoryExecution) row() *NodeRow {
+	return &NodeRow{
+		Id:       e.id,
+		RootTime: e.rootTime(),
+		Result:   e.result,
+	}
+}
+
+type memoryWork struct {
+	WorkItem
+	path         string
+	claimedUntil time.Time
+}
+
+type memoryDigestItem struct {
+	triggerPath string
+	item        DigestItem
+}
+
+type memoryKey struct {
+	path string
+	key  interface{}
+}
+
+type memoryLease struct {
+	m        *Memory
+	key      string
+	id       int64
+	deadline time.Time
+	obtained time.Time
+	holder   *hostinfo.HostInfo
+}
+
+var errMemoryUniqueViolation = errors.New("unique constraint violated")
+
+func NewMemory() *Memory {
+	return &Memory{
+		leases:            map[string]*memoryLease{},
+		queue:             map[string]time.Time{},
+		alertStates:       map[string]AlertState{},
+		suppressedFirings: map[memoryKey]bool{},
+		dedupFirings:      map[memoryKey]time.Time{},
+		digestStates:      map[string]DigestState{},
+	}
+}
+
+// truncateMillis rounds a time down to the precision of the database.
+func truncateMillis(t time.Time) time.Time {
+	return fromUTCMillis(toUTCMillis(t))
+}
+
+func optionalTruncateMillis(t *time.Time) *time.Time {
+	return optionalFromUTCMillis(optionalToUTCMillis(t))
+}
+
+func (m *Memory) newId() int64 {
+	m.nextId++
+	return m.nextId
+}
+
+func (m *Memory) Ping(timeout time.Duration) error {
+	return nil
+}
+
+// WithContext returns the Memory itself, whose operations never block.
+func (m *Memory) WithContext(ctx context.Context) Store {
+	return m
+}
+
+func (m *Memory) find(id int64) *memoryExecution {
+	for _, e := range m.executions {
+		if e.id == id {
+			return e
+		}
+	}
+	return nil
+}
+
+func (m *Memory) hasChild(parent int64, childPath string) bool {
+	for _, e := range m.executions {
+		if e.path == childPath && e.parent != nil && *e.parent == parent {
+			return true
+		}
+	}
+	return false
+}
+
+// byRootTime returns the executions of the node, latest root time first.
+func (m *Memory) byRootTime(path string) []*memoryExecution {
+	var rv []*memoryExecution
+	for _, e := range m.executions {
+		if e.path == path {
+			rv = append(rv, e)
+		}
+	}
+	sort.SliceStable(rv, func(i, j int) bool {
+		ti, tj := rv[i].rootTime(), rv[j].rootTime()
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return rv[i].id > rv[j].id
+	})
+	return rv
+}
+
+func (m *Memory) InsertExecution(path string, result *runner.Result, info *hostinfo.HostInfo, parent *int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.insertExecution(path, result, parent)
+}
+
+func (m *Memory) insertExecution(path string, result *runner.Result, parent *int64) (int64, error) {
+	e := &memoryExecution{
+		path:   path,
+		result: *result,
+	}
+	e.result.Start = truncateMillis(result.Start)
+	e.result.Stop = truncateMillis(result.Stop)
+	e.runs = 1
+	e.until = e.result.Stop
+
+	for _, other := range m.executions {
+		if other.path == path && other.result.Start.Equal(e.result.Start) {
+			return 0, errMemoryUniqueViolation
+		}
+	}
+
+	if parent != nil {
+		parentExecution := m.find(*parent)
+		if parentExecution == nil {
+			return 0, errors.New("parent execution does not exist")
+		}
+		e.parent = &parentExecution.id
+		e.root = parentExecution.root
+		if e.root == nil {
+			e.root = parentExecution
+		}
+	}
+
+	e.id = m.newId()
+	m.executions = append(m.executions, e)
+
+	if result.Success {
+		for _, child := range m.children[path] {
+			m.enqueueWork(child, e)
+		}
+	}
+	return e.id, nil
+}
+
+func (m *Memory) SetChildren(children map[string][]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	isChild := map[string]bool{}
+	for _, paths := range children {
+		for _, child := range paths {
+			isChild[child] = true
+		}
+	}
+	var kept []*memoryWork
+	for _, w := range m.work {
+		if isChild[w.path] {
+			kept = append(kept, w)
+		}
+	}
+	m.work = kept
+
+	reconciled := map[[2]string]bool{}
+	for parent, paths := range children {
+		for _, child := range paths {
+			pair := [2]string{parent, child}
+			reconciled[pair] = m.reconciled[pair]
+		}
+	}
+	m.children = children
+	m.reconciled = reconciled
+	return nil
+}
+
+func (m *Memory) GetUnreconciledChildren() (map[string][]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rv := map[string][]string{}
+	for parent, paths := range m.children {
+		for _, child := range paths {
+			if !m.reconciled[[2]string{parent, child}] {
+				rv[parent] = append(rv[parent], child)
+			}
+		}
+	}
+	return rv, nil
+}
+
+func (m *Memory) SetChildReconciled(parentPath, childPath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pair := [2]string{parentPath, childPath}
+	if _, ok := m.reconciled[pair]; ok {
+		m.reconciled[pair] = true
+	}
+	return nil
+}
+
+func (m *Memory) enqueueWork(path string, e *memoryExecution) bool {
+	for _, w := range m.work {
+		if w.path == path && w.ExecutionId == e.id {
+			return false
+		}
+	}
+	m.work = append(m.work, &memoryWork{
+		WorkItem: WorkItem{Id: m.newId(), ExecutionId: e.id, Stdout: e.result.Stdout},
+		path:     path,
+	})
+	return true
+}
+
+func (m *Memory) EnqueueChildlessExecutions(parentPath, childPath string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for _, e := range m.executions {
+		if e.path != parentPath || !e.result.Success || m.hasChild(e.id, childPath) {
+			continue
+		}
+		if m.enqueueWork(childPath, e) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ProcessWork claims items for the timeout, as the SQL implementation
+// does, so that the lock is not held while the item is processed.
+func (m *Memory) ProcessWork(path string, timeout time.Duration, info *hostinfo.HostInfo, process ProcessFunc) (bool, error) {
+	m.mu.Lock()
+	now := time.Now()
+	var claimed *memoryWork
+	for _, w := range m.work {
+		if w.path == path && !w.claimedUntil.After(now) {
+			claimed = w
+			break
+		}
+	}
+	if claimed == nil {
+		m.mu.Unlock()
+		return false, nil
+	}
+	claimed.claimedUntil = now.Add(timeout)
+	item := claimed.WorkItem
+	m.mu.Unlock()
+
+	result, samples := process(&item)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	finished := true
+	for _, w := range m.work {
+		if w.Id == item.Id {
+			finished = false
+		}
+	}
+	if finished {
+		// The item was deleted with its execution, or its claim ran out
+		// and it was processed again.
+		return true, nil
+	}
+
+	id, err := m.insertExecution(path, result, &item.ExecutionId)
+	if err != nil {
+		return false, err
+	}
+	m.find(id).samples = samples
+
+	var kept []*memoryWork
+	for _, w := range m.work {
+		if w.Id != item.Id {
+			kept = append(kept, w)
+		}
+	}
+	m.work = kept
+	return true, nil
+}
+
+func (m *Memory) GetPendingWork(path string, limit int) ([]*WorkItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rv []*WorkItem
+	for _, w := range m.work {
+		if len(rv) == limit {
+			break
+		}
+		if w.path == path {
+			item := w.WorkItem
+			rv = append(rv, &item)
+		}
+	}
+	return rv, nil
+}
+
+func (m *Memory) DeleteWork(ids []int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deleted := map[int64]bool{}
+	for _, id := range ids {
+		deleted[id] = true
+	}
+
+	var kept []*memoryWork
+	for _, w := range m.work {
+		if !deleted[w.Id] {
+			kept = append(kept, w)
+		}
+	}
+	m.work = kept
+	return nil
+}
+
+func (m *Memory) QuerySeries(query *SeriesQuery) ([]*SeriesPoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var samples []memorySample
+	for _, e := range m.executions {
+		if e.path != query.Path {
+			continue
+		}
+		t := truncateMillis(e.rootTime())
+		if (!query.From.IsZero() && t.Before(query.From)) || (!query.Before.IsZero() && !t.Before(query.Before)) {
+			continue
+		}
+		for _, sample := range e.samples {
+			if sample.Name == query.Name {
+				samples = append(samples, memorySample{t, sample})
+			}
+		}
+	}
+	return rollUp(samples, query), nil
+}
+
+func (m *Memory) GetLatestExecutionIfChildless(path, childPath string) (*NodeRow, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	executions := m.byRootTime(path)
+	if len(executions) == 0 || m.hasChild(executions[0].id, childPath) {
+		return nil, nil
+	}
+	return executions[0].row(), nil
+}
+
+func (m *Memory) GetLatestExecution(path string) (*NodeRow, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	executions := m.byRootTime(path)
+	if len(executions) == 0 {
+		return nil, nil
+	}
+	return executions[0].row(), nil
+}
+
+func (m *Memory) GetTimeOfLatestSuccessfulExecution(path string) (*time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rv *time.Time
+	for _, e := range m.executions {
+		if e.path == path && e.result.Success && (rv == nil || e.result.Start.After(*rv)) {
+			t := e.result.Start
+			rv = &t
+		}
+	}
+	return rv, nil
+}
+
+// before returns whether a comes before b in the order of executions.
+func (c *Cursor) before(b *Cursor) bool {
+	if !c.RootTime.Equal(b.RootTime) {
+		return c.RootTime.Before(b.RootTime)
+	}
+	return c.Id < b.Id
+}
+
+func (m *Memory) QueryExecutions(query *ExecutionQuery) ([]*NodeRow, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// byRootTime has the latest first.
+	executions := m.byRootTime(query.Path)
+	if !query.Descending {
+		for i, j := 0, len(executions)-1; i < j; i, j = i+1, j-1 {
+			executions[i], executions[j] = executions[j], executions[i]
+		}
+	}
+
+	from, before := truncateMillis(query.From), truncateMillis(query.Before)
+	var rv []*NodeRow
+	for _, e := range executions {
+		if query.Limit > 0 && len(rv) == query.Limit {
+			break
+		}
+		row := e.row()
+		if !query.From.IsZero() && row.RootTime.Before(from) {
+			continue
+		}
+		if !query.Before.IsZero() && !row.RootTime.Before(before) {
+			continue
+		}
+		if query.SuccessfulOnly && !row.Result.Success {
+			continue
+		}
+		if query.After != nil {
+			after := &Cursor{truncateMillis(query.After.RootTime), query.After.Id}
+			if query.Descending && !row.Cursor().before(after) || !query.Descending && !after.before(row.Cursor()) {
+				continue
+			}
+		}
+		rv = append(rv, row)
+	}
+	return rv, nil
+}
+
+func (m *Memory) ScanExecutions(query *ExecutionQuery, callback func(row *NodeRow) error) error {
+	rows, err := m.QueryExecutions(query)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := callback(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Memory) QueryExecutionResults(path string) ([]*NodeRow, error) {
+	return m.QueryExecutions(&ExecutionQuery{Path: path})
+}
+
+// nthLatestStart returns the start time of the nth latest execution of the
+// watch (or successful execution, if successful), or nil if there are not
+// that many.
+func (m *Memory) nthLatestStart(path string, n int, successful bool) *int64 {
+	var starts []int64
+	for _, e := range m.executions {
+		if e.path == path && e.parent == nil && (e.result.Success || !successful) {
+			starts = append(starts, toUTCMillis(e.result.Start))
+		}
+	}
+	if n <= 0 || len(starts) < n {
+		return nil
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] > starts[j] })
+	return &starts[n-1]
+}
+
+func (m *Memory) GetRetentionCutoffs(path string, policy *RetentionPolicy, now time.Time) (*RetentionCutoffs, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	nthLatest := m.nthLatestStart(path, policy.MaxCount, false)
+	nthLatestSuccessful := m.nthLatestStart(path, policy.KeepLastSuccessful, true)
+	return policy.newCutoffs(now, nthLatest, nthLatestSuccessful), nil
+}
+
+func (m *Memory) GetPrunableExecutions(path string, cutoffs *RetentionCutoffs, after *Cursor, limit int) ([]*PrunableExecution, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rv []*PrunableExecution
+	for _, e := range m.executions {
+		if e.path != path || e.parent != nil || !cutoffs.prunable(toUTCMillis(e.result.Start), e.result.Success) {
+			continue
+		}
+		item := &PrunableExecution{
+			Id:      e.id,
+			Started: truncateMillis(e.result.Start),
+			Success: e.result.Success,
+		}
+		if after != nil && !(&Cursor{truncateMillis(after.RootTime), after.Id}).before(item.Cursor()) {
+			continue
+		}
+		for _, d := range m.executions {
+			if d == e || d.root == e {
+				item.Rows++
+				item.Bytes += int64(len(d.result.Stdout) + len(d.result.Stderr))
+			}
+		}
+		rv = append(rv, item)
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Cursor().before(rv[j].Cursor()) })
+	if len(rv) > limit {
+		rv = rv[:limit]
+	}
+	return rv, nil
+}
+
+func (m *Memory) DeleteExecutions(ids []int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteExecutions(ids)
+	return nil
+}
+
+// deleteExecutions deletes the executions, every execution below them and
+// everything referring to them.
+func (m *Memory) deleteExecutions(ids []int64) {
+	deleted := map[int64]bool{}
+	for _, id := range ids {
+		deleted[id] = true
+	}
+
+	// Parents always precede their children.
+	var kept []*memoryExecution
+	for _, e := range m.executions {
+		if deleted[e.id] || (e.parent != nil && deleted[*e.parent]) {
+			deleted[e.id] = true
+			continue
+		}
+		kept = append(kept, e)
+	}
+	m.executions = kept
+
+	var keptWork []*memoryWork
+	for _, w := range m.work {
+		if !deleted[w.ExecutionId] {
+			keptWork = append(keptWork, w)
+		}
+	}
+	m.work = keptWork
+
+	for key := range m.suppressedFirings {
+		if deleted[key.key.(int64)] {
+			delete(m.suppressedFirings, key)
+		}
+	}
+
+	var keptItems []memoryDigestItem
+	for _, stored := range m.digestItems {
+		if !deleted[stored.item.ExecutionId] {
+			keptItems = append(keptItems, stored)
+		}
+	}
+	m.digestItems = keptItems
+}
+
+func (m *Memory) GetCompactionRows(path string, from, before time.Time, limit int) ([]*CompactionRow, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rv []*CompactionRow
+	for _, e := range m.executions {
+		if e.path != path || e.parent != nil || e.result.Start.Before(from) || !e.result.Start.Before(before) {
+			continue
+		}
+		rv = append(rv, &CompactionRow{
+			Id:      e.id,
+			Start:   e.result.Start,
+			Until:   e.until,
+			Runs:    e.runs,
+			Success: e.result.Success,
+			Stdout:  e.result.Stdout,
+		})
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Start.Before(rv[j].Start)
+	})
+	if len(rv) > limit {
+		rv = rv[:limit]
+	}
+	return rv, nil
+}
+
+func (m *Memory) CompactExecutions(keep int64, runs int, until time.Time, remove []int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.find(keep)
+	if e == nil {
+		return errors.New("execution does not exist")
+	}
+	e.runs = runs
+	e.until = truncateMillis(until)
+	m.deleteExecutions(remove)
+	return nil
+}
+
+// DeleteUnusedBlobs does nothing, since Memory keeps outputs with their
+// executions.
+func (m *Memory) DeleteUnusedBlobs(t time.Time, limit int) (int64, error) {
+	return 0, nil
+}
+
+func (m *Memory) TryObtainLease(key string, deadline time.Time) (Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.leases[key]; ok {
+		return nil, nil
+	}
+	lease := &memoryLease{m, key, m.newId(), truncateMillis(deadline), truncateMillis(time.Now()), leaseHolder()}
+	m.leases[key] = lease
+	return lease, nil
+}
+
+func (l *memoryLease) Renew(deadline time.Time) (bool, error) {
+	l.m.mu.Lock()
+	defer l.m.mu.Unlock()
+
+	current, ok := l.m.leases[l.key]
+	if !ok || current.id != l.id {
+		return false, nil
+	}
+	current.deadline = truncateMillis(deadline)
+	return true, nil
+}
+
+func (l *memoryLease) Release() error {
+	l.m.mu.Lock()
+	defer l.m.mu.Unlock()
+
+	if current, ok := l.m.leases[l.key]; ok && current.id == l.id {
+		delete(l.m.leases, l.key)
+	}
+	return nil
+}
+
+func (m *Memory) CleanLeases(t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, lease := range m.leases {
+		if lease.deadline.Before(truncateMillis(t)) {
+			delete(m.leases, key)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ListLeases() ([]*LeaseInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rv []*LeaseInfo
+	for _, lease := range m.leases {
+		obtained := lease.obtained
+		rv = append(rv, &LeaseInfo{
+			Id:         lease.id,
+			Key:        lease.key,
+			Until:      lease.deadline,
+			Obtained:   &obtained,
+			HolderHost: lease.holder.Hostname,
+			HolderPid:  lease.holder.Pid,
+		})
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Key < rv[j].Key
+	})
+	return rv, nil
+}
+
+func (m *Memory) BreakLease(key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.leases[key]
+	delete(m.leases, key)
+	return ok, nil
+}
+
+func (m *Memory) WithLease(key string, dur time.Duration, callback func(ctx context.Context) error) error {
+	return WithLease(context.Background(), m, key, dur, callback)
+}
+
+func (m *Memory) ScheduleEvent(path string, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.queue[path]; !ok {
+		m.queue[path] = truncateMillis(t)
+	}
+	return nil
+}
+
+func (m *Memory) Unschedule(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.queue, path)
+	return nil
+}
+
+func (m *Memory) NextScheduledSpecificEvent(path string) (time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.queue[path]
+	return t, ok, nil
+}
+
+func (m *Memory) GetAlertState(triggerPath string) (*AlertState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.alertStates[triggerPath]
+	if !ok {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func sameOptionalTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+func (m *Memory) SetAlertState(state *AlertState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	newState := AlertState{
+		TriggerPath:  state.TriggerPath,
+		FiringSince:  optionalTruncateMillis(state.FiringSince),
+		FiringInput:  state.FiringInput,
+		LastNotified: optionalTruncateMillis(state.LastNotified),
+		ResolvedAt:   optionalTruncateMillis(state.ResolvedAt),
+	}
+	if old, ok := m.alertStates[state.TriggerPath]; ok && sameOptionalTime(old.FiringSince, newState.FiringSince) {
+		newState.Acknowledged = old.Acknowledged
+		newState.AcknowledgedBy = old.AcknowledgedBy
+	}
+	m.alertStates[state.TriggerPath] = newState
+	return nil
+}
+
+func (m *Memory) AcknowledgeAlert(triggerPath, author string, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.alertStates[triggerPath]
+	if !ok || !state.Firing() {
+		return ErrNotFiring
+	}
+	acknowledged := truncateMillis(t)
+	state.Acknowledged = &acknowledged
+	state.AcknowledgedBy = author
+	m.alertStates[triggerPath] = state
+	return nil
+}
+
+func (m *Memory) CreateSilence(silence *Silence) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored := *silence
+	stored.Id = m.newId()
+	stored.Created = truncateMillis(silence.Created)
+	stored.Expires = truncateMillis(silence.Expires)
+	m.silences = append(m.silences, stored)
+	return stored.Id, nil
+}
+
+func (m *Memory) ExpireSilence(silenceId int64, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t = truncateMillis(t)
+	for i := range m.silences {
+		if m.silences[i].Id == silenceId && m.silences[i].Expires.After(t) {
+			m.silences[i].Expires = t
+		}
+	}
+	return nil
+}
+
+func (m *Memory) GetActiveSilences(t time.Time) ([]*Silence, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t = truncateMillis(t)
+	var rv []*Silence
+	for _, silence := range m.silences {
+		if silence.Expires.After(t) {
+			silence := silence
+			rv = append(rv, &silence)
+		}
+	}
+	return rv, nil
+}
+
+func (m *Memory) RecordSuppressedFiring(triggerPath string, parent int64, silenceId *int64, reason, input string, t time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.find(parent) == nil {
+		return false, errors.New("parent execution does not exist")
+	}
+	key := memoryKey{triggerPath, parent}
+	if m.suppressedFirings[key] {
+		return false, nil
+	}
+	m.suppressedFirings[key] = true
+	return true, nil
+}
+
+func (m *Memory) GetTimeOfLatestDedupFiring(triggerPath, key string) (*time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.dedupFirings[memoryKey{triggerPath, key}]
+	if !ok {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+func (m *Memory) RecordDedupFiring(triggerPath, key string, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dedupFirings[memoryKey{triggerPath, key}] = truncateMillis(t)
+	return nil
+}
+
+func (m *Memory) GetDigestState(triggerPath string) (*DigestState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.digestStates[triggerPath]
+	if !ok {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func (m *Memory) SetDigestState(state *DigestState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored := *state
+	stored.LastDelivered = truncateMillis(state.LastDelivered)
+	m.digestStates[state.TriggerPath] = stored
+	return nil
+}
+
+func (m *Memory) AddDigestItem(triggerPath string, executionId int64, input string, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := m.find(executionId)
+	if e == nil {
+		return errors.New("execution does not exist")
+	}
+	for _, stored := range m.digestItems {
+		if stored.triggerPath == triggerPath && stored.item.ExecutionId == executionId {
+			return nil
+		}
+	}
+
+	m.digestItems = append(m.digestItems, memoryDigestItem{triggerPath, DigestItem{
+		Id:          m.newId(),
+		ExecutionId: executionId,
+		RootTime:    e.rootTime(),
+		Input:       input,
+		Collected:   truncateMillis(t),
+	}})
+	return nil
+}
+
+func (m *Memory) GetDigestItems(triggerPath string) ([]*DigestItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rv []*DigestItem
+	for _, stored := range m.digestItems {
+		if stored.triggerPath == triggerPath {
+			item := stored.item
+			rv = append(rv, &item)
+		}
+	}
+	return rv, nil
+}
+
+func (m *Memory) DeleteDigestItems(triggerPath string, upToId int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []memoryDigestItem
+	for _, stored := range m.digestItems {
+		if stored.triggerPath != triggerPath || stored.item.Id > upToId {
+			kept = append(kept, stored)
+		}
+	}
+	m.digestItems = kept
+	return nil
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+)
+
+// Migration is a schema migration from one version to the next, read from
+// a pg-migrator-style file named N-(N+1).sql.
+type Migration struct {
+	From, To int
+	Filename string
+	SQL      string
+}
+
+// Migrations is a contiguous sequence of migrations, in order.
+type Migrations []*Migration
+
+// Latest returns the schema version after every migration.
+func (m Migrations) Latest() int {
+	return m[len(m)-1].To
+}
+
+// LoadMigrations reads the migrations in the top directory of fsys.
+func LoadMigrations(fsys fs.FS) (Migrations, error) {
+	filenames, err := fs.Glob(fsys, "*-*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var rv Migrations
+	for _, filename := range filenames {
+		m := &Migration{Filename: filename}
+		if _, err := fmt.Sscanf(filename, "%d-%d.sql", &m.From, &m.To); err != nil {
+			return nil, fmt.Errorf("bad migration filename %q: %v", filename, err)
+		}
+		if m.To != m.From+1 {
+			return nil, fmt.Errorf("bad migration %q: must migrate from N to N+1", filename)
+		}
+		data, err := fs.ReadFile(fsys, filename)
+		if err != nil {
+			return nil, err
+		}
+		m.SQL = string(data)
+		rv = append(rv, m)
+	}
+
+	if len(rv) == 0 {
+		return nil, errors.New("no migrations found")
+	}
+
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].From < rv[j].From
+	})
+	for i := 1; i < len(rv); i++ {
+		if rv[i].From != rv[i-1].To {
+			return nil, fmt.Errorf("migrations not contiguous: %q follows %q", rv[i].Filename, rv[i-1].Filename)
+		}
+	}
+
+	return rv, nil
+}
+
+// ErrNoSchemaVersion means that the database has tables, but no recorded
+// schema version, e.g. because it was set up with pg-migrator.
+var ErrNoSchemaVersion = errors.New("database has no recorded schema version (if it was set up with pg-migrator, record its version with 'migrate --baseline N')")
+
+func (d *DB) tableExists(table string) (bool, error) {
+	query := `
+		SELECT COUNT(*) FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_name = $1
+	`
+	if d.dialect == dialectSQLite {
+		query = `
+			SELECT COUNT(*) FROM sqlite_master
+			WHERE type = 'table' AND name = $1
+		`
+	}
+
+	var n int
+	track := d.beginTracking("table-exists")
+	err := d.queryRow(track.ctx, query, table).Scan(&n)
+	return n > 0, track.Finish(err)
+}
+
+// SchemaVersion returns the recorded schema version of the database. An
+// empty database has version 0.
+func (d *DB) SchemaVersion() (int, error) {
+	exists, err := d.tableExists("schema_version")
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		populated, err := d.tableExists("program_executions")
+		if err != nil {
+			return 0, err
+		}
+		if populated {
+			return 0, ErrNoSchemaVersion
+		}
+		return 0, nil
+	}
+
+	var version int
+	track := d.beginTracking("get-schema-version")
+	err = d.queryRow(track.ctx, `SELECT version FROM schema_version`).Scan(&version)
+	return version, track.Finish(err)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// setSchemaVersion records the schema version, which must currently be
+// oldVersion.
+func (d *DB) setSchemaVersion(e execer, oldVersion, newVersion int) error {
+	if oldVersion == 0 {
+		if _, err := e.Exec(`CREATE TABLE schema_version (version INT NOT NULL)`); err != nil {
+			return err
+		}
+		_, err := e.Exec(d.dialect.rebind(`INSERT INTO schema_version (version) VALUES ($1)`), newVersion)
+		return err
+	}
+
+	result, err := e.Exec(d.dialect.rebind(`UPDATE schema_version SET version = $2 WHERE version = $1`), oldVersion, newVersion)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return fmt.Errorf("schema version is no longer %d", oldVersion)
+	}
+	return nil
+}
+
+// Baseline records the schema version of a database that was migrated
+// without recording it.
+func (d *DB) Baseline(version int) error {
+	exists, err := d.tableExists("schema_version")
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.New("database already has a recorded schema version")
+	}
+
+	log.Printf("recording schema version %d", version)
+	track := d.beginTracking("baseline-schema-version")
+	return track.Finish(d.setSchemaVersion(d.DB, 0, version))
+}
+
+// Migrate applies the migrations the database has not had yet, each in a
+// transaction of its own along with recording the new version. It returns
+// the versions before and after.
+func (d *DB) Migrate(migrations Migrations) (int, int, error) {
+	initial, err := d.SchemaVersion()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	version := initial
+	if version > migrations.Latest() {
+		return initial, version, fmt.Errorf("schema version %d is newer than the latest known version %d", version, migrations.Latest())
+	}
+
+	for _, m := range migrations {
+		if m.To <= version {
+			continue
+		}
+		// An empty database may start with the first migration, whatever
+		// its number; otherwise we must be at the version it starts from.
+		if version != 0 && m.From != version {
+			return initial, version, fmt.Errorf("no migration from version %d", version)
+		}
+
+		log.Printf("applying migration %q", m.Filename)
+		if err := d.applyMigration(m, version); err != nil {
+			return initial, version, fmt.Errorf("error applying migration %q: %v", m.Filename, err)
+		}
+		version = m.To
+	}
+
+	return initial, version, nil
+}
+
+func (d *DB) applyMigration(m *Migration, oldVersion int) error {
+	track := d.beginTrackingFor("apply-migration", 0)
+
+	tx, err := d.DB.BeginTx(track.ctx, nil)
+	if err != nil {
+		return track.Finish(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return track.Finish(err)
+	}
+
+	if err := d.setSchemaVersion(tx, oldVersion, m.To); err != nil {
+		return track.Finish(err)
+	}
+
+	return track.Finish(tx.Commit())
+}
+
+// CheckSchemaVersion checks that the database schema is up to date. A
+// schema older than the latest migration is an error; a newer one (e.g.
+// while rolling out a new version of watcher) is only logged.
+func (d *DB) CheckSchemaVersion(migrations Migrations) error {
+	version, err := d.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	latest := migrations.Latest()
+	switch {
+	case version < latest:
+		return fmt.Errorf("database schema version %d is older than the expected version %d; run 'watcher migrate'", version, latest)
+	case version > latest:
+		log.Printf("warning: database schema version %d is newer than the expected version %d", version, latest)
+	}
+	return nil
+}
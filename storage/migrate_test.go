@@ -0,0 +1,121 @@
+package storage_test
+
+import (
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/steinarvk/watcher/storage"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := storage.LoadMigrations(fstest.MapFS{
+		"2-3.sql":   {Data: []byte("SELECT 2")},
+		"1-2.sql":   {Data: []byte("SELECT 1")},
+		"10-11.sql": {Data: []byte("SELECT 10")},
+		"README":    {Data: []byte("not a migration")},
+	})
+	if err == nil {
+		t.Errorf("LoadMigrations() with a gap = %v want error", migrations)
+	}
+
+	migrations, err = storage.LoadMigrations(fstest.MapFS{
+		"2-3.sql": {Data: []byte("SELECT 2")},
+		"1-2.sql": {Data: []byte("SELECT 1")},
+		"3-4.sql": {Data: []byte("SELECT 3")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 3 || migrations[0].Filename != "1-2.sql" || migrations[2].SQL != "SELECT 3" || migrations.Latest() != 4 {
+		t.Errorf("LoadMigrations() = %v", migrations)
+	}
+
+	if _, err := storage.LoadMigrations(fstest.MapFS{"1-3.sql": {}}); err == nil {
+		t.Errorf("LoadMigrations() with 1-3.sql succeeded")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	migrations := loadMigrations(t, "../sql/sqlite")
+	db := openSQLite(t)
+
+	if err := db.CheckSchemaVersion(migrations); err == nil {
+		t.Errorf("CheckSchemaVersion() on empty database succeeded")
+	}
+
+	from, to, err := db.Migrate(migrations)
+	if err != nil || from != 0 || to != migrations.Latest() {
+		t.Fatalf("Migrate() = %d, %d, %v want 0, %d", from, to, err, migrations.Latest())
+	}
+
+	from, to, err = db.Migrate(migrations)
+	if err != nil || from != to {
+		t.Errorf("Migrate() again = %d, %d, %v want no change", from, to, err)
+	}
+
+	if err := db.CheckSchemaVersion(migrations); err != nil {
+		t.Errorf("CheckSchemaVersion() after Migrate() = %v", err)
+	}
+
+	if err := db.Baseline(1); err == nil {
+		t.Errorf("Baseline() with recorded version succeeded")
+	}
+}
+
+func TestMigrateUnversioned(t *testing.T) {
+	db := openSQLite(t)
+	if _, err := db.DB.Exec(`CREATE TABLE program_executions (execution_id INTEGER PRIMARY KEY)`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.SchemaVersion(); err != storage.ErrNoSchemaVersion {
+		t.Errorf("SchemaVersion() without version table = %v want ErrNoSchemaVersion", err)
+	}
+
+	if err := db.Baseline(100); err != nil {
+		t.Fatal(err)
+	}
+	if version, err := db.SchemaVersion(); err != nil || version != 100 {
+		t.Errorf("SchemaVersion() after Baseline(100) = %d, %v", version, err)
+	}
+
+	// A newer schema is accepted, but not migrated.
+	migrations := loadMigrations(t, "../sql/sqlite")
+	if err := db.CheckSchemaVersion(migrations); err != nil {
+		t.Errorf("CheckSchemaVersion() with newer schema = %v", err)
+	}
+	if _, _, err := db.Migrate(migrations); err == nil {
+		t.Errorf("Migrate() with newer schema succeeded")
+	}
+}
+
+func TestMigrateRootTimes(t *testing.T) {
+	migrations := loadMigrations(t, "../sql/sqlite")
+	db := openSQLite(t)
+	if _, _, err := db.Migrate(migrations[:len(migrations)-1]); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.DB.Exec(`
+		INSERT INTO program_executions
+			(execution_id, node_path, executor_host, executor_pid, started_utcmillis, stopped_utcmillis, success, stdout, stderr, parent_execution_id, root_execution_id)
+			VALUES (1, 'w', 'testhost', 1234, 60000, 61000, 1, '', '', NULL, NULL),
+			       (2, 'w/a', 'testhost', 1234, 120000, 121000, 1, '', '', 1, 1)
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := db.Migrate(migrations); err != nil {
+		t.Fatal(err)
+	}
+
+	// The child is found by the start time of its root.
+	rows, err := db.QueryExecutions(&storage.ExecutionQuery{Path: "w/a", From: time.Unix(60, 0), Before: time.Unix(61, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Id != 2 || !rows[0].RootTime.Equal(time.Unix(60, 0)) {
+		t.Errorf("QueryExecutions(w/a) after migration = %+v want 2 at root time 60s", rows)
+	}
+}
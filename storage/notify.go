@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ExecutionsChannel is the Postgres channel on which every stored execution
+// is notified, with the path of its node as the payload.
+const ExecutionsChannel = "watcher_executions"
+
+// AnyExecution is sent by ListenForExecutions in place of a node path when
+// executions of any node may have been missed, so that every node is to be
+// checked for new executions. No node has an empty path.
+const AnyExecution = ""
+
+// listenerPingPeriod is how often an idle listener checks its connection.
+const listenerPingPeriod = 90 * time.Second
+
+// EnableListening makes ListenForExecutions possible, using the connection
+// string to open the listening connection.
+func (d *DB) EnableListening(dsn string) {
+	d.listenDSN = dsn
+}
+
+// CanListen returns whether ListenForExecutions is possible.
+func (d *DB) CanListen() bool {
+	return d.dialect == dialectPostgres && d.listenDSN != ""
+}
+
+// notifyExecution notifies listeners of the execution when the transaction
+// commits.
+func (d *DB) notifyExecution(tx *sql.Tx, path string) error {
+	if d.dialect != dialectPostgres {
+		return nil
+	}
+	_, err := tx.Exec(`SELECT pg_notify($1, $2)`, ExecutionsChannel, path)
+	return err
+}
+
+// ListenForExecutions sends the node path of every execution stored by any
+// process, including this one, on stored. It runs until the listening
+// connection fails for good. Notifications sent while the connection is
+// being reestablished are lost, so once it is, AnyExecution is sent.
+func (d *DB) ListenForExecutions(stored chan<- string) error {
+	if !d.CanListen() {
+		return errors.New("listening for executions is not enabled")
+	}
+
+	listener := pq.NewListener(d.listenDSN, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			log.Printf("execution listener disconnected: %v", err)
+		case pq.ListenerEventReconnected:
+			log.Printf("execution listener reconnected")
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.Printf("execution listener failed to reconnect: %v", err)
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen(ExecutionsChannel); err != nil {
+		return err
+	}
+	log.Printf("listening for executions on %q", ExecutionsChannel)
+
+	for {
+		select {
+		case notification, ok := <-listener.Notify:
+			if !ok {
+				return errors.New("execution listener closed")
+			}
+			// A nil notification means the connection was reestablished.
+			if notification == nil {
+				stored <- AnyExecution
+				continue
+			}
+			metricNotificationsReceived.Inc()
+			if Verbose {
+				log.Printf("notified of execution of %q", notification.Extra)
+			}
+			stored <- notification.Extra
+
+		case <-time.After(listenerPingPeriod):
+			if err := listener.Ping(); err != nil {
+				log.Printf("execution listener ping failed: %v", err)
+			}
+		}
+	}
+}
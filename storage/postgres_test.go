@@ -0,0 +1,56 @@
+package storage_test
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/watcher/storage"
+	"github.com/steinarvk/watcher/storage/storagetest"
+)
+
+// TestPostgres runs the conformance tests against the Postgres database
+// given by WATCHER_TEST_POSTGRES (a lib/pq connection string), each in a
+// schema of its own.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("WATCHER_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("WATCHER_TEST_POSTGRES not set")
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	migrations := loadMigrations(t, "../sql")
+
+	n := 0
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		n++
+		schema := fmt.Sprintf("watcher_test_%d_%d", time.Now().UnixNano(), n)
+		if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+				t.Errorf("unable to drop schema %q: %v", schema, err)
+			}
+		})
+
+		db, err := sql.Open("postgres", dsn+" search_path="+schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		store := storage.NewPostgres(db)
+		if _, _, err := store.Migrate(migrations); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ExecutionQuery selects executions of a node, in order of root time (and
+// of id, among executions with the same root time).
+type ExecutionQuery struct {
+	Path string
+
+	// From and Before, if not zero, bound the root times of the
+	// executions: from From (inclusive) to Before (exclusive).
+	From   time.Time
+	Before time.Time
+
+	SuccessfulOnly bool
+
+	// Descending selects the latest executions first.
+	Descending bool
+
+	// After, if given, selects only the executions after the one the
+	// cursor was taken from, in the order of the query, to page through
+	// the executions. Limit is the size of a page (0 for no limit).
+	After *Cursor
+	Limit int
+}
+
+// Cursor is the position of an execution in the order of executions.
+type Cursor struct {
+	RootTime time.Time
+	Id       int64
+}
+
+// Cursor returns the position of the execution.
+func (r *NodeRow) Cursor() *Cursor {
+	return &Cursor{r.RootTime, r.Id}
+}
+
+// ScanExecutions calls the callback with each execution selected by the
+// query, in order, reading them from the database as it goes rather than
+// all at once. It stops at the first error returned by the callback, and
+// returns it. The callback must not use the DB: with SQLite, it would wait
+// forever for the connection held by the scan.
+//
+// As the scan takes as long as the callback does, it is not limited by the
+// query timeout, only by one set for "scan-executions" in QueryTimeouts.
+func (d *DB) ScanExecutions(query *ExecutionQuery, callback func(row *NodeRow) error) error {
+	return d.scanExecutions(d.beginTrackingFor("scan-executions", d.QueryTimeouts["scan-executions"]), query, callback)
+}
+
+func (d *DB) scanExecutions(track *queryTracker, query *ExecutionQuery, callback func(row *NodeRow) error) error {
+	// The root time is stored with each execution, so that the executions
+	// of a node are found in order of it through the index.
+	const rootTime = "n.root_started_utcmillis"
+
+	args := []interface{}{query.Path}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	conditions := []string{"n.node_path = $1"}
+	if !query.From.IsZero() {
+		conditions = append(conditions, rootTime+" >= "+arg(toUTCMillis(query.From)))
+	}
+	if !query.Before.IsZero() {
+		conditions = append(conditions, rootTime+" < "+arg(toUTCMillis(query.Before)))
+	}
+	if query.SuccessfulOnly {
+		conditions = append(conditions, "n.success")
+	}
+
+	order, direction := ">", "ASC"
+	if query.Descending {
+		order, direction = "<", "DESC"
+	}
+	if query.After != nil {
+		t, id := arg(toUTCMillis(query.After.RootTime)), arg(query.After.Id)
+		conditions = append(conditions, fmt.Sprintf("(%s %s %s OR (%s = %s AND n.execution_id %s %s))", rootTime, order, t, rootTime, t, order, id))
+	}
+
+	limit := ""
+	if query.Limit > 0 {
+		limit = "LIMIT " + arg(query.Limit)
+	}
+
+	rows, err := d.query(track.ctx, `
+		SELECT `+nodeRowColumns+`
+		FROM program_executions AS n
+		LEFT OUTER JOIN program_executions AS r ON r.execution_id = n.root_execution_id`+outputJoins+`
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY `+rootTime+` `+direction+`, n.execution_id `+direction+`
+		`+limit, args...)
+	if err != nil {
+		return track.Finish(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanNodeRow(rows)
+		if err != nil {
+			return track.Finish(err)
+		}
+		if err := callback(item); err != nil {
+			return track.Finish(err)
+		}
+	}
+	return track.Finish(rows.Err())
+}
+
+// QueryExecutions returns the executions selected by the query, in order.
+// The query should have a limit, and be paged through with cursors.
+func (d *DB) QueryExecutions(query *ExecutionQuery) ([]*NodeRow, error) {
+	var rv []*NodeRow
+	err := d.scanExecutions(d.beginTracking("query-executions"), query, func(row *NodeRow) error {
+		rv = append(rv, row)
+		return nil
+	})
+	return rv, err
+}
+
+// QueryExecutionResults returns every execution of the node, in order of
+// root time.
+func (d *DB) QueryExecutionResults(path string) ([]*NodeRow, error) {
+	return d.QueryExecutions(&ExecutionQuery{Path: path})
+}
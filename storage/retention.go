@@ -0,0 +1,305 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// RetentionPolicy says which executions of a watch to prune. A zero limit
+// means no limit of that kind.
+//
+// An execution is pruned if it is older than MaxAge or is not among the
+// MaxCount latest executions, unless it is among the KeepLastSuccessful
+// latest successful executions. If KeepFailuresFor is given, failed
+// executions are instead pruned once they are older than that.
+type RetentionPolicy struct {
+	MaxAge             time.Duration
+	MaxCount           int
+	KeepLastSuccessful int
+	KeepFailuresFor    time.Duration
+}
+
+// PrunableExecution is an execution due to be pruned. Rows and Bytes count
+// the execution along with every execution below it, which is deleted with
+// it. Bytes counts the uncompressed outputs, whether or not their blobs are
+// shared with other executions.
+type PrunableExecution struct {
+	Id      int64
+	Started time.Time
+	Success bool
+	Rows    int64
+	Bytes   int64
+}
+
+// Cursor returns the position of the execution in the order of pruning.
+func (e *PrunableExecution) Cursor() *Cursor {
+	return &Cursor{e.Started, e.Id}
+}
+
+// RetentionCutoffs are the start times (in UTC millis) by which a policy
+// prunes the executions of a watch at some time. They are found once for
+// each pass of pruning, rather than ranking the executions for every batch.
+type RetentionCutoffs struct {
+	// before is the time before which executions are pruned, by age or
+	// count (-1 for no cutoff, which no execution is older than).
+	before int64
+	// failuresBefore is the time before which failed executions are
+	// pruned instead, unless -1.
+	failuresBefore int64
+	// keepSuccessfulFrom is the time from which successful executions are
+	// kept regardless.
+	keepSuccessfulFrom int64
+}
+
+// newCutoffs returns the cutoffs of the policy, given the start times of
+// the MaxCount-th latest execution and of the KeepLastSuccessful-th latest
+// successful execution, if there are that many.
+func (p *RetentionPolicy) newCutoffs(now time.Time, nthLatest, nthLatestSuccessful *int64) *RetentionCutoffs {
+	rv := &RetentionCutoffs{before: -1, failuresBefore: -1, keepSuccessfulFrom: math.MaxInt64}
+	if p.MaxAge > 0 {
+		rv.before = toUTCMillis(now.Add(-p.MaxAge))
+	}
+	if p.MaxCount > 0 && nthLatest != nil && *nthLatest > rv.before {
+		rv.before = *nthLatest
+	}
+	if p.KeepFailuresFor > 0 {
+		rv.failuresBefore = toUTCMillis(now.Add(-p.KeepFailuresFor))
+	}
+	if p.KeepLastSuccessful > 0 {
+		rv.keepSuccessfulFrom = -1
+		if nthLatestSuccessful != nil {
+			rv.keepSuccessfulFrom = *nthLatestSuccessful
+		}
+	}
+	return rv
+}
+
+// prunable returns whether an execution is to be pruned by the cutoffs.
+func (c *RetentionCutoffs) prunable(started int64, success bool) bool {
+	if success && started >= c.keepSuccessfulFrom {
+		return false
+	}
+	if !success && c.failuresBefore >= 0 {
+		return started < c.failuresBefore
+	}
+	return started < c.before
+}
+
+// latest returns the latest cutoff, which no prunable execution is newer
+// than.
+func (c *RetentionCutoffs) latest() int64 {
+	if c.failuresBefore > c.before {
+		return c.failuresBefore
+	}
+	return c.before
+}
+
+func (d *DB) byteLength(column string) string {
+	if d.dialect == dialectSQLite {
+		return fmt.Sprintf("LENGTH(CAST(%s AS BLOB))", column)
+	}
+	return fmt.Sprintf("OCTET_LENGTH(%s)", column)
+}
+
+// nthLatestStart returns the start time of the nth latest execution of the
+// watch (or successful execution, if successful), or nil if there are not
+// that many.
+func (d *DB) nthLatestStart(ctx context.Context, path string, n int, successful bool) (*int64, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	outcome := ""
+	if successful {
+		outcome = "AND success"
+	}
+	var rv int64
+	err := d.queryRow(ctx, `
+		SELECT started_utcmillis
+		FROM program_executions
+		WHERE node_path = $1
+		  AND parent_execution_id IS NULL
+		  `+outcome+`
+		ORDER BY started_utcmillis DESC
+		LIMIT 1 OFFSET $2
+	`, path, n-1).Scan(&rv)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rv, nil
+}
+
+// GetRetentionCutoffs returns the cutoffs by which the policy prunes the
+// executions of the watch now.
+func (d *DB) GetRetentionCutoffs(path string, policy *RetentionPolicy, now time.Time) (*RetentionCutoffs, error) {
+	track := d.beginTracking("get-retention-cutoffs")
+	nthLatest, err := d.nthLatestStart(track.ctx, path, policy.MaxCount, false)
+	if err != nil {
+		return nil, track.Finish(err)
+	}
+	nthLatestSuccessful, err := d.nthLatestStart(track.ctx, path, policy.KeepLastSuccessful, true)
+	if err != nil {
+		return nil, track.Finish(err)
+	}
+	return policy.newCutoffs(now, nthLatest, nthLatestSuccessful), track.Finish(nil)
+}
+
+// GetPrunableExecutions returns up to limit of the executions of the watch
+// that the cutoffs prune, in order of start time, starting after the cursor
+// if given. Both this and finding the cutoffs go by the start times of the
+// watch, which are unique and so indexed.
+func (d *DB) GetPrunableExecutions(path string, cutoffs *RetentionCutoffs, after *Cursor, limit int) ([]*PrunableExecution, error) {
+	afterMillis, afterId := int64(-1), int64(0)
+	if after != nil {
+		afterMillis, afterId = toUTCMillis(after.RootTime), after.Id
+	}
+	bytes := `COALESCE(SUM(` + d.byteLength("n.stdout") + ` + ` + d.byteLength("n.stderr") + ` + COALESCE(so.size_bytes, 0) + COALESCE(se.size_bytes, 0)), 0)`
+
+	track := d.beginTracking("get-prunable-executions")
+	rows, err := d.query(track.ctx, `
+		SELECT e.execution_id, e.started_utcmillis, e.success,
+		       1 + (SELECT COUNT(*) FROM program_executions AS c
+		            WHERE c.root_execution_id = e.execution_id),
+		       (SELECT `+bytes+`
+		        FROM program_executions AS n`+outputJoins+`
+		        WHERE n.execution_id = e.execution_id) +
+		       (SELECT `+bytes+`
+		        FROM program_executions AS n`+outputJoins+`
+		        WHERE n.root_execution_id = e.execution_id)
+		FROM program_executions AS e
+		WHERE e.node_path = $1
+		  AND e.parent_execution_id IS NULL
+		  AND e.started_utcmillis < $2
+		  AND (e.started_utcmillis > $3 OR (e.started_utcmillis = $3 AND e.execution_id > $4))
+		  AND NOT (e.success AND e.started_utcmillis >= $5)
+		  AND (CASE WHEN NOT e.success AND $6 >= 0
+		            THEN e.started_utcmillis < $6
+		            ELSE e.started_utcmillis < $7
+		       END)
+		ORDER BY e.started_utcmillis, e.execution_id
+		LIMIT $8
+	`, path, cutoffs.latest(), afterMillis, afterId, cutoffs.keepSuccessfulFrom, cutoffs.failuresBefore, cutoffs.before, limit)
+	if err != nil {
+		return nil, track.Finish(err)
+	}
+	defer rows.Close()
+
+	var rv []*PrunableExecution
+	for rows.Next() {
+		item := &PrunableExecution{}
+		var startMillis int64
+		if err := rows.Scan(&item.Id, &startMillis, &item.Success, &item.Rows, &item.Bytes); err != nil {
+			return nil, track.Finish(err)
+		}
+		item.Started = fromUTCMillis(startMillis)
+		rv = append(rv, item)
+	}
+	return rv, track.Finish(rows.Err())
+}
+
+// DeleteExecutions deletes the executions, along with every execution
+// below them, in a single transaction.
+func (d *DB) DeleteExecutions(ids []int64) error {
+	track := d.beginTracking("delete-executions")
+
+	tx, err := d.DB.BeginTx(track.ctx, nil)
+	if err != nil {
+		return track.Finish(err)
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		if _, err := tx.Exec(d.dialect.rebind(`DELETE FROM program_executions WHERE execution_id = $1`), id); err != nil {
+			return track.Finish(err)
+		}
+	}
+
+	return track.Finish(tx.Commit())
+}
+
+// CompactionRow is an execution of a watch as seen by compaction. An
+// execution that has been kept in place of others stands for Runs runs,
+// the last of which stopped at Until.
+type CompactionRow struct {
+	Id      int64
+	Start   time.Time
+	Until   time.Time
+	Runs    int
+	Success bool
+	Stdout  string
+}
+
+// GetCompactionRows returns up to limit of the executions of the watch that
+// started from from and before before, in order of start time.
+func (d *DB) GetCompactionRows(path string, from, before time.Time, limit int) ([]*CompactionRow, error) {
+	track := d.beginTracking("get-compaction-rows")
+	rows, err := d.query(track.ctx, `
+		SELECT n.execution_id, n.started_utcmillis,
+		       COALESCE(n.compacted_until_utcmillis, n.stopped_utcmillis),
+		       n.compacted_runs, n.success, n.stdout, so.compression, so.data
+		FROM program_executions AS n
+		LEFT OUTER JOIN output_blobs AS so ON so.blob_hash = n.stdout_hash
+		WHERE n.node_path = $1
+		  AND n.parent_execution_id IS NULL
+		  AND n.started_utcmillis >= $2
+		  AND n.started_utcmillis < $3
+		ORDER BY n.started_utcmillis
+		LIMIT $4
+	`, path, toUTCMillis(from), toUTCMillis(before), limit)
+	if err != nil {
+		return nil, track.Finish(err)
+	}
+	defer rows.Close()
+
+	var rv []*CompactionRow
+	for rows.Next() {
+		item := &CompactionRow{}
+		var startMillis, untilMillis int64
+		var stdout output
+		if err := rows.Scan(&item.Id, &startMillis, &untilMillis, &item.Runs, &item.Success, &stdout.text, &stdout.compression, &stdout.data); err != nil {
+			return nil, track.Finish(err)
+		}
+		if item.Stdout, err = stdout.value(); err != nil {
+			return nil, track.Finish(err)
+		}
+		item.Start = fromUTCMillis(startMillis)
+		item.Until = fromUTCMillis(untilMillis)
+		rv = append(rv, item)
+	}
+	return rv, track.Finish(rows.Err())
+}
+
+// CompactExecutions records that the kept execution stands for runs runs,
+// the last of which stopped at until, and deletes the executions it is
+// kept in place of (along with every execution below them).
+func (d *DB) CompactExecutions(keep int64, runs int, until time.Time, remove []int64) error {
+	track := d.beginTracking("compact-executions")
+
+	tx, err := d.DB.BeginTx(track.ctx, nil)
+	if err != nil {
+		return track.Finish(err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(d.dialect.rebind(`
+		UPDATE program_executions
+		SET compacted_runs = $2, compacted_until_utcmillis = $3
+		WHERE execution_id = $1
+	`), keep, runs, toUTCMillis(until))
+	if err != nil {
+		return track.Finish(err)
+	}
+
+	for _, id := range remove {
+		if _, err := tx.Exec(d.dialect.rebind(`DELETE FROM program_executions WHERE execution_id = $1`), id); err != nil {
+			return track.Finish(err)
+		}
+	}
+
+	return track.Finish(tx.Commit())
+}
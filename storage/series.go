@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sample is a value of a metric, as emitted by an analysis in metrics mode.
+// It is stored at the root time of the execution.
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// SeriesQuery selects the samples of a metric of a node, by root time, and
+// optionally rolls them up into buckets of the given length, aligned to the
+// Unix epoch.
+type SeriesQuery struct {
+	Path string
+	Name string
+
+	// Labels, if given, selects only the series with these labels (among
+	// any others).
+	Labels map[string]string
+
+	From   time.Time
+	Before time.Time
+	Bucket time.Duration
+}
+
+// SeriesPoint is a sample, or the rollup of the samples of a series in a
+// bucket (starting at Time).
+type SeriesPoint struct {
+	Time   time.Time
+	Labels map[string]string
+	Count  int
+	Min    float64
+	Max    float64
+	Avg    float64
+}
+
+// encodeLabels encodes labels canonically (with sorted keys), so that the
+// samples of a series can be grouped by them.
+func encodeLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+func decodeLabels(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var rv map[string]string
+	if err := json.Unmarshal([]byte(s), &rv); err != nil {
+		return nil, fmt.Errorf("invalid labels %q: %v", s, err)
+	}
+	return rv, nil
+}
+
+func hasLabels(labels, want map[string]string) bool {
+	for key, value := range want {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// insertSamples stores the samples of the execution, at its root time.
+func (d *DB) insertSamples(tx *sql.Tx, path string, executionId int64, samples []*Sample) error {
+	for _, sample := range samples {
+		_, err := tx.Exec(d.dialect.rebind(`
+			INSERT INTO metric_samples
+				(node_path, execution_id, sample_utcmillis, metric_name, labels, value)
+			SELECT $1, n.execution_id, COALESCE(r.started_utcmillis, n.started_utcmillis), $3, $4, $5
+			FROM program_executions AS n
+			LEFT OUTER JOIN program_executions AS r ON r.execution_id = n.root_execution_id
+			WHERE n.execution_id = $2
+		`), path, executionId, sample.Name, encodeLabels(sample.Labels), sample.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QuerySeries returns the points of each series of the metric selected by
+// the query, ordered by series (their labels) and then by time.
+func (d *DB) QuerySeries(query *SeriesQuery) ([]*SeriesPoint, error) {
+	args := []interface{}{query.Path, query.Name}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	conditions := []string{"node_path = $1", "metric_name = $2"}
+	if !query.From.IsZero() {
+		conditions = append(conditions, "sample_utcmillis >= "+arg(toUTCMillis(query.From)))
+	}
+	if !query.Before.IsZero() {
+		conditions = append(conditions, "sample_utcmillis < "+arg(toUTCMillis(query.Before)))
+	}
+
+	columns := "labels, sample_utcmillis, 1, value, value, value"
+	groupBy := ""
+	orderBy := "labels, sample_utcmillis, sample_id"
+	if query.Bucket > 0 {
+		bucket := arg(int64(query.Bucket / time.Millisecond))
+		columns = "labels, (sample_utcmillis / " + bucket + ") * " + bucket + " AS bucket_utcmillis, COUNT(*), MIN(value), MAX(value), AVG(value)"
+		groupBy = "GROUP BY labels, bucket_utcmillis"
+		orderBy = "labels, bucket_utcmillis"
+	}
+
+	track := d.beginTracking("query-series")
+	rows, err := d.query(track.ctx, `
+		SELECT `+columns+`
+		FROM metric_samples
+		WHERE `+strings.Join(conditions, " AND ")+`
+		`+groupBy+`
+		ORDER BY `+orderBy, args...)
+	if err != nil {
+		return nil, track.Finish(err)
+	}
+	defer rows.Close()
+
+	var rv []*SeriesPoint
+	for rows.Next() {
+		point := &SeriesPoint{}
+		var labels string
+		var millis int64
+		if err := rows.Scan(&labels, &millis, &point.Count, &point.Min, &point.Max, &point.Avg); err != nil {
+			return nil, track.Finish(err)
+		}
+		if point.Labels, err = decodeLabels(labels); err != nil {
+			return nil, track.Finish(err)
+		}
+		if !hasLabels(point.Labels, query.Labels) {
+			continue
+		}
+		point.Time = fromUTCMillis(millis)
+		rv = append(rv, point)
+	}
+	return rv, track.Finish(rows.Err())
+}
+
+func newSeriesPoint(t time.Time, labels map[string]string, value float64) *SeriesPoint {
+	return &SeriesPoint{Time: t, Labels: labels, Count: 1, Min: value, Max: value, Avg: value}
+}
+
+func (p *SeriesPoint) add(value float64) {
+	if value < p.Min {
+		p.Min = value
+	}
+	if value > p.Max {
+		p.Max = value
+	}
+	p.Avg = (p.Avg*float64(p.Count) + value) / float64(p.Count+1)
+	p.Count++
+}
+
+type memorySample struct {
+	t      time.Time
+	sample *Sample
+}
+
+// rollUp computes the points of the samples (in order of insertion) as
+// QuerySeries does, for Memory.
+func rollUp(samples []memorySample, query *SeriesQuery) []*SeriesPoint {
+	bucket := int64(query.Bucket / time.Millisecond)
+	buckets := map[string]*SeriesPoint{}
+
+	var rv []*SeriesPoint
+	for _, s := range samples {
+		if !hasLabels(s.sample.Labels, query.Labels) {
+			continue
+		}
+		if bucket <= 0 {
+			rv = append(rv, newSeriesPoint(s.t, s.sample.Labels, s.sample.Value))
+			continue
+		}
+
+		millis := (toUTCMillis(s.t) / bucket) * bucket
+		key := fmt.Sprintf("%d %s", millis, encodeLabels(s.sample.Labels))
+		if point, ok := buckets[key]; ok {
+			point.add(s.sample.Value)
+			continue
+		}
+		point := newSeriesPoint(fromUTCMillis(millis), s.sample.Labels, s.sample.Value)
+		buckets[key] = point
+		rv = append(rv, point)
+	}
+
+	sort.SliceStable(rv, func(i, j int) bool {
+		li, lj := encodeLabels(rv[i].Labels), encodeLabels(rv[j].Labels)
+		if li != lj {
+			return li < lj
+		}
+		return rv[i].Time.Before(rv[j].Time)
+	})
+	return rv
+}
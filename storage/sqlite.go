@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteBusyTimeout is how long (in milliseconds) a query waits for another
+// process holding a lock on the database file.
+var SQLiteBusyTimeout = 10000
+
+// OpenSQLite opens (creating it if necessary) an SQLite database file. The
+// schema is not created; apply the migrations in sql/sqlite first.
+//
+// The database is used through a single connection, since SQLite only
+// allows one writer at a time anyway.
+func OpenSQLite(filename string) (*DB, error) {
+	params := url.Values{}
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", SQLiteBusyTimeout))
+
+	db, err := sql.Open("sqlite", "file:"+filename+"?"+params.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("unable to open SQLite database %q: %v", filename, err)
+	}
+	db.SetMaxOpenConns(1)
+
+	return &DB{DB: db, dialect: dialectSQLite}, nil
+}
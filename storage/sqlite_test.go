@@ -0,0 +1,118 @@
+package storage_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/runner"
+	"github.com/steinarvk/watcher/storage"
+	"github.com/steinarvk/watcher/storage/storagetest"
+)
+
+func openSQLite(t *testing.T) *storage.DB {
+	db, err := storage.OpenSQLite(filepath.Join(t.TempDir(), "watcher.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DB.Close() })
+	return db
+}
+
+func loadMigrations(t *testing.T, dir string) storage.Migrations {
+	migrations, err := storage.LoadMigrations(os.DirFS(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrations
+}
+
+func TestSQLite(t *testing.T) {
+	migrations := loadMigrations(t, "../sql/sqlite")
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		db := openSQLite(t)
+		if _, _, err := db.Migrate(migrations); err != nil {
+			t.Fatal(err)
+		}
+		return db
+	})
+}
+
+func TestQueryContext(t *testing.T) {
+	db := openSQLite(t)
+	if _, _, err := db.Migrate(loadMigrations(t, "../sql/sqlite")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	withCtx := db.WithContext(ctx)
+	if _, err := withCtx.GetLatestExecution("w"); err != nil {
+		t.Fatalf("GetLatestExecution() = %v", err)
+	}
+
+	cancel()
+	if _, err := withCtx.GetLatestExecution("w"); err == nil {
+		t.Errorf("GetLatestExecution() with a cancelled context succeeded")
+	}
+	if _, err := db.GetLatestExecution("w"); err != nil {
+		t.Errorf("GetLatestExecution() without the cancelled context = %v", err)
+	}
+
+	db.QueryTimeouts = map[string]time.Duration{"get-latest-execution": time.Nanosecond}
+	if _, err := db.GetLatestExecution("w"); err == nil {
+		t.Errorf("GetLatestExecution() with a timeout of 1ns succeeded")
+	}
+	if _, err := db.GetTimeOfLatestSuccessfulExecution("w"); err != nil {
+		t.Errorf("GetTimeOfLatestSuccessfulExecution() = %v", err)
+	}
+
+	// A scan takes as long as its callback, so it is only limited by a
+	// timeout set for it by name.
+	db.QueryTimeouts = nil
+	db.QueryTimeout = time.Nanosecond
+	if _, err := db.QueryExecutions(&storage.ExecutionQuery{Path: "w", Limit: 10}); err == nil {
+		t.Errorf("QueryExecutions() with a timeout of 1ns succeeded")
+	}
+	if err := db.ScanExecutions(&storage.ExecutionQuery{Path: "w"}, func(*storage.NodeRow) error { return nil }); err != nil {
+		t.Errorf("ScanExecutions() with a query timeout of 1ns = %v", err)
+	}
+}
+
+func TestChildrenSharedBetweenProcesses(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "watcher.db")
+	open := func() *storage.DB {
+		db, err := storage.OpenSQLite(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.DB.Close() })
+		return db
+	}
+
+	daemon := open()
+	if _, _, err := daemon.Migrate(loadMigrations(t, "../sql/sqlite")); err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.SetChildren(map[string][]string{"w": {"w/a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// E.g. an importer, which does not know the config.
+	importer := open()
+	now := time.Now()
+	if _, err := importer.InsertExecution("w", &runner.Result{Start: now, Stop: now, Stdout: "imported", Success: true}, &hostinfo.HostInfo{Hostname: "testhost"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var got string
+	processed, err := daemon.ProcessWork("w/a", time.Minute, &hostinfo.HostInfo{Hostname: "testhost"}, func(item *storage.WorkItem) (*runner.Result, []*storage.Sample) {
+		got = item.Stdout
+		return &runner.Result{Start: now, Stop: now, Success: true}, nil
+	})
+	if err != nil || !processed || got != "imported" {
+		t.Errorf("ProcessWork(w/a) = %v, %v with input %q want the imported execution", processed, err, got)
+	}
+}
@@ -1,13 +1,13 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"log"
+	"sync"
 	"time"
 
-	"go4.org/sort"
-
-	"github.com/lib/pq"
 	"github.com/steinarvk/watcher/hostinfo"
 	"github.com/steinarvk/watcher/runner"
 
@@ -52,6 +52,39 @@ var (
 		},
 		[]string{"stream"},
 	)
+
+	metricBlobBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "output_blob_bytes_inserted",
+			Help:      "Bytes of (compressed) output blobs inserted into database",
+		},
+		[]string{"compression"},
+	)
+
+	metricLeaseRenewals = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "lease_renewals",
+			Help:      "Number of times a lease was renewed while its work was running",
+		},
+	)
+
+	metricLeasesLost = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "leases_lost",
+			Help:      "Number of leases lost (expired or broken) while their work was running",
+		},
+	)
+
+	metricNotificationsReceived = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "execution_notifications_received",
+			Help:      "Number of notifications of stored executions received from the database",
+		},
+	)
 )
 
 func init() {
@@ -59,20 +92,41 @@ func init() {
 	prometheus.MustRegister(metricQueriesFinished)
 	prometheus.MustRegister(metricQueryLatency)
 	prometheus.MustRegister(metricExecutionDataBytes)
+	prometheus.MustRegister(metricBlobBytes)
+	prometheus.MustRegister(metricNotificationsReceived)
+	prometheus.MustRegister(metricLeaseRenewals)
+	prometheus.MustRegister(metricLeasesLost)
 }
 
 type queryTracker struct {
-	name string
-	t0   time.Time
+	name   string
+	t0     time.Time
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func beginTracking(name string) *queryTracker {
+func (d *DB) beginTracking(name string) *queryTracker {
+	return d.beginTrackingFor(name, d.queryTimeout(name))
+}
+
+// beginTrackingFor begins tracking a query, which is cancelled if it takes
+// longer than the timeout (if not zero) or the context of the DB is done.
+func (d *DB) beginTrackingFor(name string, timeout time.Duration) *queryTracker {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(d.context(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(d.context())
+	}
 	metricQueries.With(prometheus.Labels{
 		"query": name,
 	}).Inc()
 	return &queryTracker{
-		name: name,
-		t0:   time.Now(),
+		name:   name,
+		t0:     time.Now(),
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
@@ -81,12 +135,18 @@ func (q *queryTracker) Finish(err error) error {
 	status := "ok"
 	if err != nil {
 		status = "error"
-		if err == sql.ErrNoRows {
+		switch {
+		case err == sql.ErrNoRows:
 			status = "ErrNoRows"
-		} else if castErr, ok := err.(*pq.Error); ok {
-			status = castErr.Code.Name()
+		case q.ctx.Err() == context.DeadlineExceeded:
+			status = "timeout"
+		case q.ctx.Err() == context.Canceled:
+			status = "cancelled"
+		default:
+			status = errorStatus(err)
 		}
 	}
+	q.cancel()
 	duration := t1.Sub(q.t0)
 	durationSecs := duration.Seconds()
 
@@ -105,8 +165,63 @@ func (q *queryTracker) Finish(err error) error {
 	return err
 }
 
+// DB is the SQL implementation of Store, for Postgres or SQLite.
 type DB struct {
-	DB *sql.DB
+	DB      *sql.DB
+	dialect dialect
+
+	// Compression is the compression algorithm for new output blobs
+	// (DefaultCompression if empty).
+	Compression string
+
+	// QueryTimeout is how long a query may take (unlimited if zero), and
+	// QueryTimeouts overrides it by query name, as in the metrics.
+	// Migrations are not limited.
+	QueryTimeout  time.Duration
+	QueryTimeouts map[string]time.Duration
+
+	ctx context.Context
+
+	listenDSN string
+}
+
+// NewPostgres returns a DB using an opened Postgres database.
+func NewPostgres(db *sql.DB) *DB {
+	return &DB{DB: db, dialect: dialectPostgres}
+}
+
+// WithContext returns a DB sharing everything with this one, except that
+// its queries are cancelled when the context is done.
+func (d *DB) WithContext(ctx context.Context) Store {
+	rv := *d
+	rv.ctx = ctx
+	return &rv
+}
+
+func (d *DB) context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+func (d *DB) queryTimeout(name string) time.Duration {
+	if timeout, ok := d.QueryTimeouts[name]; ok {
+		return timeout
+	}
+	return d.QueryTimeout
+}
+
+func (d *DB) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return d.DB.QueryContext(ctx, d.dialect.rebind(query), args...)
+}
+
+func (d *DB) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return d.DB.QueryRowContext(ctx, d.dialect.rebind(query), args...)
+}
+
+func (d *DB) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return d.DB.ExecContext(ctx, d.dialect.rebind(query), args...)
 }
 
 func toUTCMillis(t time.Time) int64 {
@@ -118,57 +233,17 @@ func fromUTCMillis(t int64) time.Time {
 }
 
 func (d *DB) wrappedExec(name, sql string, args ...interface{}) (sql.Result, error) {
-	track := beginTracking(name)
-	result, err := d.DB.Exec(sql, args...)
+	track := d.beginTracking(name)
+	result, err := d.exec(track.ctx, sql, args...)
 	return result, track.Finish(err)
 }
 
-type ChildlessExecution struct {
-	Id     int64
-	Stdout string
-}
-
-func (d *DB) GetChildlessExecutions(parentPath, childPath string) ([]*ChildlessExecution, bool, error) {
-	limit := 100
-	track := beginTracking("get-childless-executions")
-	rows, err := d.DB.Query(`
-		SELECT execution_id, stdout
-		FROM program_executions AS p
-		WHERE p.node_path = $1
-		  AND p.success
-		  AND (SELECT COUNT(execution_id)
-		       FROM program_executions AS c
-		       WHERE c.parent_execution_id = p.execution_id
-					   AND c.node_path = $2) = 0
-		LIMIT $3
-	`, parentPath, childPath, limit)
-	if err != nil {
-		return nil, false, track.Finish(err)
-	}
-	var rv []*ChildlessExecution
-	for rows.Next() {
-		item := &ChildlessExecution{}
-		if err := rows.Scan(&item.Id, &item.Stdout); err != nil {
-			return nil, false, track.Finish(err)
-		}
-		rv = append(rv, item)
-	}
-	if err := rows.Err(); err != nil {
-		return nil, false, track.Finish(err)
-	}
-	return rv, len(rv) == limit, nil
-}
+func (d *DB) Ping(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(d.context(), timeout)
+	defer cancel()
 
-func (d *DB) getRootId(parent int64) (*int64, error) {
-	var rv *int64
-
-	track := beginTracking("get-root-execution-id")
-	err := d.DB.QueryRow(`
-		SELECT root_execution_id
-		FROM program_executions
-		WHERE execution_id = $1
-	`, parent).Scan(&rv)
-	return rv, track.Finish(err)
+	track := d.beginTracking("ping")
+	return track.Finish(d.DB.PingContext(ctx))
 }
 
 type NodeRow struct {
@@ -177,31 +252,31 @@ type NodeRow struct {
 	Result   runner.Result
 }
 
-func (d *DB) GetLatestExecutionIfChildless(path, childPath string) (*NodeRow, error) {
-	item := &NodeRow{}
+// nodeRowColumns are the columns read by scanNodeRow, from program_executions
+// AS n, its root AS r and outputJoins.
+const nodeRowColumns = `n.execution_id, r.started_utcmillis, n.started_utcmillis, n.stopped_utcmillis, n.stdout, so.compression, so.data, n.stderr, se.compression, se.data, n.success`
 
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanNodeRow(row scanner) (*NodeRow, error) {
+	item := &NodeRow{}
 	var rootStartMillis *int64
 	var startMillis, stopMillis int64
-
-	track := beginTracking("get-latest-execution-if-childless")
-	err := d.DB.QueryRow(`
-		SELECT n.execution_id, r.started_utcmillis, n.started_utcmillis, n.stopped_utcmillis, n.stdout, n.stderr, n.success
-		FROM program_executions AS n
-		JOIN (SELECT nn.execution_id
-					FROM program_executions AS nn
-					LEFT OUTER JOIN program_executions AS rt ON rt.execution_id = nn.root_execution_id
-					WHERE nn.node_path = $1
-					ORDER BY rt.started_utcmillis DESC
-					LIMIT 1) as latest ON (latest.execution_id = n.execution_id)
-		LEFT OUTER JOIN program_executions AS r ON r.execution_id = n.root_execution_id
-		WHERE NOT EXISTS (SELECT execution_id FROM program_executions
-		                  WHERE node_path = $2 AND parent_execution_id = n.execution_id)
-	`, path, childPath).Scan(&item.Id, &rootStartMillis, &startMillis, &stopMillis, &item.Result.Stdout, &item.Result.Stderr, &item.Result.Success)
-	track.Finish(err)
+	var stdout, stderr output
+	err := row.Scan(&item.Id, &rootStartMillis, &startMillis, &stopMillis,
+		&stdout.text, &stdout.compression, &stdout.data,
+		&stderr.text, &stderr.compression, &stderr.data,
+		&item.Result.Success)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
+		return nil, err
+	}
+
+	if item.Result.Stdout, err = stdout.value(); err != nil {
+		return nil, err
+	}
+	if item.Result.Stderr, err = stderr.value(); err != nil {
 		return nil, err
 	}
 
@@ -217,11 +292,51 @@ func (d *DB) GetLatestExecutionIfChildless(path, childPath string) (*NodeRow, er
 	return item, nil
 }
 
+func (d *DB) GetLatestExecutionIfChildless(path, childPath string) (*NodeRow, error) {
+	track := d.beginTracking("get-latest-execution-if-childless")
+	item, err := scanNodeRow(d.queryRow(track.ctx, `
+		SELECT `+nodeRowColumns+`
+		FROM program_executions AS n
+		JOIN (SELECT nn.execution_id
+					FROM program_executions AS nn
+					WHERE nn.node_path = $1
+					ORDER BY nn.root_started_utcmillis DESC
+					LIMIT 1) as latest ON (latest.execution_id = n.execution_id)
+		LEFT OUTER JOIN program_executions AS r ON r.execution_id = n.root_execution_id`+outputJoins+`
+		WHERE NOT EXISTS (SELECT execution_id FROM program_executions
+		                  WHERE node_path = $2 AND parent_execution_id = n.execution_id)
+	`, path, childPath))
+	track.Finish(err)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return item, err
+}
+
+// GetLatestExecution returns the execution of the node with the latest root
+// time, or nil if the node has no executions.
+func (d *DB) GetLatestExecution(path string) (*NodeRow, error) {
+	track := d.beginTracking("get-latest-execution")
+	item, err := scanNodeRow(d.queryRow(track.ctx, `
+		SELECT `+nodeRowColumns+`
+		FROM program_executions AS n
+		LEFT OUTER JOIN program_executions AS r ON r.execution_id = n.root_execution_id`+outputJoins+`
+		WHERE n.node_path = $1
+		ORDER BY n.root_started_utcmillis DESC
+		LIMIT 1
+	`, path))
+	track.Finish(err)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return item, err
+}
+
 func (d *DB) GetTimeOfLatestSuccessfulExecution(path string) (*time.Time, error) {
 	var timeMillis int64
 
-	track := beginTracking("get-time-of-latest-successful-execution")
-	err := d.DB.QueryRow(`
+	track := d.beginTracking("get-time-of-latest-successful-execution")
+	err := d.queryRow(track.ctx, `
 		SELECT started_utcmillis
 		FROM program_executions
 		WHERE node_path = $1
@@ -234,106 +349,114 @@ func (d *DB) GetTimeOfLatestSuccessfulExecution(path string) (*time.Time, error)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
+	if err != nil {
+		return nil, err
+	}
 	rv := fromUTCMillis(timeMillis)
 	return &rv, nil
 }
 
-func (d *DB) QueryExecutionResults(path string) ([]*NodeRow, error) {
-	var rv []*NodeRow
-	var err error
+func (d *DB) InsertExecution(path string, result *runner.Result, info *hostinfo.HostInfo, parent *int64) (int64, error) {
+	if Verbose {
+		log.Printf("InsertExecution(%q, ...)", path)
+	}
 
-	track := beginTracking("query-execution-results")
-	rows, err := d.DB.Query(`
-		SELECT n.execution_id, r.started_utcmillis, n.started_utcmillis, n.stopped_utcmillis, n.stdout, n.stderr, n.success
-		FROM program_executions AS n
-		LEFT OUTER JOIN program_executions AS r ON r.execution_id = n.root_execution_id
-		WHERE n.node_path = $1
-	`, path)
-	if err == nil {
-		for rows.Next() {
-			item := &NodeRow{}
-			var rootStartMillis *int64
-			var startMillis, stopMillis int64
-			err = rows.Scan(&item.Id, &rootStartMillis, &startMillis, &stopMillis, &item.Result.Stdout, &item.Result.Stderr, &item.Result.Success)
-			if err != nil {
-				break
-			}
-			item.Result.Start = fromUTCMillis(startMillis)
-			item.Result.Stop = fromUTCMillis(stopMillis)
-
-			if rootStartMillis != nil {
-				item.RootTime = fromUTCMillis(*rootStartMillis)
-			} else {
-				item.RootTime = item.Result.Start
-			}
-
-			rv = append(rv, item)
-		}
+	track := d.beginTracking("insert-execution")
 
-		if err == nil {
-			err = rows.Err()
-		}
+	tx, err := d.DB.BeginTx(track.ctx, nil)
+	if err != nil {
+		return 0, track.Finish(err)
 	}
+	defer tx.Rollback()
 
-	sort.Slice(rv, func(i, j int) bool {
-		return rv[i].RootTime.Before(rv[j].RootTime)
-	})
+	executionId, err := d.insertExecution(tx, path, result, info, parent)
+	if err != nil {
+		return 0, track.Finish(err)
+	}
 
-	return rv, track.Finish(err)
+	if err := tx.Commit(); err != nil {
+		return 0, track.Finish(err)
+	}
+	countExecutionData(result)
+	return executionId, track.Finish(nil)
 }
 
-func (d *DB) InsertExecution(path string, result *runner.Result, info *hostinfo.HostInfo, parent *int64) (int64, error) {
+// insertExecution inserts the execution along with the blobs of its outputs,
+// and enqueues the work of running the children of the node on it.
+func (d *DB) insertExecution(tx *sql.Tx, path string, result *runner.Result, info *hostinfo.HostInfo, parent *int64) (int64, error) {
 	var rootId *int64
+	rootStartMillis := toUTCMillis(result.Start)
 	if parent != nil {
-		id, err := d.getRootId(*parent)
+		err := tx.QueryRow(d.dialect.rebind(`
+			SELECT COALESCE(root_execution_id, execution_id), COALESCE(root_started_utcmillis, started_utcmillis)
+			FROM program_executions
+			WHERE execution_id = $1
+		`), *parent).Scan(&rootId, &rootStartMillis)
 		if err != nil {
 			return 0, err
 		}
-		if id == nil {
-			rootId = parent
-		} else {
-			rootId = id
-		}
 	}
 
-	if Verbose {
-		log.Printf("InsertExecution(%q, ...)", path)
+	now := time.Now()
+	stdoutHash, err := d.storeBlob(tx, result.Stdout, now)
+	if err != nil {
+		return 0, err
 	}
+	stderrHash, err := d.storeBlob(tx, result.Stderr, now)
+	if err != nil {
+		return 0, err
+	}
+
 	var executionId int64
-	track := beginTracking("insert-execution")
-	err := d.DB.QueryRow(`
+	err = tx.QueryRow(d.dialect.rebind(`
 		INSERT INTO program_executions
 			(node_path,
 		   executor_host, executor_pid,
 			 started_utcmillis, stopped_utcmillis,
 			 success,
 			 stdout, stderr,
+			 stdout_hash, stderr_hash,
 			 parent_execution_id,
-		   root_execution_id)
+		   root_execution_id, root_started_utcmillis)
 			VALUES
 			($1,
 			 $2, $3,
 			 $4, $5,
 			 $6,
+			 '', '',
 			 $7, $8,
 		   $9,
-		   $10)
+		   $10, $11)
 		  RETURNING execution_id
-	`,
+	`),
 		path,
 		info.Hostname, info.Pid,
 		toUTCMillis(result.Start), toUTCMillis(result.Stop),
 		result.Success,
-		result.Stdout, result.Stderr,
+		stdoutHash, stderrHash,
 		parent,
-		rootId,
+		rootId, rootStartMillis,
 	).Scan(&executionId)
-	track.Finish(err)
-	if err == nil {
-		metricExecutionDataBytes.WithLabelValues("stdout").Add(float64(len(result.Stdout)))
-		metricExecutionDataBytes.WithLabelValues("stderr").Add(float64(len(result.Stderr)))
+	if err != nil {
+		return 0, err
+	}
+
+	if err := d.notifyExecution(tx, path); err != nil {
+		return 0, err
 	}
-	return executionId, err
+
+	if result.Success {
+		if err := d.enqueueWork(tx, path, executionId, now); err != nil {
+			return 0, err
+		}
+	}
+
+	return executionId, nil
+}
+
+func countExecutionData(result *runner.Result) {
+	metricExecutionDataBytes.WithLabelValues("stdout").Add(float64(len(result.Stdout)))
+	metricExecutionDataBytes.WithLabelValues("stderr").Add(float64(len(result.Stderr)))
 }
 
 func (d *DB) CleanLeases(t time.Time) error {
@@ -346,53 +469,128 @@ func (d *DB) CleanLeases(t time.Time) error {
 	return err
 }
 
-type Lease struct {
+var (
+	leaseHolderOnce sync.Once
+	leaseHolderInfo *hostinfo.HostInfo
+)
+
+// leaseHolder returns the host and pid recorded as the holder of the
+// leases this process obtains.
+func leaseHolder() *hostinfo.HostInfo {
+	leaseHolderOnce.Do(func() {
+		info, err := hostinfo.Get()
+		if err != nil {
+			log.Printf("error getting hostinfo for leases: %v", err)
+			info = &hostinfo.HostInfo{}
+		}
+		leaseHolderInfo = info
+	})
+	return leaseHolderInfo
+}
+
+type dbLease struct {
 	db  *DB
 	key string
 	id  int64
 }
 
-func (l *Lease) Release() error {
+func (l *dbLease) Renew(deadline time.Time) (bool, error) {
+	if Verbose {
+		log.Printf("Lease.Renew(%q,%v,%v)", l.key, l.id, deadline)
+	}
+	result, err := l.db.wrappedExec("renew-lease", `
+		UPDATE work_leases
+		SET leased_until_utcmillis = $3
+		WHERE lease_id = $1 AND lease_key = $2
+	`, l.id, l.key, toUTCMillis(deadline))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (l *dbLease) Release() error {
 	if Verbose {
 		log.Printf("Lease.Release(%q,%v)", l.key, l.id)
 	}
-	_, err := l.db.DB.Exec(`
+	_, err := l.db.wrappedExec("release-lease", `
 		DELETE FROM work_leases
 		WHERE lease_id = $1 AND lease_key = $2
 	`, l.id, l.key)
 	return err
 }
 
-func (d *DB) TryObtainLease(key string, deadline time.Time) (*Lease, error) {
+func (d *DB) TryObtainLease(key string, deadline time.Time) (Lease, error) {
 	if Verbose {
 		log.Printf("TryObtainLease(%q, %v)", key, deadline)
 	}
 
 	var leaseId int64
+	holder := leaseHolder()
 
-	track := beginTracking("try-obtain-lease")
-	err := d.DB.QueryRow(`
+	track := d.beginTracking("try-obtain-lease")
+	err := d.queryRow(track.ctx, `
 		INSERT INTO work_leases
-			(lease_key, leased_until_utcmillis)
+			(lease_key, leased_until_utcmillis,
+			 holder_host, holder_pid, obtained_utcmillis)
 				VALUES
-		  ($1, $2)
+		  ($1, $2,
+			 $3, $4, $5)
 		RETURNING lease_id
-	`, key, toUTCMillis(deadline)).Scan(&leaseId)
+	`, key, toUTCMillis(deadline), holder.Hostname, holder.Pid, toUTCMillis(time.Now())).Scan(&leaseId)
 	track.Finish(err)
 
 	if err == nil {
-		return &Lease{d, key, leaseId}, nil
+		return &dbLease{d, key, leaseId}, nil
 	}
 
-	if castErr, ok := err.(*pq.Error); ok {
-		if castErr.Code.Name() == "unique_violation" {
-			return nil, nil
-		}
+	if isUniqueViolation(err) {
+		return nil, nil
 	}
 
 	return nil, err
 }
 
+func (d *DB) ListLeases() ([]*LeaseInfo, error) {
+	track := d.beginTracking("list-leases")
+	rows, err := d.query(track.ctx, `
+		SELECT lease_id, lease_key, leased_until_utcmillis, obtained_utcmillis,
+		       COALESCE(holder_host, ''), COALESCE(holder_pid, 0)
+		FROM work_leases
+		ORDER BY lease_key
+	`)
+	if err != nil {
+		return nil, track.Finish(err)
+	}
+	defer rows.Close()
+
+	var rv []*LeaseInfo
+	for rows.Next() {
+		item := &LeaseInfo{}
+		var untilMillis int64
+		var obtainedMillis *int64
+		if err := rows.Scan(&item.Id, &item.Key, &untilMillis, &obtainedMillis, &item.HolderHost, &item.HolderPid); err != nil {
+			return nil, track.Finish(err)
+		}
+		item.Until = fromUTCMillis(untilMillis)
+		item.Obtained = optionalFromUTCMillis(obtainedMillis)
+		rv = append(rv, item)
+	}
+	return rv, track.Finish(rows.Err())
+}
+
+func (d *DB) BreakLease(key string) (bool, error) {
+	result, err := d.wrappedExec("break-lease", `
+		DELETE FROM work_leases WHERE lease_key = $1
+	`, key)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
 func (d *DB) Unschedule(path string) error {
 	_, err := d.wrappedExec("unschedule", `
 		DELETE FROM scheduling_queue WHERE node_path = $1
@@ -412,10 +610,8 @@ func (d *DB) ScheduleEvent(path string, t time.Time) error {
 	`,
 		path, toUTCMillis(t),
 	)
-	if castErr, ok := err.(*pq.Error); ok {
-		if castErr.Code.Name() == "unique_violation" {
-			return nil
-		}
+	if isUniqueViolation(err) {
+		return nil
 	}
 	return err
 }
@@ -426,8 +622,8 @@ func (d *DB) NextScheduledSpecificEvent(path string) (time.Time, bool, error) {
 	}
 	var millis int64
 
-	track := beginTracking("next-scheduled-specific-event")
-	err := d.DB.QueryRow(`
+	track := d.beginTracking("next-scheduled-specific-event")
+	err := d.queryRow(track.ctx, `
 	  SELECT target_time_utcmillis
 		FROM scheduling_queue
 		WHERE node_path = $1
@@ -439,29 +635,386 @@ func (d *DB) NextScheduledSpecificEvent(path string) (time.Time, bool, error) {
 	if err == sql.ErrNoRows {
 		return time.Time{}, false, nil
 	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
 	t := time.Unix(0, millis*int64(time.Millisecond))
 	return t, true, nil
 }
 
-func (d *DB) WithLease(key string, dur time.Duration, callback func() error) error {
+func (d *DB) WithLease(key string, dur time.Duration, callback func(ctx context.Context) error) error {
+	return WithLease(d.context(), d, key, dur, callback)
+}
+
+// AlertState is the state of a stateful trigger. An alert is firing if
+// FiringSince is set.
+type AlertState struct {
+	TriggerPath  string
+	FiringSince  *time.Time
+	FiringInput  string
+	LastNotified *time.Time
+	ResolvedAt   *time.Time
+
+	// Acknowledged is set (through AcknowledgeAlert) if the current firing
+	// has been acknowledged. It is cleared when the alert resolves or
+	// starts firing anew.
+	Acknowledged   *time.Time
+	AcknowledgedBy string
+}
+
+func (a *AlertState) Firing() bool {
+	return a.FiringSince != nil
+}
+
+func optionalFromUTCMillis(t *int64) *time.Time {
+	if t == nil {
+		return nil
+	}
+	rv := fromUTCMillis(*t)
+	return &rv
+}
+
+func optionalToUTCMillis(t *time.Time) *int64 {
+	if t == nil {
+		return nil
+	}
+	rv := toUTCMillis(*t)
+	return &rv
+}
+
+// GetAlertState returns the alert state of the trigger, or nil if the
+// trigger has never fired.
+func (d *DB) GetAlertState(triggerPath string) (*AlertState, error) {
+	var firingSince, lastNotified, resolvedAt, acknowledged *int64
+	var acknowledgedBy *string
+	rv := &AlertState{TriggerPath: triggerPath}
+
+	track := d.beginTracking("get-alert-state")
+	err := d.queryRow(track.ctx, `
+		SELECT firing_since_utcmillis, firing_input, last_notified_utcmillis, resolved_at_utcmillis,
+		       acknowledged_utcmillis, acknowledged_by
+		FROM alert_states
+		WHERE trigger_path = $1
+	`, triggerPath).Scan(&firingSince, &rv.FiringInput, &lastNotified, &resolvedAt, &acknowledged, &acknowledgedBy)
+	track.Finish(err)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rv.FiringSince = optionalFromUTCMillis(firingSince)
+	rv.LastNotified = optionalFromUTCMillis(lastNotified)
+	rv.ResolvedAt = optionalFromUTCMillis(resolvedAt)
+	rv.Acknowledged = optionalFromUTCMillis(acknowledged)
+	if acknowledgedBy != nil {
+		rv.AcknowledgedBy = *acknowledgedBy
+	}
+
+	return rv, nil
+}
+
+// SetAlertState stores the alert state. The acknowledgement is not written,
+// but it is cleared if the firing start time changes.
+func (d *DB) SetAlertState(state *AlertState) error {
 	if Verbose {
-		log.Printf("WithLease(%q, %v)", key, dur)
+		log.Printf("SetAlertState(%q, firing=%v)", state.TriggerPath, state.Firing())
 	}
-	now := time.Now()
-	deadline := now.Add(dur)
-	lease, err := d.TryObtainLease(key, deadline)
+	_, err := d.wrappedExec("set-alert-state", `
+		INSERT INTO alert_states
+			(trigger_path, firing_since_utcmillis, firing_input, last_notified_utcmillis, resolved_at_utcmillis)
+				VALUES
+			($1, $2, $3, $4, $5)
+		ON CONFLICT (trigger_path) DO UPDATE SET
+			firing_since_utcmillis = EXCLUDED.firing_since_utcmillis,
+			firing_input = EXCLUDED.firing_input,
+			last_notified_utcmillis = EXCLUDED.last_notified_utcmillis,
+			resolved_at_utcmillis = EXCLUDED.resolved_at_utcmillis,
+			acknowledged_utcmillis = CASE
+				WHEN alert_states.firing_since_utcmillis IS NOT DISTINCT FROM EXCLUDED.firing_since_utcmillis
+				THEN alert_states.acknowledged_utcmillis
+				ELSE NULL END,
+			acknowledged_by = CASE
+				WHEN alert_states.firing_since_utcmillis IS NOT DISTINCT FROM EXCLUDED.firing_since_utcmillis
+				THEN alert_states.acknowledged_by
+				ELSE NULL END
+	`,
+		state.TriggerPath,
+		optionalToUTCMillis(state.FiringSince),
+		state.FiringInput,
+		optionalToUTCMillis(state.LastNotified),
+		optionalToUTCMillis(state.ResolvedAt),
+	)
+	return err
+}
+
+var ErrNotFiring = errors.New("alert is not firing")
+
+// AcknowledgeAlert acknowledges the current firing of a stateful trigger,
+// which stops repeat notifications until it resolves.
+func (d *DB) AcknowledgeAlert(triggerPath, author string, t time.Time) error {
+	if Verbose {
+		log.Printf("AcknowledgeAlert(%q, %q)", triggerPath, author)
+	}
+	result, err := d.wrappedExec("acknowledge-alert", `
+		UPDATE alert_states
+		SET acknowledged_utcmillis = $2, acknowledged_by = $3
+		WHERE trigger_path = $1
+		  AND firing_since_utcmillis IS NOT NULL
+	`, triggerPath, toUTCMillis(t), author)
 	if err != nil {
 		return err
 	}
-	if lease == nil {
-		return nil
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
 	}
-	defer func() {
-		err := lease.Release()
-		if err != nil {
-			log.Printf("error: failed to release lease %v: %v", lease, err)
+	if n == 0 {
+		return ErrNotFiring
+	}
+	return nil
+}
+
+// Silence suppresses trigger commands for the trigger paths matching
+// PathPattern (a path.Match pattern) until Expires.
+type Silence struct {
+	Id          int64     `json:"id"`
+	PathPattern string    `json:"path_pattern"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+	Author      string    `json:"author"`
+	Comment     string    `json:"comment"`
+}
+
+func (d *DB) CreateSilence(silence *Silence) (int64, error) {
+	if Verbose {
+		log.Printf("CreateSilence(%q, %v)", silence.PathPattern, silence.Expires)
+	}
+	var silenceId int64
+	track := d.beginTracking("create-silence")
+	err := d.queryRow(track.ctx, `
+		INSERT INTO alert_silences
+			(path_pattern, created_utcmillis, expires_utcmillis, author, comment)
+				VALUES
+			($1, $2, $3, $4, $5)
+		RETURNING silence_id
+	`,
+		silence.PathPattern,
+		toUTCMillis(silence.Created), toUTCMillis(silence.Expires),
+		silence.Author, silence.Comment,
+	).Scan(&silenceId)
+	return silenceId, track.Finish(err)
+}
+
+// ExpireSilence ends a silence at the given time (if it had not already
+// expired).
+func (d *DB) ExpireSilence(silenceId int64, t time.Time) error {
+	_, err := d.wrappedExec("expire-silence", `
+		UPDATE alert_silences
+		SET expires_utcmillis = $2
+		WHERE silence_id = $1 AND expires_utcmillis > $2
+	`, silenceId, toUTCMillis(t))
+	return err
+}
+
+// GetActiveSilences returns the silences that have not expired at t.
+func (d *DB) GetActiveSilences(t time.Time) ([]*Silence, error) {
+	track := d.beginTracking("get-active-silences")
+	rows, err := d.query(track.ctx, `
+		SELECT silence_id, path_pattern, created_utcmillis, expires_utcmillis, author, comment
+		FROM alert_silences
+		WHERE expires_utcmillis > $1
+		ORDER BY silence_id
+	`, toUTCMillis(t))
+	if err != nil {
+		return nil, track.Finish(err)
+	}
+	defer rows.Close()
+
+	var rv []*Silence
+	for rows.Next() {
+		item := &Silence{}
+		var createdMillis, expiresMillis int64
+		if err := rows.Scan(&item.Id, &item.PathPattern, &createdMillis, &expiresMillis, &item.Author, &item.Comment); err != nil {
+			return nil, track.Finish(err)
 		}
-	}()
+		item.Created = fromUTCMillis(createdMillis)
+		item.Expires = fromUTCMillis(expiresMillis)
+		rv = append(rv, item)
+	}
+	return rv, track.Finish(rows.Err())
+}
+
+// RecordSuppressedFiring records that a trigger would have run a command for
+// the given analysis execution, but did not. Only the first suppression per
+// trigger and execution is recorded, and it returns whether this was it.
+func (d *DB) RecordSuppressedFiring(triggerPath string, parent int64, silenceId *int64, reason, input string, t time.Time) (bool, error) {
+	if Verbose {
+		log.Printf("RecordSuppressedFiring(%q, %d, %q)", triggerPath, parent, reason)
+	}
+	result, err := d.wrappedExec("record-suppressed-firing", `
+		INSERT INTO suppressed_firings
+			(trigger_path, parent_execution_id, silence_id, suppressed_utcmillis, reason, input)
+				VALUES
+			($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (trigger_path, parent_execution_id) DO NOTHING
+	`, triggerPath, parent, silenceId, toUTCMillis(t), reason, input)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetTimeOfLatestDedupFiring returns when the trigger last fired for the
+// given deduplication key, or nil if it never has.
+func (d *DB) GetTimeOfLatestDedupFiring(triggerPath, key string) (*time.Time, error) {
+	var timeMillis int64
 
-	return callback()
+	track := d.beginTracking("get-time-of-latest-dedup-firing")
+	err := d.queryRow(track.ctx, `
+		SELECT last_fired_utcmillis
+		FROM trigger_dedup_keys
+		WHERE trigger_path = $1 AND dedup_key = $2
+	`, triggerPath, key).Scan(&timeMillis)
+	track.Finish(err)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rv := fromUTCMillis(timeMillis)
+	return &rv, nil
+}
+
+func (d *DB) RecordDedupFiring(triggerPath, key string, t time.Time) error {
+	if Verbose {
+		log.Printf("RecordDedupFiring(%q, %q, %v)", triggerPath, key, t)
+	}
+	_, err := d.wrappedExec("record-dedup-firing", `
+		INSERT INTO trigger_dedup_keys
+			(trigger_path, dedup_key, last_fired_utcmillis)
+				VALUES
+			($1, $2, $3)
+		ON CONFLICT (trigger_path, dedup_key) DO UPDATE SET
+			last_fired_utcmillis = EXCLUDED.last_fired_utcmillis
+	`, triggerPath, key, toUTCMillis(t))
+	return err
+}
+
+// DigestState is the state of a digest trigger: the latest execution of its
+// parent it has collected (for information; the executions to collect are
+// queued as work), and when it last delivered a digest.
+type DigestState struct {
+	TriggerPath     string
+	LastExecutionId int64
+	LastDelivered   time.Time
+}
+
+// GetDigestState returns the state of a digest trigger, or nil if it has
+// never run.
+func (d *DB) GetDigestState(triggerPath string) (*DigestState, error) {
+	rv := &DigestState{TriggerPath: triggerPath}
+	var lastDeliveredMillis int64
+
+	track := d.beginTracking("get-digest-state")
+	err := d.queryRow(track.ctx, `
+		SELECT last_execution_id, last_delivered_utcmillis
+		FROM digest_states
+		WHERE trigger_path = $1
+	`, triggerPath).Scan(&rv.LastExecutionId, &lastDeliveredMillis)
+	track.Finish(err)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rv.LastDelivered = fromUTCMillis(lastDeliveredMillis)
+
+	return rv, nil
+}
+
+func (d *DB) SetDigestState(state *DigestState) error {
+	if Verbose {
+		log.Printf("SetDigestState(%q, %d, %v)", state.TriggerPath, state.LastExecutionId, state.LastDelivered)
+	}
+	_, err := d.wrappedExec("set-digest-state", `
+		INSERT INTO digest_states
+			(trigger_path, last_execution_id, last_delivered_utcmillis)
+				VALUES
+			($1, $2, $3)
+		ON CONFLICT (trigger_path) DO UPDATE SET
+			last_execution_id = EXCLUDED.last_execution_id,
+			last_delivered_utcmillis = EXCLUDED.last_delivered_utcmillis
+	`, state.TriggerPath, state.LastExecutionId, toUTCMillis(state.LastDelivered))
+	return err
+}
+
+// DigestItem is a trigger input waiting to be delivered in a digest.
+type DigestItem struct {
+	Id          int64
+	ExecutionId int64
+	RootTime    time.Time
+	Input       string
+	Collected   time.Time
+}
+
+func (d *DB) AddDigestItem(triggerPath string, executionId int64, input string, t time.Time) error {
+	if Verbose {
+		log.Printf("AddDigestItem(%q, %d)", triggerPath, executionId)
+	}
+	_, err := d.wrappedExec("add-digest-item", `
+		INSERT INTO digest_items
+			(trigger_path, execution_id, input, collected_utcmillis)
+				VALUES
+			($1, $2, $3, $4)
+		ON CONFLICT (trigger_path, execution_id) DO NOTHING
+	`, triggerPath, executionId, input, toUTCMillis(t))
+	return err
+}
+
+// GetDigestItems returns the undelivered items of a digest trigger, in the
+// order they were collected.
+func (d *DB) GetDigestItems(triggerPath string) ([]*DigestItem, error) {
+	track := d.beginTracking("get-digest-items")
+	rows, err := d.query(track.ctx, `
+		SELECT i.digest_item_id, i.execution_id, COALESCE(r.started_utcmillis, n.started_utcmillis), i.input, i.collected_utcmillis
+		FROM digest_items AS i
+		JOIN program_executions AS n ON n.execution_id = i.execution_id
+		LEFT OUTER JOIN program_executions AS r ON r.execution_id = n.root_execution_id
+		WHERE i.trigger_path = $1
+		ORDER BY i.digest_item_id ASC
+	`, triggerPath)
+	if err != nil {
+		return nil, track.Finish(err)
+	}
+	defer rows.Close()
+
+	var rv []*DigestItem
+	for rows.Next() {
+		item := &DigestItem{}
+		var rootMillis, collectedMillis int64
+		if err := rows.Scan(&item.Id, &item.ExecutionId, &rootMillis, &item.Input, &collectedMillis); err != nil {
+			return nil, track.Finish(err)
+		}
+		item.RootTime = fromUTCMillis(rootMillis)
+		item.Collected = fromUTCMillis(collectedMillis)
+		rv = append(rv, item)
+	}
+	return rv, track.Finish(rows.Err())
+}
+
+// DeleteDigestItems deletes the items of a digest trigger up to and
+// including the given item id, once they have been delivered.
+func (d *DB) DeleteDigestItems(triggerPath string, upToId int64) error {
+	_, err := d.wrappedExec("delete-digest-items", `
+		DELETE FROM digest_items
+		WHERE trigger_path = $1 AND digest_item_id <= $2
+	`, triggerPath, upToId)
+	return err
 }
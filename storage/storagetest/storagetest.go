@@ -0,0 +1,1054 @@
+// Package storagetest is a conformance test suite for implementations of
+// storage.Store.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/runner"
+	"github.com/steinarvk/watcher/storage"
+)
+
+// Run runs the conformance tests. newStore is called once per test and
+// must return an empty store.
+func Run(t *testing.T, newStore func(t *testing.T) storage.Store) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, s storage.Store)
+	}{
+		{"Executions", testExecutions},
+		{"QueryExecutions", testQueryExecutions},
+		{"BinaryOutput", testBinaryOutput},
+		{"ChildlessExecutions", testChildlessExecutions},
+		{"WorkQueue", testWorkQueue},
+		{"Reconciliation", testReconciliation},
+		{"Series", testSeries},
+		{"Retention", testRetention},
+		{"Compaction", testCompaction},
+		{"Leases", testLeases},
+		{"SchedulingQueue", testSchedulingQueue},
+		{"AlertStates", testAlertStates},
+		{"Silences", testSilences},
+		{"DedupKeys", testDedupKeys},
+		{"Digests", testDigests},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.f(t, newStore(t))
+		})
+	}
+}
+
+var (
+	t0   = time.Unix(1500000000, 0)
+	info = &hostinfo.HostInfo{Hostname: "testhost", Pid: 1234}
+)
+
+func at(minutes int) time.Time {
+	return t0.Add(time.Duration(minutes) * time.Minute)
+}
+
+func insert(t *testing.T, s storage.Store, path string, start time.Time, success bool, stdout string, parent *int64) int64 {
+	t.Helper()
+	result := &runner.Result{
+		Start:   start,
+		Stop:    start.Add(time.Second),
+		Stdout:  stdout,
+		Stderr:  "stderr of " + stdout,
+		Success: success,
+	}
+	id, err := s.InsertExecution(path, result, info, parent)
+	if err != nil {
+		t.Fatalf("InsertExecution(%q, %v) = err: %v", path, start, err)
+	}
+	return id
+}
+
+func ids(rows []*storage.NodeRow) []int64 {
+	var rv []int64
+	for _, row := range rows {
+		rv = append(rv, row.Id)
+	}
+	return rv
+}
+
+func sameIds(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testExecutions(t *testing.T, s storage.Store) {
+	root1 := insert(t, s, "w", at(0), true, "one", nil)
+	root2 := insert(t, s, "w", at(10), true, "two", nil)
+	root3 := insert(t, s, "w", at(20), false, "three", nil)
+
+	// Analyses run later than the watches, and not in order.
+	a2 := insert(t, s, "w/a", at(30), true, "a2", &root2)
+	a1 := insert(t, s, "w/a", at(31), false, "a1", &root1)
+	trig := insert(t, s, "w/a/t", at(32), true, "t", &a2)
+
+	if _, err := s.InsertExecution("w", &runner.Result{Start: at(0), Stop: at(1)}, info, nil); err == nil {
+		t.Errorf("InsertExecution() with duplicate node and start time succeeded")
+	}
+
+	rows, err := s.QueryExecutionResults("w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(rows), []int64{root1, root2, root3}; !sameIds(got, want) {
+		t.Errorf("QueryExecutionResults(w) = %v want %v", got, want)
+	}
+	if rows[2].Result.Success || rows[2].Result.Stdout != "three" || rows[2].Result.Stderr != "stderr of three" {
+		t.Errorf("QueryExecutionResults(w)[2] = %+v", rows[2].Result)
+	}
+	if !rows[0].Result.Start.Equal(at(0)) || !rows[0].Result.Stop.Equal(at(0).Add(time.Second)) {
+		t.Errorf("QueryExecutionResults(w)[0] has times %v-%v", rows[0].Result.Start, rows[0].Result.Stop)
+	}
+
+	// Executions are ordered by the times of their roots.
+	rows, err = s.QueryExecutionResults("w/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(rows), []int64{a1, a2}; !sameIds(got, want) {
+		t.Errorf("QueryExecutionResults(w/a) = %v want %v", got, want)
+	}
+
+	latest, err := s.GetLatestExecution("w/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil || latest.Id != a2 || !latest.RootTime.Equal(at(10)) {
+		t.Errorf("GetLatestExecution(w/a) = %+v want %d with root time %v", latest, a2, at(10))
+	}
+
+	latest, err = s.GetLatestExecution("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil || latest.Id != trig || !latest.RootTime.Equal(at(10)) {
+		t.Errorf("GetLatestExecution(w/a/t) = %+v want %d with root time %v", latest, trig, at(10))
+	}
+
+	latest, err = s.GetLatestExecution("nonexistent")
+	if err != nil || latest != nil {
+		t.Errorf("GetLatestExecution(nonexistent) = %v, %v want nil", latest, err)
+	}
+
+	recent, err := s.QueryExecutions(&storage.ExecutionQuery{Path: "w", Descending: true, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(recent), []int64{root3, root2}; !sameIds(got, want) {
+		t.Errorf("QueryExecutions(w, latest 2) = %v want %v", got, want)
+	}
+
+	recent, err = s.QueryExecutions(&storage.ExecutionQuery{Path: "w", SuccessfulOnly: true, Descending: true, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(recent), []int64{root2, root1}; !sameIds(got, want) {
+		t.Errorf("QueryExecutions(w, latest 10 successful) = %v want %v", got, want)
+	}
+
+	successTime, err := s.GetTimeOfLatestSuccessfulExecution("w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if successTime == nil || !successTime.Equal(at(10)) {
+		t.Errorf("GetTimeOfLatestSuccessfulExecution(w) = %v want %v", successTime, at(10))
+	}
+
+	successTime, err = s.GetTimeOfLatestSuccessfulExecution("nonexistent")
+	if err != nil || successTime != nil {
+		t.Errorf("GetTimeOfLatestSuccessfulExecution(nonexistent) = %v, %v want nil", successTime, err)
+	}
+}
+
+func testQueryExecutions(t *testing.T, s storage.Store) {
+	var roots []int64
+	for i := 0; i < 6; i++ {
+		roots = append(roots, insert(t, s, "w", at(i), i != 2, fmt.Sprintf("%d", i), nil))
+	}
+	// Analyses are ordered by the times of their roots.
+	a4 := insert(t, s, "w/a", at(10), true, "a4", &roots[4])
+	a1 := insert(t, s, "w/a", at(11), true, "a1", &roots[1])
+
+	query := func(q storage.ExecutionQuery) []int64 {
+		t.Helper()
+		rows, err := s.QueryExecutions(&q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids(rows)
+	}
+
+	if got, want := query(storage.ExecutionQuery{Path: "w", From: at(1), Before: at(4)}), roots[1:4]; !sameIds(got, want) {
+		t.Errorf("QueryExecutions(w, from 1 before 4) = %v want %v", got, want)
+	}
+	if got, want := query(storage.ExecutionQuery{Path: "w", From: at(1), Before: at(4), SuccessfulOnly: true}), []int64{roots[1], roots[3]}; !sameIds(got, want) {
+		t.Errorf("QueryExecutions(w, from 1 before 4, successful) = %v want %v", got, want)
+	}
+	if got, want := query(storage.ExecutionQuery{Path: "w/a", From: at(2)}), []int64{a4}; !sameIds(got, want) {
+		t.Errorf("QueryExecutions(w/a, from 2) = %v want %v", got, want)
+	}
+	if got, want := query(storage.ExecutionQuery{Path: "w/a"}), []int64{a1, a4}; !sameIds(got, want) {
+		t.Errorf("QueryExecutions(w/a) = %v want %v", got, want)
+	}
+
+	// Paging through with cursors, in both directions.
+	for _, descending := range []bool{false, true} {
+		var got []int64
+		q := storage.ExecutionQuery{Path: "w", Descending: descending, Limit: 4}
+		for {
+			rows, err := s.QueryExecutions(&q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, ids(rows)...)
+			if len(rows) < q.Limit {
+				break
+			}
+			q.After = rows[len(rows)-1].Cursor()
+		}
+		want := append([]int64(nil), roots...)
+		if descending {
+			for i, j := 0, len(want)-1; i < j; i, j = i+1, j-1 {
+				want[i], want[j] = want[j], want[i]
+			}
+		}
+		if !sameIds(got, want) {
+			t.Errorf("paging through QueryExecutions(w, descending=%v) = %v want %v", descending, got, want)
+		}
+	}
+
+	errStop := errors.New("stop")
+	var scanned []int64
+	err := s.ScanExecutions(&storage.ExecutionQuery{Path: "w", From: at(3)}, func(row *storage.NodeRow) error {
+		scanned = append(scanned, row.Id)
+		if len(scanned) == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || !sameIds(scanned, roots[3:5]) {
+		t.Errorf("ScanExecutions(w, from 3) = %v, %v want %v, stopped", scanned, err, roots[3:5])
+	}
+}
+
+func testBinaryOutput(t *testing.T, s storage.Store) {
+	binary := "\x00\xff\xfe not UTF-8 \xc3\x28"
+	result := &runner.Result{Start: at(0), Stop: at(1), Stdout: binary, Stderr: binary + "\n", Success: true}
+	id, err := s.InsertExecution("w", result, info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := s.GetLatestExecution("w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil || latest.Id != id || latest.Result.Stdout != binary || latest.Result.Stderr != binary+"\n" {
+		t.Errorf("GetLatestExecution(w) = %+v want binary outputs %q", latest, binary)
+	}
+
+	if _, err := s.EnqueueChildlessExecutions("w", "w/a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := processWork(t, s, "w/a"); got != binary {
+		t.Errorf("ProcessWork(w/a) got input %q want binary output %q", got, binary)
+	}
+}
+
+// processWork processes a work item of the node, storing its input as the
+// output, and returns the input.
+func processWork(t *testing.T, s storage.Store, path string) string {
+	t.Helper()
+	var input string
+	processed, err := s.ProcessWork(path, time.Minute, info, func(item *storage.WorkItem) (*runner.Result, []*storage.Sample) {
+		input = item.Stdout
+		return &runner.Result{Start: at(30), Stop: at(31), Stdout: item.Stdout, Success: true}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !processed {
+		t.Fatalf("ProcessWork(%s) found no work", path)
+	}
+	return input
+}
+
+func testChildlessExecutions(t *testing.T, s storage.Store) {
+	root1 := insert(t, s, "w", at(0), true, "one", nil)
+	root2 := insert(t, s, "w", at(10), true, "two", nil)
+	insert(t, s, "w", at(20), false, "three", nil)
+
+	insert(t, s, "w/a", at(1), true, "a1", &root1)
+
+	latest, err := s.GetLatestExecutionIfChildless("w", "w/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil || latest.Result.Stdout != "three" {
+		t.Errorf("GetLatestExecutionIfChildless(w, w/a) = %+v want the latest execution", latest)
+	}
+
+	a2 := insert(t, s, "w/a", at(11), true, "a2", &root2)
+	insert(t, s, "w/a/t", at(12), true, "t", &a2)
+
+	latest, err = s.GetLatestExecutionIfChildless("w/a", "w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != nil {
+		t.Errorf("GetLatestExecutionIfChildless(w/a, w/a/t) = %+v want nil", latest)
+	}
+}
+
+func setChildren(t *testing.T, s storage.Store, children map[string][]string) {
+	t.Helper()
+	if err := s.SetChildren(children); err != nil {
+		t.Fatalf("SetChildren(%v) = %v", children, err)
+	}
+}
+
+func hasWork(t *testing.T, s storage.Store, path string) bool {
+	t.Helper()
+	processed, err := s.ProcessWork(path, time.Minute, info, func(item *storage.WorkItem) (*runner.Result, []*storage.Sample) {
+		return &runner.Result{Start: at(50), Stop: at(50), Success: true}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return processed
+}
+
+func testWorkQueue(t *testing.T, s storage.Store) {
+	setChildren(t, s, map[string][]string{"w": {"w/a"}})
+
+	root1 := insert(t, s, "w", at(0), true, "one", nil)
+	insert(t, s, "w", at(10), false, "two", nil)
+
+	if got := processWork(t, s, "w/a"); got != "one" {
+		t.Errorf("ProcessWork(w/a) got input %q want %q", got, "one")
+	}
+	processed, err := s.ProcessWork("w/a", time.Minute, info, func(item *storage.WorkItem) (*runner.Result, []*storage.Sample) {
+		t.Errorf("ProcessWork(w/a) got item %+v want none: failed executions are not analysed", item)
+		return nil, nil
+	})
+	if err != nil || processed {
+		t.Errorf("ProcessWork(w/a) = %v, %v want no work", processed, err)
+	}
+
+	rows, err := s.QueryExecutionResults("w/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Result.Stdout != "one" || !rows[0].RootTime.Equal(at(0)) {
+		t.Errorf("QueryExecutionResults(w/a) = %+v want the analysis of %d", rows, root1)
+	}
+
+	// Executions stored before the child was configured are only found by
+	// reconciling, and only once.
+	root3 := insert(t, s, "w", at(20), true, "three", nil)
+	for _, want := range []int64{2, 0} {
+		n, err := s.EnqueueChildlessExecutions("w", "w/b")
+		if err != nil || n != want {
+			t.Errorf("EnqueueChildlessExecutions(w, w/b) = %d, %v want %d", n, err, want)
+		}
+	}
+	if n, err := s.EnqueueChildlessExecutions("w", "w/a"); err != nil || n != 0 {
+		t.Errorf("EnqueueChildlessExecutions(w, w/a) = %d, %v want 0: already enqueued", n, err)
+	}
+
+	// A claimed item is not handed out again before its timeout.
+	processed, err = s.ProcessWork("w/b", time.Minute, info, func(item *storage.WorkItem) (*runner.Result, []*storage.Sample) {
+		ok, err := s.ProcessWork("w/b", time.Minute, info, func(other *storage.WorkItem) (*runner.Result, []*storage.Sample) {
+			if other.Id == item.Id {
+				t.Errorf("ProcessWork(w/b) handed out claimed item %+v again", item)
+			}
+			return &runner.Result{Start: at(41), Stop: at(41), Success: true}, nil
+		})
+		if err != nil || !ok {
+			t.Errorf("nested ProcessWork(w/b) = %v, %v want the other item", ok, err)
+		}
+		return &runner.Result{Start: at(40), Stop: at(40), Success: true}, nil
+	})
+	if err != nil || !processed {
+		t.Errorf("ProcessWork(w/b) = %v, %v want work", processed, err)
+	}
+
+	// Deleting an execution deletes its pending work.
+	if err := s.DeleteExecutions([]int64{root3}); err != nil {
+		t.Fatal(err)
+	}
+	processed, err = s.ProcessWork("w/a", time.Minute, info, func(item *storage.WorkItem) (*runner.Result, []*storage.Sample) {
+		t.Errorf("ProcessWork(w/a) got item %+v of a deleted execution", item)
+		return nil, nil
+	})
+	if err != nil || processed {
+		t.Errorf("ProcessWork(w/a) after deletion = %v, %v want no work", processed, err)
+	}
+
+	// Setting the children replaces all of those set before, and deletes
+	// the pending work of those removed.
+	setChildren(t, s, map[string][]string{"w": {"w/c", "w/e"}, "x": {"x/a"}})
+	insert(t, s, "w", at(60), true, "six", nil)
+	setChildren(t, s, map[string][]string{"w": {"w/c"}})
+	insert(t, s, "w", at(61), true, "six and a half", nil)
+	insert(t, s, "x", at(61), true, "x", nil)
+	for _, path := range []string{"w/a", "w/e", "x/a"} {
+		if hasWork(t, s, path) {
+			t.Errorf("ProcessWork(%s) found work after %s was removed", path, path)
+		}
+	}
+	if !hasWork(t, s, "w/c") {
+		t.Errorf("ProcessWork(w/c) found no work")
+	}
+
+	// The pending work of a node can also be collected in bulk.
+	setChildren(t, s, map[string][]string{"w": {"w/d"}})
+	for i, stdout := range []string{"seven", "eight", "nine"} {
+		insert(t, s, "w", at(70+i), true, stdout, nil)
+	}
+	pending, err := s.GetPendingWork("w/d", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].Stdout != "seven" || pending[1].Stdout != "eight" {
+		t.Fatalf("GetPendingWork(w/d, 2) = %+v want seven and eight", pending)
+	}
+	if err := s.DeleteWork([]int64{pending[0].Id, pending[1].Id}); err != nil {
+		t.Fatal(err)
+	}
+	pending, err = s.GetPendingWork("w/d", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Stdout != "nine" {
+		t.Errorf("GetPendingWork(w/d, 10) after DeleteWork = %+v want nine", pending)
+	}
+
+	// An item whose claim runs out is processed again, but its result is
+	// only stored once.
+	processed, err = s.ProcessWork("w/d", -time.Second, info, func(item *storage.WorkItem) (*runner.Result, []*storage.Sample) {
+		if !hasWork(t, s, "w/d") {
+			t.Errorf("ProcessWork(w/d) did not hand out the item whose claim ran out")
+		}
+		return &runner.Result{Start: at(80), Stop: at(80), Success: true}, nil
+	})
+	if err != nil || !processed {
+		t.Errorf("ProcessWork(w/d) = %v, %v want work", processed, err)
+	}
+	rows, err = s.QueryExecutionResults("w/d")
+	if err != nil || len(rows) != 1 {
+		t.Errorf("QueryExecutionResults(w/d) = %d rows, %v want 1", len(rows), err)
+	}
+}
+
+func testReconciliation(t *testing.T, s storage.Store) {
+	unreconciled := func() map[string][]string {
+		t.Helper()
+		children, err := s.GetUnreconciledChildren()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return children
+	}
+
+	setChildren(t, s, map[string][]string{"w": {"w/a", "w/b"}})
+	if got := unreconciled(); len(got["w"]) != 2 {
+		t.Errorf("GetUnreconciledChildren() = %v want w/a and w/b", got)
+	}
+	if err := s.SetChildReconciled("w", "w/a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := unreconciled(); len(got["w"]) != 1 || got["w"][0] != "w/b" {
+		t.Errorf("GetUnreconciledChildren() = %v want w/b", got)
+	}
+
+	// A child that is kept stays reconciled; a new one is not.
+	setChildren(t, s, map[string][]string{"w": {"w/a", "w/c"}})
+	if got := unreconciled(); len(got) != 1 || len(got["w"]) != 1 || got["w"][0] != "w/c" {
+		t.Errorf("GetUnreconciledChildren() = %v want w/c", got)
+	}
+}
+
+func prunable(t *testing.T, s storage.Store, path string, policy *storage.RetentionPolicy, after *storage.Cursor, limit int) []*storage.PrunableExecution {
+	t.Helper()
+	cutoffs, err := s.GetRetentionCutoffs(path, policy, at(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := s.GetPrunableExecutions(path, cutoffs, after, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+func prunableIds(t *testing.T, s storage.Store, path string, policy *storage.RetentionPolicy, after *storage.Cursor, limit int) []int64 {
+	t.Helper()
+	items := prunable(t, s, path, policy, after, limit)
+	var rv []int64
+	for _, item := range items {
+		rv = append(rv, item.Id)
+	}
+	return rv
+}
+
+func testSeries(t *testing.T, s storage.Store) {
+	setChildren(t, s, map[string][]string{"w": {"w/m"}})
+
+	var roots []int64
+	for i, minute := range []int{0, 1, 61} {
+		roots = append(roots, insert(t, s, "w", at(minute), true, fmt.Sprint(i+1), nil))
+	}
+	for i := range roots {
+		processed, err := s.ProcessWork("w/m", time.Minute, info, func(item *storage.WorkItem) (*runner.Result, []*storage.Sample) {
+			var value float64
+			fmt.Sscan(item.Stdout, &value)
+			samples := []*storage.Sample{
+				{Name: "temp", Labels: map[string]string{"room": "a"}, Value: value},
+				{Name: "temp", Labels: map[string]string{"room": "b"}, Value: 10 * value},
+				{Name: "other", Value: value},
+			}
+			return &runner.Result{Start: at(100 + i), Stop: at(100 + i), Success: true}, samples
+		})
+		if err != nil || !processed {
+			t.Fatalf("ProcessWork(w/m) = %v, %v want work", processed, err)
+		}
+	}
+
+	type point struct {
+		t        time.Time
+		labels   string
+		count    int
+		min, max float64
+		avg      float64
+	}
+	query := func(query *storage.SeriesQuery) []point {
+		t.Helper()
+		points, err := s.QuerySeries(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rv []point
+		for _, p := range points {
+			rv = append(rv, point{p.Time, fmt.Sprint(p.Labels), p.Count, p.Min, p.Max, p.Avg})
+		}
+		return rv
+	}
+	sample := func(minute int, labels string, value float64) point {
+		return point{at(minute), labels, 1, value, value, value}
+	}
+	check := func(name string, got, want []point) {
+		t.Helper()
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("QuerySeries(%s) = %v want %v", name, got, want)
+		}
+	}
+
+	a, b := "map[room:a]", "map[room:b]"
+	check("temp", query(&storage.SeriesQuery{Path: "w/m", Name: "temp"}), []point{
+		sample(0, a, 1), sample(1, a, 2), sample(61, a, 3),
+		sample(0, b, 10), sample(1, b, 20), sample(61, b, 30),
+	})
+	check("temp of room b", query(&storage.SeriesQuery{Path: "w/m", Name: "temp", Labels: map[string]string{"room": "b"}}), []point{
+		sample(0, b, 10), sample(1, b, 20), sample(61, b, 30),
+	})
+	check("other from minute 1", query(&storage.SeriesQuery{Path: "w/m", Name: "other", From: at(1), Before: at(61)}), []point{
+		sample(1, "map[]", 2),
+	})
+
+	// at(0) is 40 minutes before the end of its hour.
+	hour := t0.Truncate(time.Hour)
+	check("hourly temp of room a", query(&storage.SeriesQuery{Path: "w/m", Name: "temp", Labels: map[string]string{"room": "a"}, Bucket: time.Hour}), []point{
+		{hour, a, 2, 1, 2, 1.5},
+		{hour.Add(time.Hour), a, 1, 3, 3, 3},
+	})
+
+	// Deleting an execution deletes the samples of the analyses of it.
+	if err := s.DeleteExecutions([]int64{roots[2]}); err != nil {
+		t.Fatal(err)
+	}
+	check("other after deletion", query(&storage.SeriesQuery{Path: "w/m", Name: "other"}), []point{
+		sample(0, "map[]", 1), sample(1, "map[]", 2),
+	})
+}
+
+func testRetention(t *testing.T, s storage.Store) {
+	var roots []int64
+	for i := 0; i < 6; i++ {
+		success := i != 1 && i != 3
+		roots = append(roots, insert(t, s, "w", at(i), success, fmt.Sprintf("%d", i), nil))
+	}
+	child := insert(t, s, "w/a", at(7), true, "child", &roots[0])
+
+	tests := []struct {
+		policy storage.RetentionPolicy
+		want   []int64
+	}{
+		{storage.RetentionPolicy{MaxCount: 3}, roots[:3]},
+		{storage.RetentionPolicy{MaxCount: 3, KeepLastSuccessful: 4}, roots[1:2]},
+		{storage.RetentionPolicy{MaxAge: 7 * time.Minute}, roots[:3]},
+		{storage.RetentionPolicy{MaxAge: 7 * time.Minute, KeepFailuresFor: time.Hour}, []int64{roots[0], roots[2]}},
+		{storage.RetentionPolicy{KeepFailuresFor: 8 * time.Minute}, roots[1:2]},
+		{storage.RetentionPolicy{KeepLastSuccessful: 1}, nil},
+	}
+	for _, test := range tests {
+		if got := prunableIds(t, s, "w", &test.policy, nil, 100); !sameIds(got, test.want) {
+			t.Errorf("GetPrunableExecutions(w, %+v) = %v want %v", test.policy, got, test.want)
+		}
+	}
+
+	policy := &storage.RetentionPolicy{MaxCount: 1}
+	if got, want := prunableIds(t, s, "w", policy, &storage.Cursor{at(1), roots[1]}, 2), roots[2:4]; !sameIds(got, want) {
+		t.Errorf("GetPrunableExecutions(w, after %d, limit 2) = %v want %v", roots[1], got, want)
+	}
+
+	// Only executions of watches are pruned.
+	if got := prunableIds(t, s, "w/a", &storage.RetentionPolicy{MaxAge: time.Second}, nil, 100); len(got) != 0 {
+		t.Errorf("GetPrunableExecutions(w/a) = %v want none", got)
+	}
+
+	items := prunable(t, s, "w", policy, nil, 1)
+	wantBytes := int64(len("0") + len("stderr of 0") + len("child") + len("stderr of child"))
+	if len(items) != 1 || items[0].Rows != 2 || items[0].Bytes != wantBytes || !items[0].Success || !items[0].Started.Equal(at(0)) {
+		t.Errorf("GetPrunableExecutions(w, limit 1) = %+v want 2 rows and %d bytes", items[0], wantBytes)
+	}
+
+	if _, err := s.RecordSuppressedFiring("w/a/t", child, nil, "silenced", "child", at(8)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddDigestItem("w/d", roots[0], "0", at(8)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DeleteExecutions([]int64{roots[0], roots[1]}); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := s.QueryExecutionResults("w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(rows), roots[2:]; !sameIds(got, want) {
+		t.Errorf("QueryExecutionResults(w) after DeleteExecutions() = %v want %v", got, want)
+	}
+
+	rows, err = s.QueryExecutionResults("w/a")
+	if err != nil || len(rows) != 0 {
+		t.Errorf("QueryExecutionResults(w/a) after DeleteExecutions() = %v, %v want none", ids(rows), err)
+	}
+
+	digestItems, err := s.GetDigestItems("w/d")
+	if err != nil || len(digestItems) != 0 {
+		t.Errorf("GetDigestItems(w/d) after DeleteExecutions() = %v, %v want none", digestItems, err)
+	}
+}
+
+func testCompaction(t *testing.T, s storage.Store) {
+	var roots []int64
+	for i := 0; i < 4; i++ {
+		roots = append(roots, insert(t, s, "w", at(i), true, "same", nil))
+	}
+	child := insert(t, s, "w/a", at(5), true, "child", &roots[1])
+
+	rows, err := s.GetCompactionRows("w", at(1), at(3), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Id != roots[1] || rows[1].Id != roots[2] {
+		t.Fatalf("GetCompactionRows(w, %v, %v) = %v want %v", at(1), at(3), rows, roots[1:3])
+	}
+	if rows[0].Runs != 1 || !rows[0].Start.Equal(at(1)) || !rows[0].Until.Equal(at(1).Add(time.Second)) || rows[0].Stdout != "same" || !rows[0].Success {
+		t.Errorf("GetCompactionRows(w)[0] = %+v", rows[0])
+	}
+
+	if err := s.CompactExecutions(roots[0], 3, at(2).Add(time.Second), roots[1:3]); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err = s.GetCompactionRows("w", at(0), at(10), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Id != roots[0] || rows[1].Id != roots[3] {
+		t.Fatalf("GetCompactionRows(w) after CompactExecutions() = %v want %v", rows, []int64{roots[0], roots[3]})
+	}
+	if rows[0].Runs != 3 || !rows[0].Until.Equal(at(2).Add(time.Second)) || !rows[0].Start.Equal(at(0)) {
+		t.Errorf("compacted execution = %+v want 3 runs until %v", rows[0], at(2).Add(time.Second))
+	}
+
+	// Only executions of watches are compacted, and the analyses of removed
+	// executions go with them.
+	if rows, err := s.GetCompactionRows("w/a", at(0), at(10), 100); err != nil || len(rows) != 0 {
+		t.Errorf("GetCompactionRows(w/a) = %v, %v want none", rows, err)
+	}
+	latest, err := s.GetLatestExecution("w/a")
+	if err != nil || latest != nil {
+		t.Errorf("GetLatestExecution(w/a) = %v, %v want nil (%d was removed)", latest, err, child)
+	}
+}
+
+func testLeases(t *testing.T, s storage.Store) {
+	now := time.Now()
+
+	lease, err := s.TryObtainLease("a", now.Add(time.Minute))
+	if err != nil || lease == nil {
+		t.Fatalf("TryObtainLease(a) = %v, %v", lease, err)
+	}
+
+	again, err := s.TryObtainLease("a", now.Add(time.Minute))
+	if err != nil || again != nil {
+		t.Fatalf("TryObtainLease(a) while leased = %v, %v want nil", again, err)
+	}
+
+	other, err := s.TryObtainLease("b", now.Add(time.Second))
+	if err != nil || other == nil {
+		t.Fatalf("TryObtainLease(b) = %v, %v", other, err)
+	}
+
+	if err := lease.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	lease, err = s.TryObtainLease("a", now.Add(time.Minute))
+	if err != nil || lease == nil {
+		t.Fatalf("TryObtainLease(a) after release = %v, %v", lease, err)
+	}
+
+	// Cleaning removes the expired lease on "b" only.
+	if err := s.CleanLeases(now.Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if other, err := s.TryObtainLease("b", now.Add(time.Minute)); err != nil || other == nil {
+		t.Fatalf("TryObtainLease(b) after expiry = %v, %v", other, err)
+	}
+	if again, err := s.TryObtainLease("a", now.Add(time.Minute)); err != nil || again != nil {
+		t.Fatalf("TryObtainLease(a) after cleaning = %v, %v want nil", again, err)
+	}
+
+	if ok, err := lease.Renew(now.Add(time.Hour)); err != nil || !ok {
+		t.Errorf("Renew(a) = %v, %v want true", ok, err)
+	}
+
+	var outer, inner bool
+	err = s.WithLease("c", time.Minute, func(context.Context) error {
+		outer = true
+		return s.WithLease("c", time.Minute, func(context.Context) error {
+			inner = true
+			return nil
+		})
+	})
+	if err != nil || !outer || inner {
+		t.Errorf("WithLease(c) nested: err=%v outer=%v inner=%v want (nil, true, false)", err, outer, inner)
+	}
+
+	err = s.WithLease("c", time.Minute, func(context.Context) error {
+		inner = true
+		return nil
+	})
+	if err != nil || !inner {
+		t.Errorf("WithLease(c) after release: err=%v ran=%v", err, inner)
+	}
+
+	// The lease is renewed for as long as the callback runs, and the
+	// callback finds out when it is broken.
+	err = s.WithLease("d", 300*time.Millisecond, func(ctx context.Context) error {
+		time.Sleep(500 * time.Millisecond)
+		if err := s.CleanLeases(time.Now()); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			t.Errorf("WithLease(d) lost the lease while running")
+		}
+
+		leases, err := s.ListLeases()
+		if err != nil {
+			return err
+		}
+		var keys []string
+		for _, lease := range leases {
+			keys = append(keys, lease.Key)
+			if lease.HolderPid != os.Getpid() || lease.Obtained == nil {
+				t.Errorf("ListLeases() returned %+v want held by pid %d", lease, os.Getpid())
+			}
+		}
+		if got, want := fmt.Sprint(keys), "[a b d]"; got != want {
+			t.Errorf("ListLeases() = %s want %s", got, want)
+		}
+
+		if ok, err := s.BreakLease("d"); err != nil || !ok {
+			t.Errorf("BreakLease(d) = %v, %v want true", ok, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Errorf("WithLease(d) was not told that the lease was broken")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if ok, err := lease.Renew(now.Add(time.Hour)); err != nil || !ok {
+		t.Errorf("Renew(a) = %v, %v want true", ok, err)
+	}
+	if ok, err := s.BreakLease("a"); err != nil || !ok {
+		t.Errorf("BreakLease(a) = %v, %v want true", ok, err)
+	}
+	if ok, err := lease.Renew(now.Add(time.Hour)); err != nil || ok {
+		t.Errorf("Renew(a) after BreakLease = %v, %v want false", ok, err)
+	}
+	if ok, err := s.BreakLease("a"); err != nil || ok {
+		t.Errorf("BreakLease(a) again = %v, %v want false", ok, err)
+	}
+}
+
+func testSchedulingQueue(t *testing.T, s storage.Store) {
+	if _, ok, err := s.NextScheduledSpecificEvent("w"); err != nil || ok {
+		t.Fatalf("NextScheduledSpecificEvent(w) on empty queue = %v, %v", ok, err)
+	}
+
+	if err := s.ScheduleEvent("w", at(5)); err != nil {
+		t.Fatal(err)
+	}
+	// Only one event may be scheduled per node; the second is ignored.
+	if err := s.ScheduleEvent("w", at(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ScheduleEvent("v", at(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	next, ok, err := s.NextScheduledSpecificEvent("w")
+	if err != nil || !ok || !next.Equal(at(5)) {
+		t.Errorf("NextScheduledSpecificEvent(w) = %v, %v, %v want %v", next, ok, err, at(5))
+	}
+
+	if err := s.Unschedule("w"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.NextScheduledSpecificEvent("w"); err != nil || ok {
+		t.Errorf("NextScheduledSpecificEvent(w) after Unschedule = %v, %v", ok, err)
+	}
+	if _, ok, err := s.NextScheduledSpecificEvent("v"); err != nil || !ok {
+		t.Errorf("NextScheduledSpecificEvent(v) after Unschedule(w) = %v, %v", ok, err)
+	}
+}
+
+func testAlertStates(t *testing.T, s storage.Store) {
+	state, err := s.GetAlertState("w/a/t")
+	if err != nil || state != nil {
+		t.Fatalf("GetAlertState() initially = %v, %v want nil", state, err)
+	}
+
+	if err := s.AcknowledgeAlert("w/a/t", "alice", at(0)); err != storage.ErrNotFiring {
+		t.Errorf("AcknowledgeAlert() without state = %v want ErrNotFiring", err)
+	}
+
+	firingSince := at(1)
+	state = &storage.AlertState{
+		TriggerPath:  "w/a/t",
+		FiringSince:  &firingSince,
+		FiringInput:  "too hot",
+		LastNotified: &firingSince,
+	}
+	if err := s.SetAlertState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.AcknowledgeAlert("w/a/t", "alice", at(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Updating the state of the same firing keeps the acknowledgement.
+	notified := at(3)
+	state.LastNotified = &notified
+	if err := s.SetAlertState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.GetAlertState("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Firing() || !got.FiringSince.Equal(at(1)) || got.FiringInput != "too hot" || !got.LastNotified.Equal(at(3)) || got.ResolvedAt != nil {
+		t.Errorf("GetAlertState() = %+v", got)
+	}
+	if got.Acknowledged == nil || !got.Acknowledged.Equal(at(2)) || got.AcknowledgedBy != "alice" {
+		t.Errorf("GetAlertState() acknowledgement = %v by %q want %v by alice", got.Acknowledged, got.AcknowledgedBy, at(2))
+	}
+
+	// Resolving clears it.
+	resolved := at(4)
+	state.FiringSince = nil
+	state.ResolvedAt = &resolved
+	if err := s.SetAlertState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = s.GetAlertState("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Firing() || !got.ResolvedAt.Equal(at(4)) || got.Acknowledged != nil || got.AcknowledgedBy != "" {
+		t.Errorf("GetAlertState() after resolving = %+v", got)
+	}
+
+	if err := s.AcknowledgeAlert("w/a/t", "alice", at(5)); err != storage.ErrNotFiring {
+		t.Errorf("AcknowledgeAlert() when resolved = %v want ErrNotFiring", err)
+	}
+}
+
+func testSilences(t *testing.T, s storage.Store) {
+	id1, err := s.CreateSilence(&storage.Silence{
+		PathPattern: "w/*/t",
+		Created:     at(0),
+		Expires:     at(60),
+		Author:      "alice",
+		Comment:     "maintenance",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := s.CreateSilence(&storage.Silence{
+		PathPattern: "v/*",
+		Created:     at(0),
+		Expires:     at(10),
+		Author:      "bob",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id1 == id2 {
+		t.Fatalf("CreateSilence() returned the same id twice: %d", id1)
+	}
+
+	silences, err := s.GetActiveSilences(at(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(silences) != 2 || silences[0].Id != id1 || silences[1].Id != id2 {
+		t.Fatalf("GetActiveSilences() = %+v want %d and %d", silences, id1, id2)
+	}
+	if silence := silences[0]; silence.PathPattern != "w/*/t" || !silence.Created.Equal(at(0)) || !silence.Expires.Equal(at(60)) || silence.Author != "alice" || silence.Comment != "maintenance" {
+		t.Errorf("GetActiveSilences()[0] = %+v", silence)
+	}
+
+	silences, err = s.GetActiveSilences(at(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(silences) != 1 || silences[0].Id != id1 {
+		t.Errorf("GetActiveSilences() after expiry = %+v want only %d", silences, id1)
+	}
+
+	if err := s.ExpireSilence(id1, at(20)); err != nil {
+		t.Fatal(err)
+	}
+	silences, err = s.GetActiveSilences(at(20))
+	if err != nil || len(silences) != 0 {
+		t.Errorf("GetActiveSilences() after ExpireSilence = %+v, %v want none", silences, err)
+	}
+
+	parent := insert(t, s, "w", at(0), true, "one", nil)
+	for i := 0; i < 2; i++ {
+		if recorded, err := s.RecordSuppressedFiring("w/a/t", parent, &id1, "silenced", "input", at(1)); err != nil || recorded != (i == 0) {
+			t.Errorf("RecordSuppressedFiring() #%d = %v, %v want %v", i, recorded, err, i == 0)
+		}
+	}
+	if recorded, err := s.RecordSuppressedFiring("w/a/t2", parent, nil, "acknowledged", "input", at(1)); err != nil || !recorded {
+		t.Errorf("RecordSuppressedFiring() without silence = %v, %v want recorded", recorded, err)
+	}
+}
+
+func testDedupKeys(t *testing.T, s storage.Store) {
+	last, err := s.GetTimeOfLatestDedupFiring("w/a/t", "k")
+	if err != nil || last != nil {
+		t.Fatalf("GetTimeOfLatestDedupFiring() initially = %v, %v want nil", last, err)
+	}
+
+	for _, minutes := range []int{1, 2} {
+		if err := s.RecordDedupFiring("w/a/t", "k", at(minutes)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	last, err = s.GetTimeOfLatestDedupFiring("w/a/t", "k")
+	if err != nil || last == nil || !last.Equal(at(2)) {
+		t.Errorf("GetTimeOfLatestDedupFiring() = %v, %v want %v", last, err, at(2))
+	}
+
+	last, err = s.GetTimeOfLatestDedupFiring("w/a/t", "other")
+	if err != nil || last != nil {
+		t.Errorf("GetTimeOfLatestDedupFiring(other) = %v, %v want nil", last, err)
+	}
+}
+
+func testDigests(t *testing.T, s storage.Store) {
+	state, err := s.GetDigestState("w/a/t")
+	if err != nil || state != nil {
+		t.Fatalf("GetDigestState() initially = %v, %v want nil", state, err)
+	}
+
+	root := insert(t, s, "w", at(0), true, "one", nil)
+	a1 := insert(t, s, "w/a", at(1), true, "a1", &root)
+	a2 := insert(t, s, "w/a", at(2), true, "a2", &root)
+
+	for _, exec := range []int64{a1, a1, a2} {
+		if err := s.AddDigestItem("w/a/t", exec, fmt.Sprintf("input %d", exec), at(3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, err := s.GetDigestItems("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].ExecutionId != a1 || items[1].ExecutionId != a2 {
+		t.Fatalf("GetDigestItems() = %+v want items for %d and %d", items, a1, a2)
+	}
+	if item := items[0]; !item.RootTime.Equal(at(0)) || !item.Collected.Equal(at(3)) || item.Input != fmt.Sprintf("input %d", a1) {
+		t.Errorf("GetDigestItems()[0] = %+v", item)
+	}
+
+	if err := s.DeleteDigestItems("w/a/t", items[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	items, err = s.GetDigestItems("w/a/t")
+	if err != nil || len(items) != 1 || items[0].ExecutionId != a2 {
+		t.Errorf("GetDigestItems() after delete = %+v, %v want only %d", items, err, a2)
+	}
+
+	for _, delivered := range []int{4, 5} {
+		state := &storage.DigestState{
+			TriggerPath:     "w/a/t",
+			LastExecutionId: a2,
+			LastDelivered:   at(delivered),
+		}
+		if err := s.SetDigestState(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state, err = s.GetDigestState("w/a/t")
+	if err != nil || state == nil || state.LastExecutionId != a2 || !state.LastDelivered.Equal(at(5)) {
+		t.Errorf("GetDigestState() = %+v, %v", state, err)
+	}
+}
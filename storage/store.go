@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/runner"
+)
+
+// Store is the storage layer of watcher. It is implemented by DB, on top of
+// either Postgres or SQLite, and by Memory.
+type Store interface {
+	Executions
+	WorkQueue
+	Series
+	Retention
+	Leases
+	SchedulingQueue
+	Alerts
+
+	Ping(timeout time.Duration) error
+
+	// WithContext returns a store using the same storage, whose operations
+	// are cancelled when the context is done.
+	WithContext(ctx context.Context) Store
+}
+
+// Executions stores the results of running the nodes. An execution of an
+// analysis or trigger has the execution it was run on as its parent, and
+// the execution of the watch at the top as its root.
+type Executions interface {
+	InsertExecution(path string, result *runner.Result, info *hostinfo.HostInfo, parent *int64) (int64, error)
+
+	// GetLatestExecutionIfChildless returns the execution of the node with
+	// the latest root time, unless the child node has already been run on it.
+	GetLatestExecutionIfChildless(path, childPath string) (*NodeRow, error)
+
+	GetLatestExecution(path string) (*NodeRow, error)
+	GetTimeOfLatestSuccessfulExecution(path string) (*time.Time, error)
+
+	// ScanExecutions calls the callback with each execution selected by
+	// the query, in order, without holding them all in memory. It stops at
+	// the first error returned by the callback, and returns it. The
+	// callback must not use the store.
+	ScanExecutions(query *ExecutionQuery, callback func(row *NodeRow) error) error
+
+	// QueryExecutions returns the executions selected by the query, in
+	// order. The query should have a limit, and be paged through with
+	// cursors.
+	QueryExecutions(query *ExecutionQuery) ([]*NodeRow, error)
+
+	// QueryExecutionResults returns every execution of the node, in order
+	// of root time.
+	QueryExecutionResults(path string) ([]*NodeRow, error)
+}
+
+// WorkQueue holds the pending work of running analyses on the successful
+// executions of their parents. Inserting an execution enqueues work for
+// each child of the node.
+type WorkQueue interface {
+	// SetChildren sets the analyses of every node, by path, replacing all
+	// of those set before. They are stored along with the work, so that
+	// executions inserted by any process (e.g. an importer) are enqueued.
+	SetChildren(children map[string][]string) error
+
+	// EnqueueChildlessExecutions enqueues work for every successful
+	// execution of the parent that the child has not been run on, e.g.
+	// executions from before the child was added, and returns how many
+	// items it enqueued. This scans every execution of the parent, so it
+	// is only done once for each new child: GetUnreconciledChildren
+	// returns the children it has not been done for, by the path of their
+	// parent, until SetChildReconciled is called.
+	EnqueueChildlessExecutions(parentPath, childPath string) (int64, error)
+	GetUnreconciledChildren() (map[string][]string, error)
+	SetChildReconciled(parentPath, childPath string) error
+
+	// ProcessWork claims a pending work item of the node, if there is one
+	// that is not claimed by another worker, and processes it. The result
+	// is stored as an execution of the node on the item's execution, and
+	// the item removed, together. If the worker goes away, the item can be
+	// claimed again, at the latest after the timeout.
+	ProcessWork(path string, timeout time.Duration, info *hostinfo.HostInfo, process ProcessFunc) (bool, error)
+
+	// GetPendingWork returns up to limit of the pending work items of the
+	// node, in the order they were enqueued, for a node that collects
+	// them rather than processing them one by one (under a lease), and
+	// DeleteWork removes the items it has collected.
+	GetPendingWork(path string, limit int) ([]*WorkItem, error)
+	DeleteWork(ids []int64) error
+}
+
+// Series holds the samples of metrics emitted by analyses in metrics mode,
+// which are stored with their executions.
+type Series interface {
+	// QuerySeries returns the points of each series of the metric selected
+	// by the query, ordered by series (their labels) and then by time.
+	QuerySeries(query *SeriesQuery) ([]*SeriesPoint, error)
+}
+
+// Retention prunes and compacts old executions of watches. Deleting an
+// execution also deletes every execution below it.
+type Retention interface {
+	// GetRetentionCutoffs finds the cutoffs of the policy for the watch
+	// once for each pass, by which GetPrunableExecutions pages through the
+	// executions to prune.
+	GetRetentionCutoffs(path string, policy *RetentionPolicy, now time.Time) (*RetentionCutoffs, error)
+	GetPrunableExecutions(path string, cutoffs *RetentionCutoffs, after *Cursor, limit int) ([]*PrunableExecution, error)
+	DeleteExecutions(ids []int64) error
+
+	GetCompactionRows(path string, from, before time.Time, limit int) ([]*CompactionRow, error)
+	CompactExecutions(keep int64, runs int, until time.Time, remove []int64) error
+
+	// DeleteUnusedBlobs deletes stored outputs that no execution refers to
+	// any longer.
+	DeleteUnusedBlobs(t time.Time, limit int) (int64, error)
+}
+
+// Lease is an exclusive claim on a key, which lasts until it is released
+// or its deadline passes (and expired leases are cleaned).
+type Lease interface {
+	// Renew moves the deadline of the lease, and returns false (and no
+	// error) if the lease has been lost, i.e. cleaned after it expired or
+	// broken.
+	Renew(deadline time.Time) (bool, error)
+	Release() error
+}
+
+// LeaseInfo describes a lease, for operators. The holder and the time the
+// lease was obtained are unknown for leases obtained by older versions.
+type LeaseInfo struct {
+	Id         int64
+	Key        string
+	Until      time.Time
+	Obtained   *time.Time
+	HolderHost string
+	HolderPid  int
+}
+
+// Leases coordinates work between several watcher instances.
+type Leases interface {
+	// TryObtainLease returns nil (and no error) if the key is already
+	// leased. The lease records this process as its holder.
+	TryObtainLease(key string, deadline time.Time) (Lease, error)
+	CleanLeases(t time.Time) error
+
+	// ListLeases returns every lease, in order of key.
+	ListLeases() ([]*LeaseInfo, error)
+
+	// BreakLease deletes the lease on the key, whoever holds it, and
+	// returns whether there was one. The holder finds out when it next
+	// renews the lease.
+	BreakLease(key string) (bool, error)
+
+	// WithLease runs the callback while holding a lease on the key, or
+	// does nothing if the key is already leased. The context is cancelled
+	// if the lease is found to be lost while the callback runs, but not
+	// merely because it cannot be renewed.
+	WithLease(key string, dur time.Duration, callback func(ctx context.Context) error) error
+}
+
+// SchedulingQueue holds the next scheduled time of each watch, at most one
+// per watch.
+type SchedulingQueue interface {
+	ScheduleEvent(path string, t time.Time) error
+	Unschedule(path string) error
+	NextScheduledSpecificEvent(path string) (time.Time, bool, error)
+}
+
+// Alerts stores the state of triggers: alert states and acknowledgements,
+// silences, suppressed firings, deduplication keys and digests.
+type Alerts interface {
+	GetAlertState(triggerPath string) (*AlertState, error)
+	SetAlertState(state *AlertState) error
+	AcknowledgeAlert(triggerPath, author string, t time.Time) error
+
+	CreateSilence(silence *Silence) (int64, error)
+	ExpireSilence(silenceId int64, t time.Time) error
+	GetActiveSilences(t time.Time) ([]*Silence, error)
+	// RecordSuppressedFiring records the first suppression of the trigger
+	// on the execution, and returns whether this was it.
+	RecordSuppressedFiring(triggerPath string, parent int64, silenceId *int64, reason, input string, t time.Time) (bool, error)
+
+	GetTimeOfLatestDedupFiring(triggerPath, key string) (*time.Time, error)
+	RecordDedupFiring(triggerPath, key string, t time.Time) error
+
+	GetDigestState(triggerPath string) (*DigestState, error)
+	SetDigestState(state *DigestState) error
+	AddDigestItem(triggerPath string, executionId int64, input string, t time.Time) error
+	GetDigestItems(triggerPath string) ([]*DigestItem, error)
+	DeleteDigestItems(triggerPath string, upToId int64) error
+}
+
+// WithLease implements Leases.WithLease in terms of TryObtainLease. The
+// lease is obtained for dur, and renewed for dur every third of that while
+// the callback runs, so that it outlives the callback however long it
+// takes. If the lease is found to be lost (broken, or cleaned and perhaps
+// taken by another holder), the context passed to the callback, which is
+// derived from ctx, is cancelled. While the lease cannot be renewed because
+// the database is unavailable, it is not: no other holder can take it
+// through the database either, and the work in progress can then still be
+// completed (and its result spooled).
+func WithLease(ctx context.Context, leases Leases, key string, dur time.Duration, callback func(ctx context.Context) error) error {
+	if Verbose {
+		log.Printf("WithLease(%q, %v)", key, dur)
+	}
+	now := time.Now()
+	deadline := now.Add(dur)
+	lease, err := leases.TryObtainLease(key, deadline)
+	if err != nil {
+		return err
+	}
+	if lease == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		keepLease(lease, key, deadline, dur, cancel, done)
+	}()
+
+	defer func() {
+		close(done)
+		<-heartbeatDone
+		cancel()
+
+		err := lease.Release()
+		if err != nil {
+			log.Printf("error: failed to release lease %q: %v", key, err)
+		}
+	}()
+
+	return callback(ctx)
+}
+
+// keepLease renews the lease until done is closed, or calls lost if the
+// lease is lost.
+func keepLease(lease Lease, key string, deadline time.Time, dur time.Duration, lost func(), done <-chan struct{}) {
+	ticker := time.NewTicker(dur / 3)
+	defer ticker.Stop()
+
+	expired := false
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		newDeadline := time.Now().Add(dur)
+		ok, err := lease.Renew(newDeadline)
+		if err == nil && ok {
+			deadline = newDeadline
+			expired = false
+			metricLeaseRenewals.Inc()
+			continue
+		}
+		if err != nil {
+			log.Printf("error renewing lease %q: %v", key, err)
+			if !expired && time.Now().After(deadline) {
+				log.Printf("lease %q has run out: carrying on until it can be renewed or is found to be lost", key)
+				expired = true
+			}
+			continue
+		}
+
+		log.Printf("lost lease %q", key)
+		metricLeasesLost.Inc()
+		lost()
+		return
+	}
+}
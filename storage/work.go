@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/runner"
+)
+
+// WorkItem is pending work: running a node on an execution of its parent.
+type WorkItem struct {
+	Id          int64
+	ExecutionId int64
+	Stdout      string
+}
+
+// ProcessFunc runs a node on a work item, returning the result to store
+// (which must not be nil), along with the samples of metrics in its output,
+// if any.
+type ProcessFunc func(item *WorkItem) (*runner.Result, []*Sample)
+
+// SetChildren records the analyses of each node in the database, replacing
+// all of those recorded before, so that inserting an execution enqueues
+// work for them in whichever process inserts it. The pending work of the
+// children that are gone is deleted.
+func (d *DB) SetChildren(children map[string][]string) error {
+	track := d.beginTracking("set-children")
+	tx, err := d.DB.BeginTx(track.ctx, nil)
+	if err != nil {
+		return track.Finish(err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT parent_path, child_path FROM node_children`)
+	if err != nil {
+		return track.Finish(err)
+	}
+	var old [][2]string
+	for rows.Next() {
+		var parent, child string
+		if err := rows.Scan(&parent, &child); err != nil {
+			rows.Close()
+			return track.Finish(err)
+		}
+		old = append(old, [2]string{parent, child})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return track.Finish(err)
+	}
+
+	kept := map[[2]string]bool{}
+	for parent, paths := range children {
+		for _, child := range paths {
+			kept[[2]string{parent, child}] = true
+		}
+	}
+
+	// Children that are kept keep whether they have been reconciled.
+	for _, pair := range old {
+		if kept[pair] {
+			continue
+		}
+		if _, err := tx.Exec(d.dialect.rebind(`DELETE FROM node_children WHERE parent_path = $1 AND child_path = $2`), pair[0], pair[1]); err != nil {
+			return track.Finish(err)
+		}
+	}
+	for pair := range kept {
+		_, err := tx.Exec(d.dialect.rebind(`
+			INSERT INTO node_children (parent_path, child_path)
+			VALUES ($1, $2)
+			ON CONFLICT (parent_path, child_path) DO NOTHING
+		`), pair[0], pair[1])
+		if err != nil {
+			return track.Finish(err)
+		}
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM pending_work
+		WHERE node_path NOT IN (SELECT child_path FROM node_children)
+	`)
+	if err != nil {
+		return track.Finish(err)
+	}
+
+	return track.Finish(tx.Commit())
+}
+
+// GetUnreconciledChildren returns the children recorded by SetChildren that
+// have not been marked as reconciled, by the path of their parent.
+func (d *DB) GetUnreconciledChildren() (map[string][]string, error) {
+	track := d.beginTracking("get-unreconciled-children")
+	rows, err := d.query(track.ctx, `
+		SELECT parent_path, child_path
+		FROM node_children
+		WHERE NOT reconciled
+		ORDER BY parent_path, child_path
+	`)
+	if err != nil {
+		return nil, track.Finish(err)
+	}
+	defer rows.Close()
+
+	rv := map[string][]string{}
+	for rows.Next() {
+		var parent, child string
+		if err := rows.Scan(&parent, &child); err != nil {
+			return nil, track.Finish(err)
+		}
+		rv[parent] = append(rv[parent], child)
+	}
+	return rv, track.Finish(rows.Err())
+}
+
+func (d *DB) SetChildReconciled(parentPath, childPath string) error {
+	_, err := d.wrappedExec("set-child-reconciled", `
+		UPDATE node_children
+		SET reconciled = TRUE
+		WHERE parent_path = $1 AND child_path = $2
+	`, parentPath, childPath)
+	return err
+}
+
+// enqueueWork enqueues work for each child of the node on the execution.
+func (d *DB) enqueueWork(tx *sql.Tx, path string, executionId int64, t time.Time) error {
+	_, err := tx.Exec(d.dialect.rebind(`
+		INSERT INTO pending_work
+			(node_path, execution_id, enqueued_utcmillis)
+		SELECT child_path, $2, $3
+		FROM node_children
+		WHERE parent_path = $1
+		ON CONFLICT (node_path, execution_id) DO NOTHING
+	`), path, executionId, toUTCMillis(t))
+	return err
+}
+
+// EnqueueChildlessExecutions enqueues work for every successful execution
+// of the parent that the child has not been run on.
+func (d *DB) EnqueueChildlessExecutions(parentPath, childPath string) (int64, error) {
+	result, err := d.wrappedExec("enqueue-childless-executions", `
+		INSERT INTO pending_work
+			(node_path, execution_id, enqueued_utcmillis)
+		SELECT $2, p.execution_id, $3
+		FROM program_executions AS p
+		WHERE p.node_path = $1
+		  AND p.success
+		  AND NOT EXISTS (SELECT 1 FROM program_executions AS c
+		                  WHERE c.parent_execution_id = p.execution_id
+		                    AND c.node_path = $2)
+		ON CONFLICT (node_path, execution_id) DO NOTHING
+	`, parentPath, childPath, toUTCMillis(time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (d *DB) GetPendingWork(path string, limit int) ([]*WorkItem, error) {
+	track := d.beginTracking("get-pending-work")
+	rows, err := d.query(track.ctx, `
+		SELECT w.work_id, w.execution_id, p.stdout, so.compression, so.data
+		FROM pending_work AS w
+		JOIN program_executions AS p ON p.execution_id = w.execution_id
+		LEFT OUTER JOIN output_blobs AS so ON so.blob_hash = p.stdout_hash
+		WHERE w.node_path = $1
+		ORDER BY w.work_id
+		LIMIT $2
+	`, path, limit)
+	if err != nil {
+		return nil, track.Finish(err)
+	}
+	defer rows.Close()
+
+	var rv []*WorkItem
+	for rows.Next() {
+		item := &WorkItem{}
+		var stdout output
+		if err := rows.Scan(&item.Id, &item.ExecutionId, &stdout.text, &stdout.compression, &stdout.data); err != nil {
+			return nil, track.Finish(err)
+		}
+		if item.Stdout, err = stdout.value(); err != nil {
+			return nil, track.Finish(err)
+		}
+		rv = append(rv, item)
+	}
+	return rv, track.Finish(rows.Err())
+}
+
+func (d *DB) DeleteWork(ids []int64) error {
+	track := d.beginTracking("delete-work")
+
+	tx, err := d.DB.BeginTx(track.ctx, nil)
+	if err != nil {
+		return track.Finish(err)
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		if _, err := tx.Exec(d.dialect.rebind(`DELETE FROM pending_work WHERE work_id = $1`), id); err != nil {
+			return track.Finish(err)
+		}
+	}
+
+	return track.Finish(tx.Commit())
+}
+
+// ProcessWork claims a pending work item of the node for the timeout and
+// processes it, storing the result and removing the item. No transaction
+// is open while the item is processed, as that could take a connection for
+// as long as the command runs; if the claim runs out first, the item is
+// processed again.
+func (d *DB) ProcessWork(path string, timeout time.Duration, info *hostinfo.HostInfo, process ProcessFunc) (bool, error) {
+	item, claimed, err := d.claimWork(path, timeout)
+	if item == nil || err != nil {
+		return claimed, err
+	}
+
+	result, samples := process(item)
+
+	track := d.beginTracking("finish-work")
+	tx, err := d.DB.BeginTx(track.ctx, nil)
+	if err != nil {
+		return false, track.Finish(err)
+	}
+	defer tx.Rollback()
+
+	if err := d.finishWork(tx, path, item, result, samples, info); err != nil {
+		return false, track.Finish(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, track.Finish(err)
+	}
+	countExecutionData(result)
+	return true, track.Finish(nil)
+}
+
+// claimWork claims the next unclaimed pending work item of the node for
+// the timeout, and returns it with its input. If the execution of the item
+// was deleted after it was claimed (and the item with it), it returns no
+// item, but that one was claimed.
+func (d *DB) claimWork(path string, timeout time.Duration) (*WorkItem, bool, error) {
+	track := d.beginTracking("claim-work")
+
+	// Postgres skips the rows being claimed by others, rather than waiting
+	// for them and then claiming the same row; the claim is checked again
+	// in case it does not.
+	skipLocked := ""
+	if d.dialect == dialectPostgres {
+		skipLocked = "FOR UPDATE SKIP LOCKED"
+	}
+
+	now := time.Now()
+	item := &WorkItem{}
+	err := d.queryRow(track.ctx, `
+		UPDATE pending_work
+		SET claimed_until_utcmillis = $3
+		WHERE work_id = (SELECT work_id FROM pending_work
+		                 WHERE node_path = $1
+		                   AND (claimed_until_utcmillis IS NULL OR claimed_until_utcmillis < $2)
+		                 ORDER BY work_id
+		                 LIMIT 1
+		                 `+skipLocked+`)
+		  AND (claimed_until_utcmillis IS NULL OR claimed_until_utcmillis < $2)
+		RETURNING work_id, execution_id
+	`, path, toUTCMillis(now), toUTCMillis(now.Add(timeout))).Scan(&item.Id, &item.ExecutionId)
+	if err == sql.ErrNoRows {
+		return nil, false, track.Finish(nil)
+	}
+	if err != nil {
+		return nil, false, track.Finish(err)
+	}
+
+	var stdout output
+	err = d.queryRow(track.ctx, `
+		SELECT p.stdout, so.compression, so.data
+		FROM program_executions AS p
+		LEFT OUTER JOIN output_blobs AS so ON so.blob_hash = p.stdout_hash
+		WHERE p.execution_id = $1
+	`, item.ExecutionId).Scan(&stdout.text, &stdout.compression, &stdout.data)
+	if err == sql.ErrNoRows {
+		return nil, true, track.Finish(nil)
+	}
+	if err != nil {
+		return nil, false, track.Finish(err)
+	}
+	if item.Stdout, err = stdout.value(); err != nil {
+		return nil, false, track.Finish(err)
+	}
+	return item, true, track.Finish(nil)
+}
+
+// finishWork stores the result of a work item, with its samples, and
+// removes the item.
+func (d *DB) finishWork(tx *sql.Tx, path string, item *WorkItem, result *runner.Result, samples []*Sample, info *hostinfo.HostInfo) error {
+	deleted, err := tx.Exec(d.dialect.rebind(`DELETE FROM pending_work WHERE work_id = $1`), item.Id)
+	if err != nil {
+		return err
+	}
+	if n, err := deleted.RowsAffected(); err != nil || n == 0 {
+		// The item was deleted with its execution, or its claim ran out
+		// and another worker finished it first.
+		return err
+	}
+
+	executionId, err := d.insertExecution(tx, path, result, info, &item.ExecutionId)
+	if err != nil {
+		return err
+	}
+	return d.insertSamples(tx, path, executionId, samples)
+}
@@ -0,0 +1,229 @@
+package supervisor
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	Verbose = false
+
+	// StableRuntime is how long a worker must run before a subsequent failure
+	// is no longer considered consecutive with the ones before it.
+	StableRuntime = 10 * time.Minute
+)
+
+var (
+	metricWorkerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "watcher",
+			Name:      "worker_state",
+			Help:      "Current state of supervised workers (1 for the current state, 0 otherwise)",
+		},
+		[]string{"node", "state"},
+	)
+
+	metricWorkerFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "worker_failures",
+			Help:      "Number of times a supervised worker has failed",
+		},
+		[]string{"node"},
+	)
+
+	metricWorkerConsecutiveFailures = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "watcher",
+			Name:      "worker_consecutive_failures",
+			Help:      "Number of failures of a supervised worker since it last ran stably",
+		},
+		[]string{"node"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(metricWorkerState)
+	prometheus.MustRegister(metricWorkerFailures)
+	prometheus.MustRegister(metricWorkerConsecutiveFailures)
+}
+
+type State string
+
+const (
+	StateRunning    State = "running"
+	StateBackingOff State = "backing-off"
+	StateFailed     State = "failed"
+	StateStopped    State = "stopped"
+)
+
+var allStates = []State{StateRunning, StateBackingOff, StateFailed, StateStopped}
+
+type WorkerStatus struct {
+	Node                string     `json:"node"`
+	State               State      `json:"state"`
+	Failures            int        `json:"failures"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+	NextRestart         *time.Time `json:"next_restart,omitempty"`
+}
+
+// Supervisor runs workers, restarting them with exponential backoff when
+// they fail. A worker that fails MaxFailures times in a row (without
+// running stably in between) is marked as permanently failed. A MaxFailures
+// of zero means that workers are restarted indefinitely.
+type Supervisor struct {
+	MaxFailures     int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+
+	mu      sync.Mutex
+	workers map[string]*WorkerStatus
+}
+
+func New(maxFailures int) *Supervisor {
+	return &Supervisor{
+		MaxFailures:     maxFailures,
+		InitialInterval: time.Second,
+		MaxInterval:     10 * time.Minute,
+		workers:         map[string]*WorkerStatus{},
+	}
+}
+
+func (s *Supervisor) setState(status *WorkerStatus, state State) {
+	status.State = state
+	for _, st := range allStates {
+		value := 0.0
+		if st == state {
+			value = 1.0
+		}
+		metricWorkerState.WithLabelValues(status.Node, string(st)).Set(value)
+	}
+}
+
+func (s *Supervisor) update(node string, f func(*WorkerStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s.workers[node])
+}
+
+// Go starts a supervised worker for the given node. The worker is restarted
+// whenever it returns an error; returning nil stops it for good.
+func (s *Supervisor) Go(node string, worker func() error) error {
+	s.mu.Lock()
+	if _, present := s.workers[node]; present {
+		s.mu.Unlock()
+		return fmt.Errorf("worker for node %q already started", node)
+	}
+	status := &WorkerStatus{Node: node}
+	s.workers[node] = status
+	s.setState(status, StateRunning)
+	s.mu.Unlock()
+
+	go s.supervise(node, worker)
+
+	return nil
+}
+
+// run runs the worker once, turning a panic into an error so that it is
+// handled like any other failure rather than killing the process.
+func run(worker func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("worker panicked: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return worker()
+}
+
+func (s *Supervisor) supervise(node string, worker func() error) {
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = s.InitialInterval
+	bo.MaxInterval = s.MaxInterval
+	bo.MaxElapsedTime = 0
+	bo.Reset()
+
+	for {
+		t0 := time.Now()
+		err := run(worker)
+		if err == nil {
+			log.Printf("worker %q stopped", node)
+			s.update(node, func(status *WorkerStatus) {
+				s.setState(status, StateStopped)
+			})
+			return
+		}
+
+		stable := time.Since(t0) >= StableRuntime
+		if stable {
+			bo.Reset()
+		}
+		delay := bo.NextBackOff()
+
+		permanent := false
+		s.update(node, func(status *WorkerStatus) {
+			now := time.Now()
+			if stable {
+				status.ConsecutiveFailures = 0
+			}
+			status.Failures++
+			status.ConsecutiveFailures++
+			status.LastError = err.Error()
+			status.LastFailure = &now
+
+			metricWorkerFailures.WithLabelValues(node).Inc()
+			metricWorkerConsecutiveFailures.WithLabelValues(node).Set(float64(status.ConsecutiveFailures))
+
+			if s.MaxFailures > 0 && status.ConsecutiveFailures >= s.MaxFailures {
+				permanent = true
+				status.NextRestart = nil
+				s.setState(status, StateFailed)
+				return
+			}
+
+			nextRestart := now.Add(delay)
+			status.NextRestart = &nextRestart
+			s.setState(status, StateBackingOff)
+		})
+
+		if permanent {
+			log.Printf("error: worker %q failed %d times in a row; giving up: %v", node, s.MaxFailures, err)
+			return
+		}
+
+		log.Printf("error: worker %q failed (restarting in %v): %v", node, delay, err)
+		time.Sleep(delay)
+
+		s.update(node, func(status *WorkerStatus) {
+			status.NextRestart = nil
+			s.setState(status, StateRunning)
+		})
+		if Verbose {
+			log.Printf("restarting worker %q", node)
+		}
+	}
+}
+
+// Status returns the status of every supervised worker, sorted by node.
+func (s *Supervisor) Status() []WorkerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rv []WorkerStatus
+	for _, status := range s.workers {
+		rv = append(rv, *status)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Node < rv[j].Node
+	})
+	return rv
+}
@@ -0,0 +1,102 @@
+package supervisor
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func waitForState(t *testing.T, s *Supervisor, node string, want State) WorkerStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, status := range s.Status() {
+			if status.Node == node && status.State == want {
+				return status
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("worker %q never reached state %q: %v", node, want, s.Status())
+	return WorkerStatus{}
+}
+
+func TestRestartsFailingWorker(t *testing.T) {
+	s := New(0)
+	s.InitialInterval = time.Millisecond
+
+	calls := 0
+	if err := s.Go("flaky", func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Go() = %v", err)
+	}
+
+	status := waitForState(t, s, "flaky", StateStopped)
+	if status.Failures != 2 {
+		t.Errorf("Failures = %d want 2", status.Failures)
+	}
+	if status.LastError != "transient" {
+		t.Errorf("LastError = %q want %q", status.LastError, "transient")
+	}
+}
+
+func TestGivesUpAfterMaxFailures(t *testing.T) {
+	s := New(3)
+	s.InitialInterval = time.Millisecond
+
+	if err := s.Go("broken", func() error {
+		return errors.New("permanent")
+	}); err != nil {
+		t.Fatalf("Go() = %v", err)
+	}
+
+	status := waitForState(t, s, "broken", StateFailed)
+	if status.ConsecutiveFailures != 3 {
+		t.Errorf("ConsecutiveFailures = %d want 3", status.ConsecutiveFailures)
+	}
+}
+
+func TestRecoversPanickingWorker(t *testing.T) {
+	s := New(0)
+	s.InitialInterval = time.Millisecond
+
+	calls := 0
+	if err := s.Go("panicky", func() error {
+		calls++
+		if calls < 2 {
+			panic("oops")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Go() = %v", err)
+	}
+
+	status := waitForState(t, s, "panicky", StateStopped)
+	if status.Failures != 1 {
+		t.Errorf("Failures = %d want 1", status.Failures)
+	}
+	if status.LastError != "panic: oops" {
+		t.Errorf("LastError = %q want %q", status.LastError, "panic: oops")
+	}
+}
+
+func TestRejectsDuplicateNode(t *testing.T) {
+	s := New(0)
+	block := make(chan struct{})
+	defer close(block)
+
+	worker := func() error {
+		<-block
+		return nil
+	}
+	if err := s.Go("node", worker); err != nil {
+		t.Fatalf("Go() = %v", err)
+	}
+	if err := s.Go("node", worker); err == nil {
+		t.Errorf("Go() with duplicate node = unexpected success")
+	}
+}
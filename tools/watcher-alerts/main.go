@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/steinarvk/watcher/alerts"
+	"github.com/steinarvk/watcher/dbconn"
+)
+
+var (
+	dbSecretsFilename = flag.String("db_secrets", "", "database secrets YAML file (or use WATCHER_DB_* environment variables)")
+	pathPattern       = flag.String("pattern", "", "trigger path (or path.Match pattern) to silence or acknowledge")
+	duration          = flag.Duration("duration", 0, "duration of silence")
+	until             = flag.String("until", "", "end of silence (RFC3339)")
+	author            = flag.String("author", "", "author of silence or acknowledgement (defaults to current user)")
+	comment           = flag.String("comment", "", "comment on silence")
+)
+
+const usage = `usage: watcher-alerts [flags] <command>
+
+commands:
+  silences        list active silences
+  silence         silence the triggers matching --pattern for --duration or --until
+  expire <id>     expire a silence
+  ack             acknowledge the firing trigger --pattern
+`
+
+func getAuthor() (string, error) {
+	if *author != "" {
+		return *author, nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("unable to determine author (use --author): %v", err)
+	}
+	return u.Username, nil
+}
+
+func printJSON(value interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(value)
+}
+
+func mainCore() error {
+	if flag.NArg() == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return errors.New("missing command")
+	}
+
+	db, err := dbconn.Connect(*dbSecretsFilename)
+	if err != nil {
+		return err
+	}
+
+	switch cmd := flag.Arg(0); cmd {
+	case "silences":
+		silences, err := db.GetActiveSilences(time.Now())
+		if err != nil {
+			return err
+		}
+		return printJSON(silences)
+
+	case "silence":
+		var t time.Time
+		switch {
+		case *duration != 0 && *until != "":
+			return errors.New("--duration and --until are mutually exclusive")
+		case *duration != 0:
+			t = time.Now().Add(*duration)
+		case *until != "":
+			t, err = time.Parse(time.RFC3339, *until)
+			if err != nil {
+				return fmt.Errorf("invalid --until %q: %v", *until, err)
+			}
+		default:
+			return errors.New("missing required flag: --duration or --until")
+		}
+
+		who, err := getAuthor()
+		if err != nil {
+			return err
+		}
+
+		silence, err := alerts.NewSilence(db, *pathPattern, t, who, *comment)
+		if err != nil {
+			return err
+		}
+		return printJSON(silence)
+
+	case "expire":
+		if flag.NArg() != 2 {
+			return errors.New("usage: watcher-alerts expire <id>")
+		}
+		id, err := strconv.ParseInt(flag.Arg(1), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid silence id %q: %v", flag.Arg(1), err)
+		}
+		return db.ExpireSilence(id, time.Now())
+
+	case "ack":
+		if *pathPattern == "" {
+			return errors.New("missing required flag: --pattern")
+		}
+		who, err := getAuthor()
+		if err != nil {
+			return err
+		}
+		return db.AcknowledgeAlert(*pathPattern, who, time.Now())
+
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	os.Unsetenv("PGPASSFILE")
+
+	if err := mainCore(); err != nil {
+		log.Fatalf("fatal: %v", err)
+	}
+}
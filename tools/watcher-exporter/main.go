@@ -1,83 +1,117 @@
 package main
 
 import (
-	"database/sql"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
-	"github.com/steinarvk/watcher/secrets"
+	"github.com/steinarvk/watcher/dbconn"
 	"github.com/steinarvk/watcher/storage"
 )
 
 var (
-	dbSecretsFilename = flag.String("db_secrets", "", "database secrets YAML file")
+	dbSecretsFilename = flag.String("db_secrets", "", "database secrets YAML file (or use WATCHER_DB_* environment variables)")
 	nodePath          = flag.String("node_path", "", "path of node to import")
 	showFailures      = flag.Bool("show_failures", false, "show output of failed commands")
 	changesOnly       = flag.Bool("changes_only", false, "only show changes")
 	trimValues        = flag.Bool("trim_shown_values", true, "trim spaces from beginning and end of shown values")
 	humanReadable     = flag.Bool("human_readable", false, "format timestamps for human-readability")
+	fromFlag          = flag.String("from", "", "only export executions from this time (RFC3339)")
+	beforeFlag        = flag.String("before", "", "only export executions before this time (RFC3339)")
+	metricName        = flag.String("metric", "", "export this metric of a node in metrics mode, instead of its output")
+	bucketFlag        = flag.Duration("bucket", 0, "with --metric, roll the samples up into buckets of this length (min, max, avg and count)")
 )
 
-type DatabaseSecrets struct {
-	Host     string `yaml:"host"`
-	Port     int    `yaml:"port"`
-	Database string `yaml:"database"`
-	User     string `yaml:"user"`
-	Password string `yaml:"password"`
+func formatTime(t time.Time) string {
+	if *humanReadable {
+		return t.Format(time.RFC3339)
+	}
+	return fmt.Sprint(t.UnixNano() / int64(time.Millisecond))
 }
 
-func connectDB(secretsFilename string) (*storage.DB, error) {
-	dbSecrets := DatabaseSecrets{}
-	if err := secrets.FromYAML(secretsFilename, &dbSecrets); err != nil {
-		return nil, err
+func formatLabels(labels map[string]string) string {
+	var parts []string
+	for key, value := range labels {
+		parts = append(parts, key+"="+value)
 	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
 
-	opts := fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s sslmode=require", dbSecrets.Host, dbSecrets.Port, dbSecrets.Database, dbSecrets.User, dbSecrets.Password)
-
-	dbSecrets.Password = ""
-	sanitizedDBCreds := dbSecrets
-
-	db, err := sql.Open("postgres", opts)
+// exportSeries prints the points of each series of the metric, one per
+// line, with the labels of the series.
+func exportSeries(db storage.Store, query *storage.SeriesQuery) error {
+	points, err := db.QuerySeries(query)
 	if err != nil {
-		return nil, fmt.Errorf("unable to connect to DB (credentials: %v): %v", sanitizedDBCreds, err)
+		return err
 	}
-
-	opts = ""
-
-	return &storage.DB{db}, nil
+	for _, point := range points {
+		if query.Bucket > 0 {
+			fmt.Printf("%s\t%s\t%v\t%v\t%v\t%d\n", formatTime(point.Time), formatLabels(point.Labels), point.Min, point.Max, point.Avg, point.Count)
+		} else {
+			fmt.Printf("%s\t%s\t%v\n", formatTime(point.Time), formatLabels(point.Labels), point.Avg)
+		}
+	}
+	return nil
 }
 
-func mainCore() error {
-	if *dbSecretsFilename == "" {
-		return errors.New("missing required flag: --db_secrets")
+func parseOptionalTime(name, s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
 	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --%s %q: %v", name, s, err)
+	}
+	return t, nil
+}
 
+func mainCore() error {
 	if *nodePath == "" {
 		return errors.New("missing required flag: --node_path")
 	}
 
-	db, err := connectDB(*dbSecretsFilename)
+	db, err := dbconn.Connect(*dbSecretsFilename)
 	if err != nil {
 		return err
 	}
 
-	rows, err := db.QueryExecutionResults(*nodePath)
+	from, err := parseOptionalTime("from", *fromFlag)
+	if err != nil {
+		return err
+	}
+	before, err := parseOptionalTime("before", *beforeFlag)
 	if err != nil {
 		return err
 	}
 
-	var lastValue *string
+	if *metricName != "" {
+		return exportSeries(db, &storage.SeriesQuery{
+			Path:   *nodePath,
+			Name:   *metricName,
+			From:   from,
+			Before: before,
+			Bucket: *bucketFlag,
+		})
+	}
 
-	for _, row := range rows {
-		if !*showFailures && !row.Result.Success {
-			continue
-		}
+	query := &storage.ExecutionQuery{
+		Path:           *nodePath,
+		From:           from,
+		Before:         before,
+		SuccessfulOnly: !*showFailures,
+	}
 
+	var lastValue *string
+
+	// Executions are streamed, so that exporting a long history does not
+	// need it all in memory.
+	return db.ScanExecutions(query, func(row *storage.NodeRow) error {
 		showValue := row.Result.Stdout
 		if *trimValues {
 			showValue = strings.TrimSpace(showValue)
@@ -89,20 +123,14 @@ func mainCore() error {
 
 		if *changesOnly {
 			if lastValue != nil && *lastValue == showValue {
-				continue
+				return nil
 			}
 			lastValue = &showValue
 		}
 
-		if *humanReadable {
-			fmt.Printf("%s\t%s\n", row.RootTime.Format(time.RFC3339), showValue)
-		} else {
-			ms := row.RootTime.UnixNano() / int64(time.Millisecond)
-			fmt.Printf("%v\t%s\n", ms, showValue)
-		}
-	}
-
-	return nil
+		fmt.Printf("%s\t%s\n", formatTime(row.RootTime), showValue)
+		return nil
+	})
 }
 
 func main() {
@@ -1,9 +1,7 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -12,44 +10,18 @@ import (
 	"os"
 	"time"
 
-	"github.com/steinarvk/secrets"
+	"github.com/steinarvk/watcher/dbconn"
 	"github.com/steinarvk/watcher/hostinfo"
 	"github.com/steinarvk/watcher/runner"
-	"github.com/steinarvk/watcher/storage"
 )
 
 var (
-	dbSecretsFilename = flag.String("db_secrets", "", "database secrets YAML file")
+	dbSecretsFilename = flag.String("db_secrets", "", "database secrets YAML file (or use WATCHER_DB_* environment variables)")
 	listenAddress     = flag.String("listen_address", "127.0.0.1:5753", "address on which to listen")
 )
 
-func connectDB(secretsFilename string) (*storage.DB, error) {
-	dbSecrets := secrets.Postgres{}
-	if err := secrets.FromYAML(secretsFilename, &dbSecrets); err != nil {
-		return nil, err
-	}
-
-	opts := fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s sslmode=require", dbSecrets.Host, dbSecrets.Port, dbSecrets.Database, dbSecrets.User, dbSecrets.Password)
-
-	dbSecrets.Password = ""
-	sanitizedDBCreds := dbSecrets
-
-	db, err := sql.Open("postgres", opts)
-	if err != nil {
-		return nil, fmt.Errorf("unable to connect to DB (credentials: %v): %v", sanitizedDBCreds, err)
-	}
-
-	opts = ""
-
-	return &storage.DB{db}, nil
-}
-
 func mainCore() error {
-	if *dbSecretsFilename == "" {
-		return errors.New("missing required flag: --db_secrets")
-	}
-
-	db, err := connectDB(*dbSecretsFilename)
+	db, err := dbconn.Connect(*dbSecretsFilename)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,136 @@
+package trigger
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/storage"
+)
+
+// condition decides whether a trigger fires, given the recent executions
+// of its parent.
+type condition struct {
+	name string
+
+	// failures is whether the condition is about failed executions. If not,
+	// a failed latest execution says nothing about the condition.
+	failures bool
+
+	// depth is the number of recent executions needed, and successfulOnly
+	// whether the failed ones are to be left out.
+	depth          int
+	successfulOnly bool
+
+	// eval returns whether the condition holds, and the input for the
+	// trigger. The recent executions are latest first.
+	eval func(recent []*storage.NodeRow) (string, bool)
+}
+
+func failureInput(item *storage.NodeRow) string {
+	if stderr := strings.TrimSpace(item.Result.Stderr); stderr != "" {
+		return stderr
+	}
+	return fmt.Sprintf("execution %d failed", item.Id)
+}
+
+func newCondition(spec *config.ConditionSpec) (*condition, error) {
+	if spec == nil {
+		spec = &config.ConditionSpec{}
+	}
+
+	switch {
+	case spec.Matches != "":
+		re, err := regexp.Compile(spec.Matches)
+		if err != nil {
+			return nil, err
+		}
+		return &condition{
+			name:  "matches",
+			depth: 1,
+			eval: func(recent []*storage.NodeRow) (string, bool) {
+				output := strings.TrimSpace(recent[0].Result.Stdout)
+				return output, re.MatchString(output)
+			},
+		}, nil
+
+	case spec.Changed:
+		return &condition{
+			name:           "changed",
+			depth:          2,
+			successfulOnly: true,
+			eval: func(recent []*storage.NodeRow) (string, bool) {
+				if len(recent) < 2 {
+					return "", false
+				}
+				output := strings.TrimSpace(recent[0].Result.Stdout)
+				return output, output != strings.TrimSpace(recent[1].Result.Stdout)
+			},
+		}, nil
+
+	case spec.Failed || spec.ConsecutiveFailures > 0:
+		n := spec.ConsecutiveFailures
+		if n == 0 {
+			n = 1
+		}
+		name := "failed"
+		if spec.ConsecutiveFailures > 0 {
+			name = "consecutive_failures"
+		}
+		return &condition{
+			name:     name,
+			failures: true,
+			depth:    n,
+			eval: func(recent []*storage.NodeRow) (string, bool) {
+				if len(recent) < n {
+					return "", false
+				}
+				for _, item := range recent {
+					if item.Result.Success {
+						return "", false
+					}
+				}
+				return failureInput(recent[0]), true
+			},
+		}, nil
+
+	default:
+		return &condition{
+			name:  "nonempty",
+			depth: 1,
+			eval: func(recent []*storage.NodeRow) (string, bool) {
+				output := strings.TrimSpace(recent[0].Result.Stdout)
+				return output, output != ""
+			},
+		}, nil
+	}
+}
+
+// evaluate evaluates the condition at latest, the latest execution of the
+// parent. It returns ok=false if that execution says nothing about the
+// condition, or if a newer execution has appeared in the meantime.
+func (c *condition) evaluate(db storage.Store, parentPath string, latest *storage.NodeRow) (input string, holds, ok bool, err error) {
+	if !latest.Result.Success && !c.failures {
+		return "", false, false, nil
+	}
+
+	recent := []*storage.NodeRow{latest}
+	if c.depth > 1 {
+		recent, err = db.QueryExecutions(&storage.ExecutionQuery{
+			Path:           parentPath,
+			SuccessfulOnly: c.successfulOnly,
+			Descending:     true,
+			Limit:          c.depth,
+		})
+		if err != nil {
+			return "", false, false, err
+		}
+		if len(recent) == 0 || recent[0].Id != latest.Id {
+			return "", false, false, nil
+		}
+	}
+
+	input, holds = c.eval(recent)
+	return input, holds, true, nil
+}
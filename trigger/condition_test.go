@@ -0,0 +1,60 @@
+package trigger
+
+import (
+	"testing"
+
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/storage"
+)
+
+func row(success bool, stdout, stderr string) *storage.NodeRow {
+	rv := &storage.NodeRow{}
+	rv.Result.Success = success
+	rv.Result.Stdout = stdout
+	rv.Result.Stderr = stderr
+	return rv
+}
+
+func TestConditions(t *testing.T) {
+	testcases := []struct {
+		spec      config.ConditionSpec
+		recent    []*storage.NodeRow
+		wantInput string
+		wantHolds bool
+	}{
+		{config.ConditionSpec{}, []*storage.NodeRow{row(true, " hello\n", "")}, "hello", true},
+		{config.ConditionSpec{Nonempty: true}, []*storage.NodeRow{row(true, "\n", "")}, "", false},
+		{config.ConditionSpec{Matches: "^temp=[89]"}, []*storage.NodeRow{row(true, "temp=91", "")}, "temp=91", true},
+		{config.ConditionSpec{Matches: "^temp=[89]"}, []*storage.NodeRow{row(true, "temp=51", "")}, "temp=51", false},
+		{config.ConditionSpec{Changed: true}, []*storage.NodeRow{row(true, "b", ""), row(true, "a", "")}, "b", true},
+		{config.ConditionSpec{Changed: true}, []*storage.NodeRow{row(true, "a", ""), row(true, "a\n", "")}, "a", false},
+		{config.ConditionSpec{Changed: true}, []*storage.NodeRow{row(true, "a", "")}, "", false},
+		{config.ConditionSpec{Failed: true}, []*storage.NodeRow{row(false, "", "oops\n")}, "oops", true},
+		{config.ConditionSpec{Failed: true}, []*storage.NodeRow{row(true, "fine", "")}, "", false},
+		{config.ConditionSpec{ConsecutiveFailures: 2}, []*storage.NodeRow{row(false, "", "b"), row(false, "", "a")}, "b", true},
+		{config.ConditionSpec{ConsecutiveFailures: 2}, []*storage.NodeRow{row(false, "", "b"), row(true, "", "")}, "", false},
+		{config.ConditionSpec{ConsecutiveFailures: 3}, []*storage.NodeRow{row(false, "", "b"), row(false, "", "a")}, "", false},
+	}
+	for _, testcase := range testcases {
+		cond, err := newCondition(&testcase.spec)
+		if err != nil {
+			t.Errorf("newCondition(%v) = err: %v", testcase.spec, err)
+			continue
+		}
+		input, holds := cond.eval(testcase.recent)
+		if input != testcase.wantInput || holds != testcase.wantHolds {
+			t.Errorf("condition %v on %d execution(s) = (%q, %v) want (%q, %v)", testcase.spec, len(testcase.recent), input, holds, testcase.wantInput, testcase.wantHolds)
+		}
+	}
+}
+
+func TestConditionIgnoresFailures(t *testing.T) {
+	cond, err := newCondition(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, ok, err := cond.evaluate(nil, "parent", row(false, "output", "error"))
+	if err != nil || ok {
+		t.Errorf("evaluate(failed execution) = (ok=%v, err=%v) want (false, nil)", ok, err)
+	}
+}
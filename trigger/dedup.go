@@ -0,0 +1,107 @@
+package trigger
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/steinarvk/watcher/config"
+)
+
+// dedupKeyFunc extracts the deduplication keys from a trigger input.
+type dedupKeyFunc func(input string) ([]string, error)
+
+func newDedupKeyFunc(spec *config.DedupKeySpec) (dedupKeyFunc, error) {
+	if spec == nil {
+		return nil, nil
+	}
+
+	if spec.Regex != "" {
+		re, err := regexp.Compile(spec.Regex)
+		if err != nil {
+			return nil, err
+		}
+		return func(input string) ([]string, error) {
+			return regexKeys(re, input), nil
+		}, nil
+	}
+
+	var path []string
+	if trimmed := strings.Trim(spec.JSON, "."); trimmed != "" {
+		path = strings.Split(trimmed, ".")
+	}
+	return func(input string) ([]string, error) {
+		return jsonKeys(path, input)
+	}, nil
+}
+
+func regexKeys(re *regexp.Regexp, input string) []string {
+	var rv []string
+	seen := map[string]bool{}
+	for _, match := range re.FindAllStringSubmatch(input, -1) {
+		key := match[0]
+		if len(match) > 1 {
+			key = match[1]
+		}
+		if !seen[key] {
+			seen[key] = true
+			rv = append(rv, key)
+		}
+	}
+	return rv
+}
+
+func jsonKeyString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
+
+func jsonKeys(path []string, input string) ([]string, error) {
+	var value interface{}
+	dec := json.NewDecoder(strings.NewReader(input))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return nil, fmt.Errorf("input is not JSON: %v", err)
+	}
+
+	for _, component := range path {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot look up %q: not an object", component)
+		}
+		value, ok = obj[component]
+		if !ok {
+			return nil, fmt.Errorf("no field %q", component)
+		}
+	}
+
+	var rv []string
+	switch v := value.(type) {
+	case nil:
+	case map[string]interface{}:
+		for k := range v {
+			rv = append(rv, k)
+		}
+		sort.Strings(rv)
+	case []interface{}:
+		seen := map[string]bool{}
+		for _, x := range v {
+			key := jsonKeyString(x)
+			if !seen[key] {
+				seen[key] = true
+				rv = append(rv, key)
+			}
+		}
+	default:
+		rv = append(rv, jsonKeyString(v))
+	}
+	return rv, nil
+}
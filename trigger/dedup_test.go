@@ -0,0 +1,59 @@
+package trigger
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/steinarvk/watcher/config"
+)
+
+func TestDedupKeys(t *testing.T) {
+	testcases := []struct {
+		spec  config.DedupKeySpec
+		input string
+		want  []string
+	}{
+		{config.DedupKeySpec{JSON: "."}, `{"b": 1, "a": 2}`, []string{"a", "b"}},
+		{config.DedupKeySpec{JSON: "threads"}, `{"threads": ["x", "y", "x"]}`, []string{"x", "y"}},
+		{config.DedupKeySpec{JSON: "a.id"}, `{"a": {"id": 42}}`, []string{"42"}},
+		{config.DedupKeySpec{JSON: "."}, `null`, nil},
+		{config.DedupKeySpec{Regex: `thread/(\d+)`}, "thread/1 thread/2 thread/1", []string{"1", "2"}},
+		{config.DedupKeySpec{Regex: `[a-z]+`}, "foo 42 bar", []string{"foo", "bar"}},
+	}
+	for _, testcase := range testcases {
+		f, err := newDedupKeyFunc(&testcase.spec)
+		if err != nil {
+			t.Errorf("newDedupKeyFunc(%v) = err: %v", testcase.spec, err)
+			continue
+		}
+		got, err := f(testcase.input)
+		if err != nil {
+			t.Errorf("dedup keys %v of %q = err: %v", testcase.spec, testcase.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, testcase.want) {
+			t.Errorf("dedup keys %v of %q = %q want %q", testcase.spec, testcase.input, got, testcase.want)
+		}
+	}
+}
+
+func TestDedupKeysErrors(t *testing.T) {
+	testcases := []struct {
+		spec  config.DedupKeySpec
+		input string
+	}{
+		{config.DedupKeySpec{JSON: "."}, `{'a': 1}`},
+		{config.DedupKeySpec{JSON: "a"}, `[1, 2]`},
+		{config.DedupKeySpec{JSON: "a.b"}, `{"a": {"c": 1}}`},
+	}
+	for _, testcase := range testcases {
+		f, err := newDedupKeyFunc(&testcase.spec)
+		if err != nil {
+			t.Errorf("newDedupKeyFunc(%v) = err: %v", testcase.spec, err)
+			continue
+		}
+		if got, err := f(testcase.input); err == nil {
+			t.Errorf("dedup keys %v of %q = %q want error", testcase.spec, testcase.input, got)
+		}
+	}
+}
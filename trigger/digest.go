@@ -0,0 +1,247 @@
+package trigger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/scheduler"
+	"github.com/steinarvk/watcher/storage"
+)
+
+const (
+	digestCollectBatchSize = 1000
+)
+
+// digest is a trigger that collects the nonempty outputs of its parent and
+// delivers them together on a schedule.
+type digest struct {
+	run      *command
+	schedule scheduler.Scheduler
+	format   string
+	template *template.Template
+}
+
+func newDigest(spec *config.TriggerSpec) (*digest, error) {
+	run, err := newCommand(spec.Run)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule, err := spec.Digest.Schedule.ToSpec()
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &digest{
+		run:      run,
+		schedule: schedule,
+		format:   spec.Digest.GetFormat(),
+	}
+
+	if rv.format == config.DigestFormatText {
+		text := spec.Digest.Template
+		if text == "" {
+			text = config.DefaultDigestTemplate
+		}
+		rv.template, err = template.New("digest").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rv, nil
+}
+
+// digestEntry is an item of a digest, as given to the command in the JSON
+// format or to the template in the text format. Value holds the input as
+// JSON, if it is valid JSON.
+type digestEntry struct {
+	ExecutionId int64           `json:"execution_id"`
+	RootTime    time.Time       `json:"root_time"`
+	Input       string          `json:"input"`
+	Value       json.RawMessage `json:"value,omitempty"`
+}
+
+func (d *digest) render(triggerPath string, items []*storage.DigestItem) (string, error) {
+	var entries []digestEntry
+	for _, item := range items {
+		entry := digestEntry{
+			ExecutionId: item.ExecutionId,
+			RootTime:    item.RootTime,
+			Input:       item.Input,
+		}
+		if json.Valid([]byte(item.Input)) {
+			entry.Value = json.RawMessage(item.Input)
+		}
+		entries = append(entries, entry)
+	}
+
+	if d.format == config.DigestFormatJSON {
+		data, err := json.Marshal(entries)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+
+	var buf bytes.Buffer
+	err := d.template.Execute(&buf, struct {
+		TriggerPath string
+		Items       []digestEntry
+	}{triggerPath, entries})
+	if err != nil {
+		return "", fmt.Errorf("error rendering digest template: %v", err)
+	}
+	return buf.String(), nil
+}
+
+// collect adds the new nonempty outputs of the parent to the digest. They
+// are taken from the work queue, which the parent's executions are added to
+// as they are stored, rather than found by their ids: ids are allocated
+// before the executions are committed, so not necessarily in the order they
+// become visible.
+func (d *digest) collect(w *worker, state *storage.DigestState) error {
+	for {
+		items, err := w.db.GetPendingWork(w.path, digestCollectBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			return nil
+		}
+
+		now := time.Now()
+		var ids []int64
+		for _, item := range items {
+			if input := strings.TrimSpace(item.Stdout); input != "" {
+				// Adding an item is idempotent, so an item collected
+				// again after a failure is not added twice.
+				if err := w.db.AddDigestItem(w.path, item.ExecutionId, input, now); err != nil {
+					return err
+				}
+			}
+			ids = append(ids, item.Id)
+			if item.ExecutionId > state.LastExecutionId {
+				state.LastExecutionId = item.ExecutionId
+			}
+		}
+
+		if err := w.db.DeleteWork(ids); err != nil {
+			return err
+		}
+		if err := w.db.SetDigestState(state); err != nil {
+			return err
+		}
+	}
+}
+
+// discard drops the outputs of the parent queued for the digest.
+func (d *digest) discard(w *worker) error {
+	for {
+		items, err := w.db.GetPendingWork(w.path, digestCollectBatchSize)
+		if err != nil || len(items) == 0 {
+			return err
+		}
+		var ids []int64
+		for _, item := range items {
+			ids = append(ids, item.Id)
+		}
+		if err := w.db.DeleteWork(ids); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *digest) deliver(w *worker, state *storage.DigestState) error {
+	items, err := w.db.GetDigestItems(w.path)
+	if err != nil {
+		return err
+	}
+
+	if len(items) > 0 {
+		last := items[len(items)-1]
+
+		input, err := d.render(w.path, items)
+		if err != nil {
+			return err
+		}
+
+		silenced, err := w.silenced(last.ExecutionId, input)
+		if err != nil {
+			return err
+		}
+
+		if !silenced {
+			log.Printf("running digest trigger %q with %d item(s)", w.path, len(items))
+
+			metadata := map[string]string{
+				"trigger_path": w.path,
+				"parent_path":  w.parentPath,
+				"event":        "digest",
+				"execution_id": strconv.FormatInt(last.ExecutionId, 10),
+				"root_time":    last.RootTime.Format(time.RFC3339),
+				"item_count":   strconv.Itoa(len(items)),
+			}
+			ok, err := w.run(d.run, input, last.ExecutionId, metadata)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				// Keep the items, and try again at the next wakeup.
+				return nil
+			}
+		}
+
+		if err := w.db.DeleteDigestItems(w.path, last.Id); err != nil {
+			return err
+		}
+	}
+
+	state.LastDelivered = time.Now()
+	return w.db.SetDigestState(state)
+}
+
+func (d *digest) check(w *worker) error {
+	return w.db.WithLease("digest:"+w.path, d.run.timeout+time.Second, func(ctx context.Context) error {
+		w := w.leased(ctx)
+		state, err := w.db.GetDigestState(w.path)
+		if err != nil {
+			return err
+		}
+
+		if state == nil {
+			// Start collecting from now on, rather than digesting the
+			// outputs queued before the trigger was first run.
+			state = &storage.DigestState{
+				TriggerPath:   w.path,
+				LastDelivered: time.Now(),
+			}
+			if err := d.discard(w); err != nil {
+				return err
+			}
+			log.Printf("starting digest trigger %q", w.path)
+			return w.db.SetDigestState(state)
+		}
+
+		if err := d.collect(w, state); err != nil {
+			return err
+		}
+
+		if due := d.schedule.ScheduleNext(state.LastDelivered); time.Now().Before(due) {
+			if Verbose {
+				log.Printf("digest trigger %q next due at %v", w.path, due)
+			}
+			return nil
+		}
+
+		return d.deliver(w, state)
+	})
+}
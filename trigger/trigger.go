@@ -1,15 +1,20 @@
 package trigger
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/cenkalti/backoff"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/steinarvk/watcher/alerts"
 	"github.com/steinarvk/watcher/config"
 	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/notify"
 	"github.com/steinarvk/watcher/runner"
 	"github.com/steinarvk/watcher/scheduler"
 	"github.com/steinarvk/watcher/storage"
@@ -98,6 +103,24 @@ var (
 		},
 		[]string{"name", "status"},
 	)
+
+	metricTriggerSuppressed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "trigger_commands_suppressed",
+			Help:      "Number of trigger commands suppressed (by reason)",
+		},
+		[]string{"name", "reason"},
+	)
+
+	metricAlertFiring = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "watcher",
+			Name:      "alert_firing",
+			Help:      "Whether a stateful trigger is firing (1) or not (0)",
+		},
+		[]string{"trigger"},
+	)
 )
 
 func init() {
@@ -106,113 +129,588 @@ func init() {
 	prometheus.MustRegister(metricTriggerRuns)
 	prometheus.MustRegister(metricTriggerRunsFinished)
 	prometheus.MustRegister(metricTriggerRunLatency)
+	prometheus.MustRegister(metricTriggerSuppressed)
+	prometheus.MustRegister(metricAlertFiring)
 }
 
-func TriggerWorker(db *storage.DB, parentPath, path string, spec *config.TriggerSpec, notify <-chan struct{}, nodesStored chan<- string) error {
-	log.Printf("starting trigger-worker for node %q", path)
+// command is a trigger command converted to a runner spec or a notifier,
+// along with its timeout.
+type command struct {
+	spec     runner.Spec
+	notifier notify.Notifier
+	timeout  time.Duration
+}
 
-	metricTriggersStarted.WithLabelValues(path).Inc()
+func newCommand(cfg *config.TriggerCommand) (*command, error) {
+	if cfg == nil {
+		return nil, nil
+	}
 
-	info, err := hostinfo.Get()
+	runTimeout, err := cfg.GetTimeout()
 	if err != nil {
-		return fmt.Errorf("error getting hostinfo: %v", err)
+		return nil, err
 	}
 
-	triggerPeriod, err := time.ParseDuration(spec.Period)
-	if err != nil {
-		return err
+	if cfg.Notify != nil {
+		notifier, err := cfg.Notify.ToNotifier()
+		if err != nil {
+			return nil, fmt.Errorf("invalid notify config: %v", err)
+		}
+		return &command{notifier: notifier, timeout: runTimeout}, nil
 	}
 
-	runSpec, err := spec.Run.ToSpec()
+	runSpec, err := cfg.ToSpec()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if !runSpec.ShouldRun() {
-		return errors.New("do-not-run for trigger makes no sense")
+		return nil, errors.New("do-not-run for trigger makes no sense")
 	}
 
-	runTimeout, err := spec.Run.GetTimeout()
+	return &command{spec: runSpec, timeout: runTimeout}, nil
+}
+
+// execute runs the command, or sends the notification. The description of
+// the delivery returned by a notifier is stored as stdout, and an error
+// sending it as stderr.
+func (c *command) execute(ctx context.Context, input string, metadata map[string]string) (*runner.Result, error) {
+	if c.notifier == nil {
+		return runner.Run(c.spec, runner.WithContext(ctx), runner.WithTimeout(c.timeout), runner.WithInput(input), runner.WithMetadata(metadata))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	t0 := time.Now()
+	stdout, err := c.notifier.Notify(ctx, &notify.Message{
+		Input:    input,
+		Metadata: metadata,
+	})
+	rv := &runner.Result{
+		Start:   t0,
+		Stop:    time.Now(),
+		Success: err == nil,
+		Stdout:  stdout,
+	}
 	if err != nil {
-		return err
+		rv.Stderr = err.Error() + "\n"
 	}
+	return rv, err
+}
 
-	checkScheduler := scheduler.UniformRandom{
-		time.Minute,
-		2 * time.Minute,
+type worker struct {
+	db          storage.Store
+	parentPath  string
+	path        string
+	info        *hostinfo.HostInfo
+	nodesStored chan<- string
+
+	ctx context.Context
+}
+
+// leased returns a copy of the worker whose commands and queries are
+// cancelled when the context of a lease it holds is done.
+func (w *worker) leased(ctx context.Context) *worker {
+	rv := *w
+	rv.db = w.db.WithContext(ctx)
+	rv.ctx = ctx
+	return &rv
+}
+
+func (w *worker) context() context.Context {
+	if w.ctx == nil {
+		return context.Background()
+	}
+	return w.ctx
+}
+
+// metadata describes why a trigger command is being run. It is available
+// to notifier templates and (as environment variables) to programs.
+func (w *worker) metadata(event string, item *storage.NodeRow) map[string]string {
+	return map[string]string{
+		"trigger_path": w.path,
+		"parent_path":  w.parentPath,
+		"event":        event,
+		"execution_id": strconv.FormatInt(item.Id, 10),
+		"root_time":    item.RootTime.Format(time.RFC3339),
+	}
+}
+
+// run runs a trigger command and stores its result as an execution of the
+// trigger, with the analysis execution that caused it as the parent. It
+// returns whether the command succeeded.
+func (w *worker) run(cmd *command, input string, parent int64, metadata map[string]string) (bool, error) {
+	track := beginTracking(w.path)
+	result, err := cmd.execute(w.context(), input, metadata)
+	track.Finish(err)
+
+	// Another instance may have taken over the lease.
+	if w.context().Err() != nil {
+		log.Printf("trigger %q: lost the lease; discarding the result", w.path)
+		return false, nil
 	}
 
-	timeout := make(chan struct{}, 100)
-	go func() {
-		for {
-			scheduler.WaitUntil(checkScheduler.ScheduleNext(time.Now()))
-			timeout <- struct{}{}
+	// An error running the command is not actually a trigger error.
+	// We still store the result, if there is one.
+	if err != nil {
+		log.Printf("error running trigger %q (%d): %v", w.path, parent, err)
+	} else {
+		if Verbose {
+			log.Printf("ran trigger %q (ok)", w.path)
 		}
-	}()
+	}
+	if result == nil {
+		return false, nil
+	}
 
-	for {
-		select {
-		case <-notify:
-			metricNodeStoredHintsReceived.Inc()
-			if Verbose {
-				log.Printf("trigger-worker %q woke up: notified", path)
+	_, err = w.db.InsertExecution(w.path, result, w.info, &parent)
+	w.nodesStored <- w.path
+	return result.Success, err
+}
+
+// silenced returns whether the trigger is currently silenced, or was
+// silenced at any of the given times (e.g. the root time of an old
+// analysis only now being checked). If it is, the suppressed firing is
+// recorded, and logged and counted the first time for the execution, as
+// a periodic trigger checks the same execution until it is superseded.
+func (w *worker) silenced(parent int64, input string, at ...time.Time) (bool, error) {
+	now := time.Now()
+	var silence *storage.Silence
+	for _, t := range append([]time.Time{now}, at...) {
+		silences, err := w.db.GetActiveSilences(t)
+		if err != nil {
+			return false, err
+		}
+		var started []*storage.Silence
+		for _, s := range silences {
+			if !s.Created.After(t) {
+				started = append(started, s)
 			}
-		case <-timeout:
+		}
+		if silence = alerts.FindSilence(started, w.path); silence != nil {
+			break
+		}
+	}
+	if silence == nil {
+		return false, nil
+	}
+
+	reason := fmt.Sprintf("silenced by silence %d (%s): %s", silence.Id, silence.Author, silence.Comment)
+	recorded, err := w.db.RecordSuppressedFiring(w.path, parent, &silence.Id, reason, input, now)
+	if recorded {
+		log.Printf("trigger %q silenced by silence %d (%q by %q, until %v)", w.path, silence.Id, silence.Comment, silence.Author, silence.Expires)
+		metricTriggerSuppressed.WithLabelValues(w.path, "silenced").Inc()
+	}
+	return true, err
+}
+
+// periodic is a trigger that runs whenever its condition holds for the
+// latest analysis, at most once per period (or once per period per
+// deduplication key). Unlike analyses, periodic and stateful triggers do
+// not use the work queue: they only ever act on the latest execution of
+// their parent, which is a single indexed lookup.
+type periodic struct {
+	run       *command
+	period    time.Duration
+	dedupKey  dedupKeyFunc
+	condition *condition
+}
+
+// freshDedupKeys returns the keys of the input that have not fired within
+// the period. If the input has no keys, it returns nil and false.
+func (p *periodic) freshDedupKeys(w *worker, input string) ([]string, bool, error) {
+	if p.dedupKey == nil {
+		return nil, false, nil
+	}
+
+	keys, err := p.dedupKey(input)
+	if err != nil {
+		log.Printf("unable to extract dedup keys for trigger %q: %v", w.path, err)
+		return nil, false, nil
+	}
+	if len(keys) == 0 {
+		return nil, false, nil
+	}
+
+	var fresh []string
+	for _, key := range keys {
+		lastTrigger, err := w.db.GetTimeOfLatestDedupFiring(w.path, key)
+		if err != nil {
+			return nil, false, err
+		}
+		if lastTrigger != nil && time.Since(*lastTrigger) < p.period {
 			if Verbose {
-				log.Printf("trigger-worker %q woke up: timeout", path)
+				log.Printf("trigger %q: key %q last fired %v", w.path, key, *lastTrigger)
 			}
+			continue
 		}
+		fresh = append(fresh, key)
+	}
+	return fresh, true, nil
+}
+
+func (p *periodic) check(w *worker) error {
+	item, err := w.db.GetLatestExecutionIfChildless(w.parentPath, w.path)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return nil
+	}
+	triggerInput, holds, _, err := p.condition.evaluate(w.db, w.parentPath, item)
+	if err != nil || !holds {
+		return err
+	}
+
+	if Verbose {
+		log.Printf("would trigger %q: %q [item root time %q]", w.path, triggerInput, item.RootTime)
+	}
+
+	freshKeys, hasKeys, err := p.freshDedupKeys(w, triggerInput)
+	if err != nil {
+		return err
+	}
 
-		item, err := db.GetLatestExecutionIfChildless(parentPath, path)
+	if hasKeys {
+		if len(freshKeys) == 0 {
+			log.Printf("skipping trigger %q: every key has fired within the last %v", w.path, p.period)
+			return nil
+		}
+	} else {
+		lastTrigger, err := w.db.GetTimeOfLatestSuccessfulExecution(w.path)
 		if err != nil {
 			return err
 		}
-		if item == nil {
-			continue
-		}
-		triggerInput := strings.TrimSpace(item.Result.Stdout)
-		if triggerInput == "" {
-			continue
+
+		if lastTrigger != nil {
+			if dur := time.Since(*lastTrigger); dur < p.period {
+				log.Printf("skipping trigger %q: only %v since last trigger (%v, period %v)", w.path, dur, *lastTrigger, p.period)
+				return nil
+			}
 		}
+	}
 
-		if Verbose {
-			log.Printf("would trigger %q: %q [item root time %q]", path, triggerInput, item.RootTime)
+	// An analysis from during a silence that has since expired stays
+	// silenced, rather than firing late.
+	if silenced, err := w.silenced(item.Id, triggerInput, item.RootTime); err != nil || silenced {
+		return err
+	}
+
+	return w.db.WithLease(fmt.Sprintf("trigger:%s:%d", w.path, item.Id), p.run.timeout+time.Second, func(ctx context.Context) error {
+		w := w.leased(ctx)
+		log.Printf("running trigger %q: [root time: %v] %q", w.path, item.RootTime, triggerInput)
+
+		metadata := w.metadata("trigger", item)
+		metadata["condition"] = p.condition.name
+		if hasKeys {
+			metadata["dedup_keys"] = strings.Join(freshKeys, "\n")
 		}
 
-		lastTrigger, err := db.GetTimeOfLatestSuccessfulExecution(path)
-		if err != nil {
+		t := time.Now()
+		ok, err := w.run(p.run, triggerInput, item.Id, metadata)
+		if err != nil || !ok {
 			return err
 		}
 
-		if lastTrigger != nil {
-			if dur := time.Since(*lastTrigger); dur < triggerPeriod {
-				log.Printf("skipping trigger %q: only %v since last trigger (%v, period %v)", path, dur, *lastTrigger, triggerPeriod)
-				continue
+		for _, key := range freshKeys {
+			if err := w.db.RecordDedupFiring(w.path, key, t); err != nil {
+				return err
 			}
 		}
+		return nil
+	})
+}
+
+// lifecycle is a stateful trigger, which fires when its condition starts
+// holding for the latest analysis, optionally repeats while it keeps
+// holding, and resolves when it no longer does.
+type lifecycle struct {
+	onFire    *command
+	onRepeat  *command
+	onResolve *command
+	repeat    time.Duration
+	condition *condition
+
+	// A failed command is retried after a growing delay rather than on
+	// every check, as each failure is stored.
+	backoff    *backoff.ExponentialBackOff
+	retryAfter time.Time
+}
+
+// failed puts off running the commands of the trigger again after one has
+// failed.
+func (l *lifecycle) failed(w *worker) error {
+	dur := l.backoff.NextBackOff()
+	l.retryAfter = time.Now().Add(dur)
+	log.Printf("trigger %q: command failed: not retrying for %v to throttle failures", w.path, dur)
+	return nil
+}
+
+func (l *lifecycle) leaseDuration() time.Duration {
+	rv := l.onFire.timeout
+	for _, cmd := range []*command{l.onRepeat, l.onResolve} {
+		if cmd != nil && cmd.timeout > rv {
+			rv = cmd.timeout
+		}
+	}
+	return rv + time.Second
+}
+
+// runUnlessSilenced runs the command unless the trigger is silenced. It
+// returns whether it was silenced, and otherwise whether the command
+// succeeded. If the command failed the alert state should be left as it
+// was, so that the next check tries again.
+func (w *worker) runUnlessSilenced(cmd *command, input string, parent int64, metadata map[string]string) (silenced, ok bool, err error) {
+	if silenced, err := w.silenced(parent, input); err != nil || silenced {
+		return silenced, false, err
+	}
+	ok, err = w.run(cmd, input, parent, metadata)
+	if err == nil && !ok {
+		log.Printf("trigger %q: command failed; will retry", w.path)
+	}
+	return false, ok, err
+}
+
+func (l *lifecycle) metadata(w *worker, event string, item *storage.NodeRow, firingSince time.Time) map[string]string {
+	rv := w.metadata(event, item)
+	rv["condition"] = l.condition.name
+	rv["firing_since"] = firingSince.Format(time.RFC3339)
+	return rv
+}
+
+func (l *lifecycle) check(w *worker) error {
+	if time.Now().Before(l.retryAfter) {
+		return nil
+	}
 
-		err = db.WithLease(fmt.Sprintf("trigger:%s:%d", path, item.Id), runTimeout+time.Second, func() error {
-			log.Printf("running trigger %q: [root time: %v] %q", path, item.RootTime, triggerInput)
+	item, err := w.db.GetLatestExecution(w.parentPath)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return nil
+	}
+
+	triggerInput, firing, ok, err := l.condition.evaluate(w.db, w.parentPath, item)
+	if err != nil || !ok {
+		return err
+	}
 
-			track := beginTracking(path)
-			result, err := runner.Run(runSpec, runner.WithTimeout(runTimeout), runner.WithInput(triggerInput))
-			track.Finish(err)
+	return w.db.WithLease("alert:"+w.path, l.leaseDuration(), func(ctx context.Context) error {
+		w := w.leased(ctx)
+		state, err := w.db.GetAlertState(w.path)
+		if err != nil {
+			return err
+		}
+		if state == nil {
+			state = &storage.AlertState{TriggerPath: w.path}
+		}
 
-			// An error running the command is not actually a trigger error.
-			// We still store the result.
+		now := time.Now()
+
+		switch {
+		case firing && !state.Firing():
+			log.Printf("trigger %q firing: [root time: %v] %q", w.path, item.RootTime, triggerInput)
+			silenced, ok, err := w.runUnlessSilenced(l.onFire, triggerInput, item.Id, l.metadata(w, "fire", item, now))
 			if err != nil {
-				log.Printf("error running trigger %q (%d): %v", path, item.Id, err)
-			} else {
+				return err
+			}
+			if !(ok || silenced) {
+				return l.failed(w)
+			}
+			// A silenced firing is recorded without being notified, so
+			// that on_fire is run once the silence is gone.
+			state.FiringSince = &now
+			state.FiringInput = triggerInput
+			state.LastNotified = nil
+			if ok {
+				state.LastNotified = &now
+			}
+			state.ResolvedAt = nil
+
+		case firing && state.LastNotified == nil:
+			if state.Acknowledged != nil {
+				return nil
+			}
+			log.Printf("trigger %q firing (since %v, until now silenced): [root time: %v] %q", w.path, *state.FiringSince, item.RootTime, triggerInput)
+			silenced, ok, err := w.runUnlessSilenced(l.onFire, triggerInput, item.Id, l.metadata(w, "fire", item, *state.FiringSince))
+			if err != nil || silenced {
+				return err
+			}
+			if !ok {
+				return l.failed(w)
+			}
+			state.FiringInput = triggerInput
+			state.LastNotified = &now
+
+		case firing && state.Firing():
+			if l.repeat == 0 {
+				return nil
+			}
+			if now.Sub(*state.LastNotified) < l.repeat {
+				return nil
+			}
+			if state.Acknowledged != nil {
 				if Verbose {
-					log.Printf("ran trigger %q (ok)", path)
+					log.Printf("trigger %q still firing, but acknowledged by %q at %v", w.path, state.AcknowledgedBy, *state.Acknowledged)
+				}
+				reason := fmt.Sprintf("acknowledged by %s", state.AcknowledgedBy)
+				recorded, err := w.db.RecordSuppressedFiring(w.path, item.Id, nil, reason, triggerInput, now)
+				if recorded {
+					metricTriggerSuppressed.WithLabelValues(w.path, "acknowledged").Inc()
 				}
+				return err
 			}
+			cmd := l.onRepeat
+			if cmd == nil {
+				cmd = l.onFire
+			}
+			log.Printf("trigger %q still firing (since %v): [root time: %v] %q", w.path, *state.FiringSince, item.RootTime, triggerInput)
+			silenced, ok, err := w.runUnlessSilenced(cmd, triggerInput, item.Id, l.metadata(w, "repeat", item, *state.FiringSince))
+			if err != nil {
+				return err
+			}
+			if !(ok || silenced) {
+				return l.failed(w)
+			}
+			// A silenced repeat is skipped rather than postponed.
+			state.FiringInput = triggerInput
+			state.LastNotified = &now
+
+		case !firing && state.Firing():
+			log.Printf("trigger %q resolved (was firing since %v)", w.path, *state.FiringSince)
+			// Nobody was notified of a firing that was silenced throughout,
+			// so nobody is notified of its resolution either.
+			if l.onResolve != nil && state.LastNotified != nil {
+				silenced, ok, err := w.runUnlessSilenced(l.onResolve, state.FiringInput, item.Id, l.metadata(w, "resolve", item, *state.FiringSince))
+				if err != nil {
+					return err
+				}
+				if !(ok || silenced) {
+					return l.failed(w)
+				}
+			}
+			state.FiringSince = nil
+			state.ResolvedAt = &now
 
-			_, err = db.InsertExecution(path, result, info, &item.Id)
-			nodesStored <- path
-			return err
-		})
+		default:
+			return nil
+		}
+
+		value := 0.0
+		if state.Firing() {
+			value = 1.0
+		}
+		metricAlertFiring.WithLabelValues(w.path).Set(value)
+
+		l.backoff.Reset()
+		return w.db.SetAlertState(state)
+	})
+}
+
+type checker interface {
+	check(w *worker) error
+}
+
+func newChecker(spec *config.TriggerSpec) (checker, error) {
+	if spec.Digest != nil {
+		return newDigest(spec)
+	}
+
+	cond, err := newCondition(spec.Condition)
+	if err != nil {
+		return nil, err
+	}
+
+	if !spec.Stateful() {
+		triggerPeriod, err := time.ParseDuration(spec.Period)
+		if err != nil {
+			return nil, err
+		}
+
+		run, err := newCommand(spec.Run)
+		if err != nil {
+			return nil, err
+		}
+
+		dedupKey, err := newDedupKeyFunc(spec.DedupKey)
 		if err != nil {
+			return nil, err
+		}
+
+		return &periodic{run, triggerPeriod, dedupKey, cond}, nil
+	}
+
+	// As with failing watches, but a notification is not put off for more
+	// than an hour, and checks come a minute or two apart anyway.
+	l := &lifecycle{condition: cond, backoff: backoff.NewExponentialBackOff()}
+	l.backoff.InitialInterval = time.Minute
+	l.backoff.MaxElapsedTime = 0
+	l.backoff.MaxInterval = time.Hour
+
+	if l.onFire, err = newCommand(spec.OnFire); err != nil {
+		return nil, fmt.Errorf("in on_fire: %v", err)
+	}
+	if l.onRepeat, err = newCommand(spec.OnRepeat); err != nil {
+		return nil, fmt.Errorf("in on_repeat: %v", err)
+	}
+	if l.onResolve, err = newCommand(spec.OnResolve); err != nil {
+		return nil, fmt.Errorf("in on_resolve: %v", err)
+	}
+	if spec.Repeat != "" {
+		if l.repeat, err = time.ParseDuration(spec.Repeat); err != nil {
+			return nil, err
+		}
+	}
+
+	return l, nil
+}
+
+func TriggerWorker(db storage.Store, parentPath, path string, spec *config.TriggerSpec, notify <-chan struct{}, nodesStored chan<- string) error {
+	log.Printf("starting trigger-worker for node %q", path)
+
+	metricTriggersStarted.WithLabelValues(path).Inc()
+
+	info, err := hostinfo.Get()
+	if err != nil {
+		return fmt.Errorf("error getting hostinfo: %v", err)
+	}
+
+	chk, err := newChecker(spec)
+	if err != nil {
+		return err
+	}
+
+	w := &worker{
+		db:          db,
+		parentPath:  parentPath,
+		path:        path,
+		info:        info,
+		nodesStored: nodesStored,
+	}
+
+	checkScheduler := scheduler.UniformRandom{
+		time.Minute,
+		2 * time.Minute,
+	}
+
+	for {
+		timeout := time.NewTimer(time.Until(checkScheduler.ScheduleNext(time.Now())))
+		select {
+		case <-notify:
+			metricNodeStoredHintsReceived.Inc()
+			if Verbose {
+				log.Printf("trigger-worker %q woke up: notified", path)
+			}
+		case <-timeout.C:
+			if Verbose {
+				log.Printf("trigger-worker %q woke up: timeout", path)
+			}
+		}
+		timeout.Stop()
+
+		if err := chk.check(w); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,514 @@
+package trigger
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/hostinfo"
+	"github.com/steinarvk/watcher/notify"
+	"github.com/steinarvk/watcher/runner"
+	"github.com/steinarvk/watcher/scheduler"
+	"github.com/steinarvk/watcher/storage"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// insertAnalysis stores a watch execution and an analysis of it with the
+// given output, as if they had just run.
+func insertAnalysis(t *testing.T, db storage.Store, start time.Time, stdout string) int64 {
+	t.Helper()
+	info := &hostinfo.HostInfo{Hostname: "testhost"}
+	watchId, err := db.InsertExecution("w", &runner.Result{Start: start, Stop: start, Success: true}, info, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := db.InsertExecution("w/a", &runner.Result{Start: start, Stop: start, Stdout: stdout, Success: true}, info, &watchId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func waitForStored(t *testing.T, nodesStored <-chan string, path string) {
+	t.Helper()
+	select {
+	case got := <-nodesStored:
+		if got != path {
+			t.Fatalf("got stored node %q want %q", got, path)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for %q", path)
+	}
+}
+
+func TestPeriodicTrigger(t *testing.T) {
+	db := storage.NewMemory()
+	parent := insertAnalysis(t, db, time.Now(), "too hot\n")
+
+	notify := make(chan struct{}, 100)
+	nodesStored := make(chan string, 100)
+	spec := &config.TriggerSpec{
+		Name:   "t",
+		Period: "1h",
+		Run:    &config.TriggerCommand{Config: runner.Config{Shell: "sed 's/^/alert: /'"}},
+	}
+	go func() {
+		if err := TriggerWorker(db, "w/a", "w/a/t", spec, notify, nodesStored); err != nil {
+			t.Errorf("TriggerWorker() = %v", err)
+		}
+	}()
+
+	notify <- struct{}{}
+	waitForStored(t, nodesStored, "w/a/t")
+
+	latest, err := db.GetLatestExecution("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil || latest.Result.Stdout != "alert: too hot" {
+		t.Fatalf("got trigger execution %+v want output %q", latest, "alert: too hot")
+	}
+
+	// A new analysis within the period does not trigger again.
+	insertAnalysis(t, db, time.Now().Add(time.Second), "still too hot\n")
+	notify <- struct{}{}
+	time.Sleep(100 * time.Millisecond)
+
+	rows, err := db.QueryExecutionResults("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		t.Errorf("got %d trigger executions want 1 (for %d)", len(rows), parent)
+	}
+}
+
+func TestStatefulTrigger(t *testing.T) {
+	db := storage.NewMemory()
+	t0 := time.Now()
+	insertAnalysis(t, db, t0, "too hot\n")
+
+	notify := make(chan struct{}, 100)
+	nodesStored := make(chan string, 100)
+	spec := &config.TriggerSpec{
+		Name:      "t",
+		OnFire:    &config.TriggerCommand{Config: runner.Config{Shell: "sed 's/^/firing: /'"}},
+		OnResolve: &config.TriggerCommand{Config: runner.Config{Shell: "sed 's/^/resolved: /'"}},
+	}
+	go func() {
+		if err := TriggerWorker(db, "w/a", "w/a/t", spec, notify, nodesStored); err != nil {
+			t.Errorf("TriggerWorker() = %v", err)
+		}
+	}()
+
+	notify <- struct{}{}
+	waitForStored(t, nodesStored, "w/a/t")
+
+	state, err := db.GetAlertState("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == nil || !state.Firing() || state.FiringInput != "too hot" {
+		t.Fatalf("got alert state %+v want firing with input %q", state, "too hot")
+	}
+
+	insertAnalysis(t, db, t0.Add(time.Second), "")
+	notify <- struct{}{}
+	waitForStored(t, nodesStored, "w/a/t")
+
+	rows, err := db.QueryExecutionResults("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Result.Stdout != "firing: too hot" || rows[1].Result.Stdout != "resolved: too hot" {
+		t.Fatalf("got %d trigger executions want firing and resolved", len(rows))
+	}
+
+	state, err = db.GetAlertState("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Firing() || state.ResolvedAt == nil {
+		t.Errorf("got alert state %+v want resolved", state)
+	}
+}
+
+// newTestWorker returns a worker for the trigger "w/a/t" of the analysis
+// "w/a", whose checks can be run synchronously.
+func newTestWorker(t *testing.T, db storage.Store, spec *config.TriggerSpec) (*worker, checker) {
+	t.Helper()
+	chk, err := newChecker(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &worker{
+		db:          db,
+		parentPath:  "w/a",
+		path:        "w/a/t",
+		info:        &hostinfo.HostInfo{Hostname: "testhost"},
+		nodesStored: make(chan string, 100),
+	}
+	return w, chk
+}
+
+func TestStatefulTriggerRetriesFailedNotification(t *testing.T) {
+	db := storage.NewMemory()
+	t0 := time.Now()
+	insertAnalysis(t, db, t0, "too hot\n")
+
+	flag := filepath.Join(t.TempDir(), "up")
+	w, chk := newTestWorker(t, db, &config.TriggerSpec{
+		Name:      "t",
+		OnFire:    &config.TriggerCommand{Config: runner.Config{Shell: "test -e " + flag}},
+		OnResolve: &config.TriggerCommand{Config: runner.Config{Shell: "test -e " + flag}},
+	})
+
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := db.GetAlertState("w/a/t"); err != nil || (state != nil && state.Firing()) {
+		t.Fatalf("got alert state %+v, %v after failed on_fire want not firing", state, err)
+	}
+
+	// The failed command is not retried until the backoff has passed.
+	if err := ioutil.WriteFile(flag, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+	if n := countExecutions(t, db, "w/a/t"); n != 1 {
+		t.Fatalf("got %d trigger executions right after a failure want 1", n)
+	}
+
+	chk.(*lifecycle).retryAfter = time.Time{}
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := db.GetAlertState("w/a/t"); err != nil || state == nil || !state.Firing() {
+		t.Fatalf("got alert state %+v, %v after retried on_fire want firing", state, err)
+	}
+
+	if err := os.Remove(flag); err != nil {
+		t.Fatal(err)
+	}
+	insertAnalysis(t, db, t0.Add(time.Second), "")
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := db.GetAlertState("w/a/t"); err != nil || !state.Firing() {
+		t.Fatalf("got alert state %+v, %v after failed on_resolve want still firing", state, err)
+	}
+
+	rows, err := db.QueryExecutionResults("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0].Result.Success || !rows[1].Result.Success || rows[2].Result.Success {
+		t.Errorf("got %d trigger executions want failed, succeeded and failed", len(rows))
+	}
+}
+
+func countExecutions(t *testing.T, db storage.Store, path string) int {
+	t.Helper()
+	rows, err := db.QueryExecutionResults(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(rows)
+}
+
+func TestSilencedFiringNotifiedAfterSilence(t *testing.T) {
+	db := storage.NewMemory()
+	t0 := time.Now()
+	insertAnalysis(t, db, t0, "too hot\n")
+
+	w, chk := newTestWorker(t, db, &config.TriggerSpec{
+		Name:   "t",
+		OnFire: &config.TriggerCommand{Config: runner.Config{Shell: "sed 's/^/firing: /'"}},
+	})
+
+	silence := &storage.Silence{PathPattern: "w/a/*", Created: t0, Expires: t0.Add(time.Hour), Author: "tester"}
+	id, err := db.CreateSilence(silence)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+	state, err := db.GetAlertState("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state == nil || !state.Firing() || state.LastNotified != nil {
+		t.Fatalf("got alert state %+v want firing and not notified", state)
+	}
+	if n := countExecutions(t, db, "w/a/t"); n != 0 {
+		t.Fatalf("got %d trigger executions while silenced want 0", n)
+	}
+
+	if err := db.ExpireSilence(id, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+	if n := countExecutions(t, db, "w/a/t"); n != 1 {
+		t.Fatalf("got %d trigger executions after silence want 1", n)
+	}
+	if state, err = db.GetAlertState("w/a/t"); err != nil || !state.Firing() || state.LastNotified == nil {
+		t.Errorf("got alert state %+v, %v want firing and notified", state, err)
+	}
+}
+
+func TestAcknowledgedAlertNotRepeated(t *testing.T) {
+	db := storage.NewMemory()
+	insertAnalysis(t, db, time.Now(), "too hot\n")
+
+	w, chk := newTestWorker(t, db, &config.TriggerSpec{
+		Name:   "t",
+		OnFire: &config.TriggerCommand{Config: runner.Config{Shell: "cat"}},
+		Repeat: "1ms",
+	})
+
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+	if n := countExecutions(t, db, "w/a/t"); n != 2 {
+		t.Fatalf("got %d trigger executions want firing and a repeat", n)
+	}
+
+	if err := db.AcknowledgeAlert("w/a/t", "tester", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+	if n := countExecutions(t, db, "w/a/t"); n != 2 {
+		t.Errorf("got %d trigger executions after acknowledgement want 2", n)
+	}
+}
+
+func TestPeriodicTriggerSilencedAtRootTime(t *testing.T) {
+	db := storage.NewMemory()
+	now := time.Now()
+	insertAnalysis(t, db, now.Add(-time.Minute), "too hot\n")
+
+	// The silence covered the analysis, but has expired since.
+	silence := &storage.Silence{PathPattern: "w/a/t", Created: now.Add(-2 * time.Minute), Expires: now.Add(-30 * time.Second), Author: "tester"}
+	if _, err := db.CreateSilence(silence); err != nil {
+		t.Fatal(err)
+	}
+
+	w, chk := newTestWorker(t, db, &config.TriggerSpec{
+		Name:   "t",
+		Period: "1ms",
+		Run:    &config.TriggerCommand{Config: runner.Config{Shell: "cat"}},
+	})
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+	if n := countExecutions(t, db, "w/a/t"); n != 0 {
+		t.Fatalf("got %d trigger executions for an analysis from during a silence want 0", n)
+	}
+
+	insertAnalysis(t, db, now, "still too hot\n")
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+	if n := countExecutions(t, db, "w/a/t"); n != 1 {
+		t.Errorf("got %d trigger executions for a later analysis want 1", n)
+	}
+}
+
+func TestPeriodicTriggerSilencedOncePerItem(t *testing.T) {
+	db := storage.NewMemory()
+	insertAnalysis(t, db, time.Now(), "too hot\n")
+	silence := &storage.Silence{PathPattern: "w/a/t", Created: time.Now().Add(-time.Minute), Expires: time.Now().Add(time.Hour), Author: "tester"}
+	if _, err := db.CreateSilence(silence); err != nil {
+		t.Fatal(err)
+	}
+
+	w, chk := newTestWorker(t, db, &config.TriggerSpec{
+		Name:   "t",
+		Period: "1ms",
+		Run:    &config.TriggerCommand{Config: runner.Config{Shell: "cat"}},
+	})
+	suppressed := metricTriggerSuppressed.WithLabelValues("w/a/t", "silenced")
+	before := testutil.ToFloat64(suppressed)
+
+	// The same analysis is checked on every wakeup while it is the latest.
+	for i := 0; i < 3; i++ {
+		if err := chk.check(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := testutil.ToFloat64(suppressed) - before; got != 1 {
+		t.Errorf("counted %v suppressed firings of one analysis want 1", got)
+	}
+}
+
+func TestNotifyTrigger(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		got = string(data)
+	}))
+	defer server.Close()
+
+	spec := &config.TriggerSpec{}
+	err := yaml.UnmarshalStrict([]byte(`
+name: t
+on_fire:
+  notify:
+    webhook:
+      url: `+server.URL+`
+      body: "{{.Metadata.event}}: {{.Input}}"
+  timeout: 10s
+`), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spec.OnFire.Check(); err != nil {
+		t.Fatalf("Check() = %v", err)
+	}
+
+	db := storage.NewMemory()
+	insertAnalysis(t, db, time.Now(), "too hot")
+	w, chk := newTestWorker(t, db, spec)
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+	if got != "fire: too hot" {
+		t.Errorf("webhook received %q want %q", got, "fire: too hot")
+	}
+
+	latest, err := db.GetLatestExecution("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil || !latest.Result.Success || !strings.Contains(latest.Result.Stdout, "POST") {
+		t.Errorf("got trigger execution %+v want the delivery result", latest)
+	}
+}
+
+func TestNotifyExclusiveWithCommand(t *testing.T) {
+	cmd := &config.TriggerCommand{
+		Config: runner.Config{Shell: "cat"},
+		Notify: &notify.Config{Webhook: &notify.WebhookConfig{URL: "http://localhost/"}},
+	}
+	if err := cmd.Check(); err == nil {
+		t.Errorf("Check() of notify with a command = unexpected success")
+	}
+}
+
+func TestDigestTrigger(t *testing.T) {
+	db := storage.NewMemory()
+	if err := db.SetChildren(map[string][]string{"w/a": {"w/a/t"}}); err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Now()
+	insertAnalysis(t, db, t0, "before the trigger\n")
+
+	w, chk := newTestWorker(t, db, &config.TriggerSpec{
+		Name: "t",
+		Run:  &config.TriggerCommand{Config: runner.Config{Shell: "cat"}},
+		Digest: &config.DigestSpec{
+			Schedule: &scheduler.Config{Period: "1h"},
+			Format:   config.DigestFormatJSON,
+		},
+	})
+
+	// The first check starts the digest from now on.
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+
+	first := insertAnalysis(t, db, t0.Add(time.Second), "one\n")
+	insertAnalysis(t, db, t0.Add(2*time.Second), "\n")
+	second := insertAnalysis(t, db, t0.Add(3*time.Second), "two\n")
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := db.GetDigestItems("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].ExecutionId != first || items[1].ExecutionId != second {
+		t.Fatalf("got digest items %+v want the nonempty outputs %d and %d", items, first, second)
+	}
+	pending, err := db.GetPendingWork("w/a/t", 10)
+	if err != nil || len(pending) != 0 {
+		t.Errorf("GetPendingWork(w/a/t) = %+v, %v want the collected work deleted", pending, err)
+	}
+
+	// Nothing is delivered before the digest is due.
+	if latest, err := db.GetLatestExecution("w/a/t"); err != nil || latest != nil {
+		t.Fatalf("got trigger execution %+v, %v before the digest was due", latest, err)
+	}
+	state, err := db.GetDigestState("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.LastDelivered = t0.Add(-2 * time.Hour)
+	if err := db.SetDigestState(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := chk.check(w); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err := db.GetLatestExecution("w/a/t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest == nil || !strings.Contains(latest.Result.Stdout, `"input":"one"`) || !strings.Contains(latest.Result.Stdout, `"input":"two"`) || strings.Contains(latest.Result.Stdout, "before") {
+		t.Fatalf("got trigger execution %+v want a digest of one and two", latest)
+	}
+	if items, err := db.GetDigestItems("w/a/t"); err != nil || len(items) != 0 {
+		t.Errorf("GetDigestItems(w/a/t) = %+v, %v want none after delivery", items, err)
+	}
+}
+
+func TestLostLeaseDiscardsResult(t *testing.T) {
+	db := storage.NewMemory()
+	parent := insertAnalysis(t, db, time.Now(), "too hot\n")
+
+	w, _ := newTestWorker(t, db, &config.TriggerSpec{
+		Name:   "t",
+		Period: "1h",
+		Run:    &config.TriggerCommand{Config: runner.Config{Shell: "cat"}},
+	})
+	cmd, err := newCommand(&config.TriggerCommand{Config: runner.Config{Shell: "cat"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ok, err := w.leased(ctx).run(cmd, "too hot", parent, w.metadata("trigger", &storage.NodeRow{Id: parent}))
+	if err != nil || ok {
+		t.Errorf("run() after losing the lease = %v, %v want not ok", ok, err)
+	}
+	if latest, err := db.GetLatestExecution("w/a/t"); err != nil || latest != nil {
+		t.Errorf("got trigger execution %+v, %v want none stored after losing the lease", latest, err)
+	}
+}
@@ -1,6 +1,7 @@
 package watch
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
@@ -36,6 +37,15 @@ var (
 		[]string{"name"},
 	)
 
+	metricWatchOfflineRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "watcher",
+			Name:      "watch_offline_runs",
+			Help:      "Number of times a watch was run on the local schedule because the database was unavailable",
+		},
+		[]string{"name"},
+	)
+
 	metricWatchRuns = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "watcher",
@@ -70,6 +80,7 @@ func init() {
 	prometheus.MustRegister(metricWatchRunsFinished)
 	prometheus.MustRegister(metricWatchRunLatency)
 	prometheus.MustRegister(metricWatchersStarted)
+	prometheus.MustRegister(metricWatchOfflineRuns)
 }
 
 type cmdTracker struct {
@@ -111,7 +122,7 @@ const (
 	timeoutSlack = time.Second
 )
 
-func Watch(db *storage.DB, watch *config.WatchSpec, nodesStored chan<- string) error {
+func Watch(db storage.Store, watch *config.WatchSpec, nodesStored chan<- string) error {
 	log.Printf("starting watcher for node %q", watch.Name)
 
 	metricWatchersStarted.WithLabelValues(watch.Name).Inc()
@@ -144,14 +155,65 @@ func Watch(db *storage.DB, watch *config.WatchSpec, nodesStored chan<- string) e
 	backoff.MaxElapsedTime = 0
 	backoff.MaxInterval = 24 * time.Hour
 
+	execute := func(ctx context.Context) error {
+		log.Printf("running %q", watch.Name)
+
+		track := beginTracking(watch.Name)
+		result, err := runner.Run(runSpec, runner.WithTimeout(timeout), runner.WithContext(ctx))
+		track.Finish(err)
+
+		// Another instance may be running the watch now.
+		if ctx.Err() != nil {
+			log.Printf("running %q: lost the lease; discarding the result", watch.Name)
+			return nil
+		}
+
+		if err != nil {
+			log.Printf("running %q: failed: %v", watch.Name, err)
+			dur := backoff.NextBackOff()
+			log.Printf("running %q failed: sleeping %v to throttle failures", watch.Name, dur)
+			time.Sleep(dur)
+			return nil
+		}
+		backoff.Reset()
+
+		if _, err := db.WithContext(ctx).InsertExecution(watch.Name, result, info, nil); err != nil {
+			if ctx.Err() != nil {
+				log.Printf("running %q: lost the lease while storing the result; discarding it", watch.Name)
+				return nil
+			}
+			return err
+		}
+		nodesStored <- watch.Name
+
+		return nil
+	}
+
+	// While the database cannot schedule the watch or lease it, the watch
+	// is run on a local schedule instead, so that its results can be
+	// spooled. Other instances may then run it too.
+	executeOffline := func(cause error) error {
+		log.Printf("unable to coordinate %q through the database (%v): running on the local schedule", watch.Name, cause)
+		metricWatchOfflineRuns.WithLabelValues(watch.Name).Inc()
+
+		next := scheduleSpec.ScheduleNext(time.Now())
+		metricWatchNextScheduledRun.WithLabelValues(watch.Name).Set(float64(next.UnixNano()) / float64(time.Second))
+		scheduler.WaitUntil(next)
+
+		return execute(context.Background())
+	}
+
 	for {
 		next, got, err := db.NextScheduledSpecificEvent(watch.Name)
 		if err != nil {
-			return err
+			if err := executeOffline(err); err != nil {
+				return err
+			}
+			continue
 		}
 
 		if !got {
-			err := db.WithLease("schedule:"+watch.Name, time.Second, func() error {
+			err := db.WithLease("schedule:"+watch.Name, time.Second, func(context.Context) error {
 				next = scheduleSpec.ScheduleNext(time.Now())
 				if Verbose {
 					log.Printf("scheduling %q for %v", watch.Name, next)
@@ -159,7 +221,10 @@ func Watch(db *storage.DB, watch *config.WatchSpec, nodesStored chan<- string) e
 				return db.ScheduleEvent(watch.Name, next)
 			})
 			if err != nil {
-				return err
+				if err := executeOffline(err); err != nil {
+					return err
+				}
+				continue
 			}
 		}
 
@@ -178,33 +243,17 @@ func Watch(db *storage.DB, watch *config.WatchSpec, nodesStored chan<- string) e
 		}
 		scheduler.WaitUntil(next)
 
-		err = db.WithLease("execute:"+watch.Name, timeout+timeoutSlack, func() error {
-			if err := db.Unschedule(watch.Name); err != nil {
+		leased := false
+		err = db.WithLease("execute:"+watch.Name, timeout+timeoutSlack, func(ctx context.Context) error {
+			leased = true
+			if err := db.WithContext(ctx).Unschedule(watch.Name); err != nil {
 				return err
 			}
-
-			log.Printf("running %q", watch.Name)
-
-			track := beginTracking(watch.Name)
-			result, err := runner.Run(runSpec, runner.WithTimeout(timeout))
-			track.Finish(err)
-
-			if err != nil {
-				log.Printf("running %q: failed: %v", watch.Name, err)
-				dur := backoff.NextBackOff()
-				log.Printf("running %q failed: sleeping %v to throttle failures", watch.Name, dur)
-				time.Sleep(dur)
-				return nil
-			}
-			backoff.Reset()
-
-			if _, err := db.InsertExecution(watch.Name, result, info, nil); err != nil {
-				return err
-			}
-			nodesStored <- watch.Name
-
-			return nil
+			return execute(ctx)
 		})
+		if err != nil && !leased {
+			err = executeOffline(err)
+		}
 		if err != nil {
 			return err
 		}
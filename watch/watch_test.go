@@ -0,0 +1,51 @@
+package watch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/steinarvk/watcher/config"
+	"github.com/steinarvk/watcher/runner"
+	"github.com/steinarvk/watcher/scheduler"
+	"github.com/steinarvk/watcher/storage"
+)
+
+func TestWatch(t *testing.T) {
+	db := storage.NewMemory()
+	nodesStored := make(chan string, 100)
+
+	spec := &config.WatchSpec{
+		Name:     "greeting",
+		Run:      &runner.Config{Shell: "echo hello"},
+		Schedule: &scheduler.Config{Period: "10ms"},
+	}
+	go func() {
+		if err := Watch(db, spec, nodesStored); err != nil {
+			t.Errorf("Watch() = %v", err)
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case path := <-nodesStored:
+			if path != "greeting" {
+				t.Errorf("got stored node %q want %q", path, "greeting")
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for execution #%d", i)
+		}
+	}
+
+	rows, err := db.QueryExecutionResults("greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) < 2 {
+		t.Fatalf("got %d executions want at least 2", len(rows))
+	}
+	for _, row := range rows {
+		if !row.Result.Success || row.Result.Stdout != "hello\n" {
+			t.Errorf("execution %d: got %+v", row.Id, row.Result)
+		}
+	}
+}